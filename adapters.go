@@ -2,10 +2,15 @@ package gosqs
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
 const (
-	dispatcherKey = contextKey("dispatcher")
+	dispatcherKey     = contextKey("dispatcher")
+	retryCapKey       = contextKey("retryCap")
+	panicAsSuccessKey = contextKey("panicAsSuccess")
+	retryDLQKey       = contextKey("retryDLQ")
 )
 
 type contextKey string
@@ -17,12 +22,92 @@ type Handler func(context.Context, Message) error
 type Adapter func(Handler) Handler
 
 // WithRecovery is an adapter that logs a Panic error and recovers the service from a failed state
+//
+// recovery is deferred while the handler runs and must call recover() to recover from a panic. A recovered panic fails
+// the message with ErrPanic so it is redelivered, unless Config.PanicAsSuccess is set
 func WithRecovery(recovery func()) Adapter {
 	return func(fn Handler) Handler {
-		return func(ctx context.Context, m Message) error {
+		return func(ctx context.Context, m Message) (err error) {
+			panicked := true
+			// runs after recovery, it is only reached if recovery recovered from the panic
+			defer func() {
+				if panicked {
+					if asSuccess, _ := ctx.Value(panicAsSuccessKey).(bool); !asSuccess {
+						err = ErrPanic.Context(fmt.Errorf("route: %s", m.Route()))
+					}
+				}
+			}()
 			defer recovery()
 
-			return fn(ctx, m)
+			err = fn(ctx, m)
+			panicked = false
+			return err
+		}
+	}
+}
+
+// WithSLA is an adapter that measures the processing time of the handler and calls onBreach when it exceeds the
+// provided duration. The handler is not cancelled, use it for alerting on slow but successful processing
+func WithSLA(d time.Duration, onBreach func(m Message, took time.Duration)) Adapter {
+	return func(fn Handler) Handler {
+		return func(ctx context.Context, m Message) error {
+			start := time.Now()
+			err := fn(ctx, m)
+
+			if took := time.Since(start); took > d {
+				onBreach(m, took)
+			}
+
+			return err
+		}
+	}
+}
+
+// WithTiming is an adapter that measures the processing time of every handler call and reports it along with the
+// route and the returned error, e.g. to log the latency of every route. The error is returned as is
+func WithTiming(log func(route string, d time.Duration, err error)) Adapter {
+	return func(fn Handler) Handler {
+		return func(ctx context.Context, m Message) error {
+			start := time.Now()
+			err := fn(ctx, m)
+
+			log(m.Route(), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// WithRetry is an adapter that retries a failing handler in process up to the provided amount of retries, waiting
+// delay between attempts, before the error is returned and the message is left for redelivery by SQS. With
+// Config.RetryExhaustedDeadLetter and a DLQUrl the message is moved to the DLQ instead
+//
+// Config.MaxInAppRetries caps the retries of every handler on the consumer: the lower of the two applies. The cap
+// never adds retries to a handler that was registered without WithRetry
+func WithRetry(retries int, delay time.Duration) Adapter {
+	return func(fn Handler) Handler {
+		return func(ctx context.Context, m Message) error {
+			max := retries
+			if limit, ok := ctx.Value(retryCapKey).(int); ok && limit < max {
+				max = limit
+			}
+
+			err := fn(ctx, m)
+			for i := 0; err != nil && i < max; i++ {
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(delay):
+				}
+
+				err = fn(ctx, m)
+			}
+
+			// the consumer dead-letters terminal errors, see consumer.discard
+			if err != nil && ctx.Value(retryDLQKey) != nil {
+				return Terminal(err)
+			}
+
+			return err
 		}
 	}
 }
@@ -38,6 +123,16 @@ func WithMiddleware(f func(ctx context.Context, m Message) error) Adapter {
 	}
 }
 
+// WithContextValue is an adapter that adds the key and value to the context of the handler, e.g. a logger, tenant
+// defaults or feature flags. It layers onto the context the consumer provides
+func WithContextValue(key, value interface{}) Adapter {
+	return func(fn Handler) Handler {
+		return func(ctx context.Context, m Message) error {
+			return fn(context.WithValue(ctx, key, value), m)
+		}
+	}
+}
+
 // WithDispatcher sets an adapter to support sending async messages
 func WithDispatcher(ctx context.Context, pub Publisher) context.Context {
 	return context.WithValue(ctx, dispatcherKey, pub)
@@ -61,3 +156,21 @@ func MustDispatcher(ctx context.Context) Publisher {
 
 	panic(ErrUndefinedPublisher.Error())
 }
+
+// namedDispatcherKey is the context key of a named dispatcher, it cannot collide with the unnamed dispatcher
+type namedDispatcherKey string
+
+// WithNamedDispatcher sets a dispatcher under the provided name, allowing multiple publishers to coexist in a context,
+// e.g. for publishing to different topics
+func WithNamedDispatcher(ctx context.Context, name string, pub Publisher) context.Context {
+	return context.WithValue(ctx, namedDispatcherKey(name), pub)
+}
+
+// NamedDispatcher retrieves the dispatcher set under the provided name from the context for sending messages
+func NamedDispatcher(ctx context.Context, name string) (Publisher, error) {
+	if p, ok := ctx.Value(namedDispatcherKey(name)).(Publisher); ok {
+		return p, nil
+	}
+
+	return nil, ErrUndefinedPublisher
+}
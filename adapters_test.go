@@ -0,0 +1,219 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithSLA(t *testing.T) {
+	var breached []time.Duration
+	sla := WithSLA(50*time.Millisecond, func(m Message, took time.Duration) {
+		breached = append(breached, took)
+	})
+
+	t.Run("fast", func(t *testing.T) {
+		h := sla(test)
+		if err := h(context.TODO(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if len(breached) != 0 {
+			t.Fatalf("expected no breach for a fast handler, got %v", breached)
+		}
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		h := sla(func(ctx context.Context, m Message) error {
+			time.Sleep(100 * time.Millisecond)
+			return ErrGetMessage
+		})
+		if err := h(context.TODO(), newStubMessage("post_published", `{}`)); err != ErrGetMessage {
+			t.Fatalf("did not return the handler error, got %v", err)
+		}
+
+		if len(breached) != 1 {
+			t.Fatalf("expected a breach for a slow handler, got %v", breached)
+		}
+
+		if breached[0] < 100*time.Millisecond {
+			t.Errorf("unexpected duration, got %v", breached[0])
+		}
+	})
+}
+
+func TestWithTiming(t *testing.T) {
+	var route string
+	var took time.Duration
+	var handlerErr error
+	h := WithTiming(func(r string, d time.Duration, err error) {
+		route, took, handlerErr = r, d, err
+	})(func(ctx context.Context, m Message) error {
+		time.Sleep(50 * time.Millisecond)
+		return ErrGetMessage
+	})
+
+	if err := h(context.TODO(), newStubMessage("post_published", `{}`)); err != ErrGetMessage {
+		t.Fatalf("did not return the handler error, got %v", err)
+	}
+
+	if route != "post_published" || handlerErr != ErrGetMessage {
+		t.Errorf("unexpected callback, got %s %v", route, handlerErr)
+	}
+
+	if took < 50*time.Millisecond || took > time.Second {
+		t.Errorf("unexpected duration, got %v", took)
+	}
+}
+
+func TestWithContextValue(t *testing.T) {
+	type tenantKey struct{}
+	type flagKey struct{}
+
+	c, _ := getStubConsumer(t, nil)
+	ctx := context.WithValue(context.Background(), flagKey{}, true)
+
+	var tenant, flag interface{}
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		tenant, flag = ctx.Value(tenantKey{}), ctx.Value(flagKey{})
+		return nil
+	}, HandlerOptions{WithoutExtension: true}, WithContextValue(tenantKey{}, "tenant"))
+
+	if err := c.run(ctx, newStubMessage("post_published", `{}`)); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if tenant != "tenant" {
+		t.Errorf("expected the value to be visible in the handler, got %v", tenant)
+	}
+
+	if flag != true {
+		t.Errorf("expected the consumer context to be retained, got %v", flag)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	var attempts int
+	failing := func(ctx context.Context, m Message) error {
+		attempts++
+		return ErrGetMessage
+	}
+
+	cases := []struct {
+		name     string
+		retries  int
+		cap      int
+		expected int
+	}{
+		{"without_cap", 3, 0, 4},
+		{"cap_lower", 3, 1, 2},
+		{"cap_higher", 1, 5, 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := getStubConsumer(t, nil)
+			c.maxInAppRetries = tc.cap
+			c.RegisterHandlerWithOptions("post_published", failing, HandlerOptions{WithoutExtension: true}, WithRetry(tc.retries, time.Millisecond))
+
+			attempts = 0
+			if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != ErrGetMessage {
+				t.Fatalf("expected the handler error once the retries are exhausted, got %v", err)
+			}
+
+			if attempts != tc.expected {
+				t.Errorf("unexpected attempts, expected %d, got %d", tc.expected, attempts)
+			}
+		})
+	}
+
+	t.Run("cap_without_retry", func(t *testing.T) {
+		c, _ := getStubConsumer(t, nil)
+		c.maxInAppRetries = 3
+		c.RegisterHandlerWithOptions("post_published", failing, HandlerOptions{WithoutExtension: true})
+
+		attempts = 0
+		c.run(context.Background(), newStubMessage("post_published", `{}`))
+		if attempts != 1 {
+			t.Errorf("the cap should not add retries, got %d attempts", attempts)
+		}
+	})
+
+	t.Run("recovers", func(t *testing.T) {
+		attempts = 0
+		h := WithRetry(3, time.Millisecond)(func(ctx context.Context, m Message) error {
+			attempts++
+			if attempts < 2 {
+				return ErrGetMessage
+			}
+			return nil
+		})
+
+		if err := h(context.TODO(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if attempts != 2 {
+			t.Errorf("unexpected attempts, expected 2, got %d", attempts)
+		}
+	})
+
+	t.Run("exhausted_dead_letter", func(t *testing.T) {
+		for _, deadLetter := range []bool{false, true} {
+			c, ops := getStubConsumer(t, nil)
+			c.dlqURL = "http://local.goaws:4100/queue/dev-post-worker-dlq"
+			c.retryDLQ = deadLetter
+			c.RegisterHandlerWithOptions("post_published", failing, HandlerOptions{WithoutExtension: true}, WithRetry(1, time.Millisecond))
+
+			attempts = 0
+			err := c.run(context.Background(), newStubMessage("post_published", `{}`))
+			if attempts != 2 {
+				t.Errorf("unexpected attempts, expected 2, got %d", attempts)
+			}
+
+			if !deadLetter {
+				if err != ErrGetMessage || ops.count("SendMessage") != 0 || ops.count("DeleteMessage") != 0 {
+					t.Errorf("expected the message to be left for redelivery, got %v", err)
+				}
+				continue
+			}
+
+			if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrTerminal.Err {
+				t.Errorf("expected %v, got %v", ErrTerminal, err)
+			}
+
+			if ops.count("SendMessage") != 1 || ops.count("DeleteMessage") != 1 {
+				t.Errorf("expected the message to be moved to the DLQ, got %d sends and %d deletes", ops.count("SendMessage"), ops.count("DeleteMessage"))
+			}
+		}
+	})
+}
+
+func TestNamedDispatcher(t *testing.T) {
+	audit := &publisher{arn: "arn:aws:sns:local:000000000000:audit-dev"}
+	search := &publisher{arn: "arn:aws:sns:local:000000000000:search-dev"}
+	fallback := &publisher{arn: "arn:aws:sns:local:000000000000:todolist-dev"}
+
+	ctx := WithDispatcher(context.Background(), fallback)
+	ctx = WithNamedDispatcher(ctx, "audit", audit)
+	ctx = WithNamedDispatcher(ctx, "search", search)
+
+	for name, expected := range map[string]Publisher{"audit": audit, "search": search} {
+		p, err := NamedDispatcher(ctx, name)
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if p != expected {
+			t.Errorf("unexpected dispatcher for %s, got %s", name, p.TopicARN())
+		}
+	}
+
+	if p := MustDispatcher(ctx); p != fallback {
+		t.Errorf("expected the unnamed dispatcher to be retained, got %s", p.TopicARN())
+	}
+
+	if _, err := NamedDispatcher(ctx, "billing"); err != ErrUndefinedPublisher {
+		t.Errorf("expected %v, got %v", ErrUndefinedPublisher, err)
+	}
+}
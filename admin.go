@@ -0,0 +1,92 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Admin provides bulk queue management helpers, intended for cleaning up test and ephemeral environments
+type Admin struct {
+	sqs SQSAPI
+}
+
+// BulkOptions guards the bulk queue management helpers against accidental use
+type BulkOptions struct {
+	// Confirm must be set for any queue to be purged or deleted
+	Confirm bool
+	// DryRun returns the queues matching the prefix without purging or deleting them, Confirm is not required
+	DryRun bool
+}
+
+// NewAdmin creates a new SQS instance for managing queues
+func NewAdmin(c Config) (*Admin, error) {
+	if c.SessionProvider == nil {
+		c.SessionProvider = newSession
+	}
+
+	sess, err := c.SessionProvider(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAdminWithClient(sqs.New(sess)), nil
+}
+
+// NewAdminWithClient creates an admin using the supplied sqs client
+func NewAdminWithClient(client SQSAPI) *Admin {
+	return &Admin{sqs: client}
+}
+
+// PurgeByPrefix deletes all messages of every queue whose name starts with the prefix, e.g. "dev-". It returns the
+// urls of the affected queues
+func (a *Admin) PurgeByPrefix(ctx context.Context, prefix string, opts BulkOptions) ([]string, error) {
+	return a.byPrefix(ctx, prefix, opts, func(u *string) error {
+		_, err := a.sqs.PurgeQueueWithContext(ctx, &sqs.PurgeQueueInput{QueueUrl: u})
+		return err
+	})
+}
+
+// DeleteByPrefix deletes every queue whose name starts with the prefix, e.g. "dev-". It returns the urls of the
+// affected queues
+func (a *Admin) DeleteByPrefix(ctx context.Context, prefix string, opts BulkOptions) ([]string, error) {
+	return a.byPrefix(ctx, prefix, opts, func(u *string) error {
+		_, err := a.sqs.DeleteQueueWithContext(ctx, &sqs.DeleteQueueInput{QueueUrl: u})
+		return err
+	})
+}
+
+// byPrefix runs the action against every queue matching the prefix. It stops at the first failure and returns the
+// queues that were affected up to that point along with ErrBulkOperation naming the queue that failed
+func (a *Admin) byPrefix(ctx context.Context, prefix string, opts BulkOptions, action func(queueURL *string) error) ([]string, error) {
+	if prefix == "" {
+		return nil, ErrEmptyPrefix
+	}
+
+	if !opts.Confirm && !opts.DryRun {
+		return nil, ErrNotConfirmed
+	}
+
+	var urls []*string
+	err := a.sqs.ListQueuesPagesWithContext(ctx, &sqs.ListQueuesInput{QueueNamePrefix: &prefix}, func(o *sqs.ListQueuesOutput, last bool) bool {
+		urls = append(urls, o.QueueUrls...)
+		return true
+	})
+	if err != nil {
+		return nil, ErrBulkOperation.Context(fmt.Errorf("list queues %s: %w", prefix, err))
+	}
+
+	affected := make([]string, 0, len(urls))
+	for _, u := range urls {
+		if !opts.DryRun {
+			if err := action(u); err != nil {
+				return affected, ErrBulkOperation.Context(fmt.Errorf("%s: %w", *u, err))
+			}
+		}
+
+		affected = append(affected, *u)
+	}
+
+	return affected, nil
+}
@@ -0,0 +1,124 @@
+package gosqs
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func getStubAdmin(t *testing.T) (*Admin, *operations, *[]string) {
+	ops := &operations{}
+	var affected []string
+
+	svc := sqs.New(stubSession)
+	stubClient(&svc.Handlers, ops, func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.ListQueuesInput:
+			r.Data.(*sqs.ListQueuesOutput).QueueUrls = []*string{
+				aws.String("http://local.goaws:4100/queue/" + *in.QueueNamePrefix + "post-worker"),
+				aws.String("http://local.goaws:4100/queue/" + *in.QueueNamePrefix + "user-worker"),
+			}
+		case *sqs.PurgeQueueInput:
+			affected = append(affected, *in.QueueUrl)
+		case *sqs.DeleteQueueInput:
+			affected = append(affected, *in.QueueUrl)
+		}
+	})
+
+	return NewAdminWithClient(svc), ops, &affected
+}
+
+func TestPurgeByPrefix(t *testing.T) {
+	expected := []string{"http://local.goaws:4100/queue/dev-post-worker", "http://local.goaws:4100/queue/dev-user-worker"}
+
+	t.Run("unconfirmed", func(t *testing.T) {
+		a, ops, _ := getStubAdmin(t)
+		if _, err := a.PurgeByPrefix(context.TODO(), "dev-", BulkOptions{}); err != ErrNotConfirmed {
+			t.Fatalf("expected %v, got %v", ErrNotConfirmed, err)
+		}
+
+		if len(ops.names) != 0 {
+			t.Errorf("expected no requests, got %v", ops.names)
+		}
+	})
+
+	t.Run("empty_prefix", func(t *testing.T) {
+		a, _, _ := getStubAdmin(t)
+		if _, err := a.PurgeByPrefix(context.TODO(), "", BulkOptions{Confirm: true}); err != ErrEmptyPrefix {
+			t.Fatalf("expected %v, got %v", ErrEmptyPrefix, err)
+		}
+	})
+
+	t.Run("dry_run", func(t *testing.T) {
+		a, ops, _ := getStubAdmin(t)
+		queues, err := a.PurgeByPrefix(context.TODO(), "dev-", BulkOptions{DryRun: true})
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if !reflect.DeepEqual(queues, expected) {
+			t.Errorf("unexpected queues, expected %v, got %v", expected, queues)
+		}
+
+		if n := ops.count("PurgeQueue"); n != 0 {
+			t.Errorf("expected no queues to be purged, got %d", n)
+		}
+	})
+
+	t.Run("confirmed", func(t *testing.T) {
+		a, _, affected := getStubAdmin(t)
+		queues, err := a.PurgeByPrefix(context.TODO(), "dev-", BulkOptions{Confirm: true})
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if !reflect.DeepEqual(queues, expected) || !reflect.DeepEqual(*affected, expected) {
+			t.Errorf("unexpected queues, expected %v, got %v purged %v", expected, queues, *affected)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		a, _, _ := getStubAdmin(t)
+		a.sqs.(*sqs.SQS).Handlers.Send.PushBack(func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.PurgeQueueInput); ok && *in.QueueUrl == expected[1] {
+				r.Error = awserr.New(sqs.ErrCodePurgeQueueInProgress, "purge in progress", nil)
+				r.Retryable = aws.Bool(false)
+			}
+		})
+
+		queues, err := a.PurgeByPrefix(context.TODO(), "dev-", BulkOptions{Confirm: true})
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrBulkOperation.Err {
+			t.Fatalf("expected %v, got %v", ErrBulkOperation, err)
+		}
+
+		if !strings.Contains(err.Error(), expected[1]) {
+			t.Errorf("expected the failed queue to be named, got %v", err)
+		}
+
+		if !reflect.DeepEqual(queues, expected[:1]) {
+			t.Errorf("expected the queues affected before the failure, got %v", queues)
+		}
+	})
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	a, ops, affected := getStubAdmin(t)
+	queues, err := a.DeleteByPrefix(context.TODO(), "dev-", BulkOptions{Confirm: true})
+	if err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if len(queues) != 2 || len(*affected) != 2 {
+		t.Errorf("expected 2 queues to be deleted, got %v", queues)
+	}
+
+	if n := ops.count("PurgeQueue"); n != 0 {
+		t.Errorf("expected no queues to be purged, got %d", n)
+	}
+}
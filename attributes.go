@@ -0,0 +1,26 @@
+package gosqs
+
+import "context"
+
+// AttributeKey is the context key of a message attribute promoted to the handler context with
+// Config.ContextAttributes, e.g. ctx.Value(gosqs.AttributeKey("tenant"))
+type AttributeKey string
+
+// ContextAttribute retrieves a message attribute promoted to the context with Config.ContextAttributes, it returns
+// an empty string if the attribute was not promoted or the message did not carry it
+func ContextAttribute(ctx context.Context, name string) string {
+	v, _ := ctx.Value(AttributeKey(name)).(string)
+	return v
+}
+
+// attributeContext adds the ContextAttributes carried by the message to the context, missing attributes are skipped
+func (c *consumer) attributeContext(ctx context.Context, m *message) context.Context {
+	for _, name := range c.contextAttributes {
+		if _, ok := m.MessageAttributes[name]; !ok {
+			continue
+		}
+		ctx = context.WithValue(ctx, AttributeKey(name), m.Attribute(name))
+	}
+
+	return ctx
+}
@@ -0,0 +1,38 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestRunContextAttributes(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	c.contextAttributes = []string{"correlationId", "tenant"}
+
+	var correlation, tenant interface{}
+	var promoted bool
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		correlation = ContextAttribute(ctx, "correlationId")
+		tenant, promoted = ctx.Value(AttributeKey("tenant")).(string)
+		return nil
+	}, HandlerOptions{WithoutExtension: true})
+
+	m := newStubMessage("post_published", `{}`)
+	m.MessageAttributes["correlationId"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("abc-123")}
+	m.MessageAttributes["hop"] = &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("2")}
+
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if correlation != "abc-123" {
+		t.Errorf("expected the correlation id in the handler context, got %v", correlation)
+	}
+
+	if promoted {
+		t.Errorf("expected the missing tenant attribute to be skipped, got %v", tenant)
+	}
+}
@@ -0,0 +1,180 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// BatchHandler processes the messages of a route that were received together in a single call
+type BatchHandler func(ctx context.Context, messages []Message) error
+
+// job is the work handed to a worker, a single message or the messages of a batch route
+type job struct {
+	message *message
+	batch   []*message
+}
+
+// RegisterBatchHandler registers a handler that processes the messages of a route received by a single receive
+// together, up to MaxMessages at once, e.g. to amortize downstream writes of idempotent workloads. A batch handler
+// takes precedence over handlers registered for the route with RegisterHandler
+//
+// If the handler succeeds the batch is deleted with DeleteMessageBatch, with RequireCommit the messages it did not
+// commit are left for redelivery instead. If it fails no message is deleted and every message is redelivered once its
+// visibility timeout lapses, unless the error is marked with Terminal: the messages are then moved to the DLQ, or
+// deleted without a DLQUrl. The visibility of every message in the batch is extended on its own schedule while the
+// handler runs, the extensions stop together when the handler returns. Once any message reaches the extension limit
+// and its visibility lapses the context of the batch is cancelled
+//
+// The messages support Commit, Ack, Nack, Defer, Extend and DeadLetter like the messages of a regular handler, a
+// message that was committed or rescheduled is not deleted with the batch. The batch shares a single context, the
+// trace header and the ContextAttributes of the individual messages are not added to it, read them from the messages
+// with TraceHeader and Attribute instead
+func (c *consumer) RegisterBatchHandler(name string, h BatchHandler) {
+	if c.batchHandlers == nil {
+		c.batchHandlers = make(map[string]BatchHandler)
+	}
+
+	c.batchHandlers[name] = h
+}
+
+// isBatchRoute determines whether the message is processed by a batch handler
+func (c *consumer) isBatchRoute(m *message) bool {
+	_, ok := c.batchHandlers[m.Route()]
+	return ok
+}
+
+// processBatch runs the batch and logs any errors
+func (c *consumer) processBatch(ctx context.Context, batch []*message) {
+	if err := c.runBatch(ctx, batch); err != nil {
+		c.Logger().Println(err.Error())
+	}
+
+	// the messages have either been deleted or released back to the queue
+	atomic.AddInt64(&c.inFlight, -int64(len(batch)))
+}
+
+// runBatch runs the batch handler of the route of the messages, every message of the batch has the same route.
+// Messages whose body cannot be prepared are left for redelivery and are not handed to the handler
+func (c *consumer) runBatch(ctx context.Context, batch []*message) error {
+	h := c.batchHandlers[batch[0].Route()]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if c.maxInAppRetries > 0 {
+		ctx = context.WithValue(ctx, retryCapKey, c.maxInAppRetries)
+	}
+	if c.panicAsSuccess {
+		ctx = context.WithValue(ctx, panicAsSuccessKey, true)
+	}
+
+	var ready []*message
+	messages := make([]Message, 0, len(batch))
+	for _, m := range batch {
+		m.codec = c.codec
+		if err := c.fetchOffloaded(ctx, m); err != nil {
+			c.Logger().Println(err.Error())
+			continue
+		}
+
+		if err := c.decompress(m); err != nil {
+			c.Logger().Println(err.Error())
+			continue
+		}
+
+		if err := c.preprocessBody(m); err != nil {
+			c.Logger().Println(err.Error())
+			continue
+		}
+
+		if err := c.transcode(m); err != nil {
+			c.Logger().Println(err.Error())
+			continue
+		}
+
+		m.commit = c.delete
+		m.deadLetter = c.deadLetter
+		m.changeVisibility = c.changeVisibility
+
+		if !c.redriveImminent(m) {
+			go c.extend(ctx, m, nil, cancel)
+		}
+
+		ready = append(ready, m)
+		messages = append(messages, m)
+	}
+
+	if len(ready) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := h(ctx, messages)
+	c.meter().ObserveLatency(batch[0].Route(), time.Since(start))
+	for _, m := range ready {
+		m.finish()
+		if m.isDeferred() {
+			// the handler rescheduled the message, it is neither a failure nor deleted
+			continue
+		}
+
+		if err != nil {
+			c.meter().IncFailed(m.Route(), err)
+			if c.onError != nil {
+				c.onError(ctx, m, err)
+			}
+			c.reply(ctx, m, err)
+			if IsTerminal(err) {
+				// the terminal error is returned for the batch below, only a failure to discard the message is logged
+				derr := c.discard(ctx, m, err)
+				if sqsErr, ok := derr.(*SQSError); !ok || sqsErr.Err != ErrTerminal.Err {
+					c.Logger().Println(derr.Error())
+				}
+			}
+		} else {
+			c.meter().IncProcessed(m.Route())
+		}
+	}
+
+	if err != nil {
+		if IsTerminal(err) {
+			return ErrTerminal.Context(err)
+		}
+		return err
+	}
+
+	// a message whose visibility lapsed may have been redelivered, it is not deleted from underneath its new consumer.
+	// Messages the handler committed or rescheduled are left as they are, with RequireCommit so are the messages it
+	// did not commit
+	deletable := ready[:0]
+	for _, m := range ready {
+		if m.isDeferred() {
+			continue
+		}
+
+		if !m.isCommitted() {
+			if m.visibilityLapsed() {
+				c.Logger().Println(ErrLateCompletion.Context(fmt.Errorf("route: %s", m.Route())).Error())
+				continue
+			}
+
+			if c.requireCommit {
+				c.Logger().Println(ErrNotCommitted.Context(fmt.Errorf("route: %s", m.Route())).Error())
+				continue
+			}
+		}
+
+		c.reply(ctx, m, nil)
+		if !m.isCommitted() {
+			deletable = append(deletable, m)
+		}
+	}
+
+	if len(deletable) > 0 {
+		c.deleteBatch(deletable)
+	}
+
+	return nil
+}
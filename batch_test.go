@@ -0,0 +1,182 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// getStubBatchConsumer creates a consumer whose queue holds three batched messages and a single message, all
+// received at once
+func getStubBatchConsumer(t *testing.T) (*consumer, *operations, chan *sqs.DeleteMessageBatchInput) {
+	var once sync.Once
+	batches := make(chan *sqs.DeleteMessageBatchInput, 10)
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.ReceiveMessageInput:
+			once.Do(func() {
+				out := r.Data.(*sqs.ReceiveMessageOutput)
+				for i := 0; i < 3; i++ {
+					m := newStubMessage("post_batched", fmt.Sprintf(`{"val":"%d"}`, i)).Message
+					m.ReceiptHandle = aws.String(fmt.Sprintf("receipt-handle-%d", i))
+					out.Messages = append(out.Messages, m)
+				}
+				out.Messages = append(out.Messages, newStubMessage("post_published", `{}`).Message)
+			})
+		case *sqs.DeleteMessageBatchInput:
+			batches <- in
+		}
+	})
+	c.exitAfterIdle = 1
+	c.workerPool = 2
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	return c, ops, batches
+}
+
+func TestRegisterBatchHandler(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		c, ops, batches := getStubBatchConsumer(t)
+
+		var mu sync.Mutex
+		var calls [][]string
+		c.RegisterBatchHandler("post_batched", func(ctx context.Context, messages []Message) error {
+			var vals []string
+			for _, m := range messages {
+				var out testStruct
+				if err := m.Decode(&out); err != nil {
+					return err
+				}
+				vals = append(vals, out.Val)
+			}
+
+			mu.Lock()
+			calls = append(calls, vals)
+			mu.Unlock()
+			return nil
+		})
+
+		c.Consume()
+
+		if len(calls) != 1 || len(calls[0]) != 3 {
+			t.Fatalf("expected a single call with the 3 batched messages, got %v", calls)
+		}
+
+		select {
+		case in := <-batches:
+			if len(in.Entries) != 3 {
+				t.Errorf("expected the batch to be deleted together, got %d entries", len(in.Entries))
+			}
+		default:
+			t.Fatal("expected the batch to be deleted with DeleteMessageBatch")
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the single message to be deleted on its own, got %d deletes", n)
+		}
+
+		if n := atomic.LoadInt64(&c.inFlight); n != 0 {
+			t.Errorf("expected no messages in flight, got %d", n)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		c, ops, batches := getStubBatchConsumer(t)
+		c.serial = true
+		c.RegisterBatchHandler("post_batched", func(ctx context.Context, messages []Message) error {
+			return ErrGetMessage
+		})
+
+		c.Consume()
+
+		if len(batches) != 0 {
+			t.Errorf("expected a failed batch not to be deleted")
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected only the single message to be deleted, got %d deletes", n)
+		}
+	})
+	t.Run("require_commit", func(t *testing.T) {
+		c, ops, batches := getStubBatchConsumer(t)
+		c.requireCommit = true
+		c.RegisterBatchHandler("post_batched", func(ctx context.Context, messages []Message) error {
+			return messages[0].Commit(ctx)
+		})
+
+		c.Consume()
+
+		if len(batches) != 0 {
+			t.Errorf("expected the uncommitted messages not to be deleted")
+		}
+
+		// only the committed message, the single message was not committed either
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected only the committed message to be deleted, got %d deletes", n)
+		}
+	})
+
+	t.Run("terminal", func(t *testing.T) {
+		c, ops, batches := getStubBatchConsumer(t)
+		c.serial = true
+		c.dlqURL = "http://local.goaws:4100/queue/dev-post-worker-dlq"
+		c.RegisterBatchHandler("post_batched", func(ctx context.Context, messages []Message) error {
+			return Terminal(ErrGetMessage)
+		})
+
+		c.Consume()
+
+		if len(batches) != 0 {
+			t.Errorf("expected a failed batch not to be deleted with DeleteMessageBatch")
+		}
+
+		if n := ops.count("SendMessage"); n != 3 {
+			t.Errorf("expected every message of the batch to be moved to the DLQ, got %d", n)
+		}
+
+		// the dead-lettered messages along with the single message
+		if n := ops.count("DeleteMessage"); n != 4 {
+			t.Errorf("expected the dead-lettered messages to be deleted, got %d deletes", n)
+		}
+	})
+
+	t.Run("message_controls", func(t *testing.T) {
+		c, ops, batches := getStubBatchConsumer(t)
+		c.RegisterBatchHandler("post_batched", func(ctx context.Context, messages []Message) error {
+			if err := messages[0].Ack(ctx); err != nil {
+				return err
+			}
+			if err := messages[1].Nack(ctx); err != nil {
+				return err
+			}
+			return messages[2].Extend(ctx, 60)
+		})
+
+		c.Consume()
+
+		select {
+		case in := <-batches:
+			if len(in.Entries) != 1 || aws.StringValue(in.Entries[0].ReceiptHandle) != "receipt-handle-2" {
+				t.Errorf("expected only the untouched message to be deleted with the batch, got %v", in.Entries)
+			}
+		default:
+			t.Fatal("expected the remaining message to be deleted with DeleteMessageBatch")
+		}
+
+		// the acked message along with the single message
+		if n := ops.count("DeleteMessage"); n != 2 {
+			t.Errorf("expected the acked message to be deleted by the handler, got %d deletes", n)
+		}
+
+		// the nack and the extension
+		if n := ops.count("ChangeMessageVisibility"); n != 2 {
+			t.Errorf("expected the nack and the extension to change the visibility, got %d", n)
+		}
+	})
+}
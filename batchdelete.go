@@ -0,0 +1,134 @@
+package gosqs
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// defaultDeleteFlushInterval is the time processed messages are buffered before they are deleted in a batch
+const defaultDeleteFlushInterval = time.Second
+
+// deleteBatcher buffers processed messages and deletes them with DeleteMessageBatch once the batch is full or the
+// flush interval lapsed
+type deleteBatcher struct {
+	c        *consumer
+	size     int
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []*message
+	timer   *time.Timer
+}
+
+// newDeleteBatcher creates a batcher deleting up to size messages per request, the size is capped at the 10 entries
+// sqs allows
+func newDeleteBatcher(c *consumer, size int, interval time.Duration) *deleteBatcher {
+	if size > int(maxMessages) {
+		size = int(maxMessages)
+	}
+
+	if interval <= 0 {
+		interval = defaultDeleteFlushInterval
+	}
+
+	return &deleteBatcher{c: c, size: size, interval: interval}
+}
+
+// add buffers the message, the batch is deleted right away once it is full
+func (b *deleteBatcher) add(m *message) {
+	b.mu.Lock()
+	b.pending = append(b.pending, m)
+	if len(b.pending) < b.size {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.interval, b.flush)
+		}
+		b.mu.Unlock()
+		return
+	}
+
+	batch := b.take()
+	b.mu.Unlock()
+
+	b.c.deleteBatch(batch)
+}
+
+// flush deletes the buffered messages
+func (b *deleteBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	b.c.deleteBatch(batch)
+}
+
+// take empties the buffer and returns the buffered messages, b.mu must be held
+func (b *deleteBatcher) take() []*message {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// deleteProcessed deletes a message that was processed successfully, it is buffered for a batch delete when
+// DeleteBatchSize is configured
+func (c *consumer) deleteProcessed(m *message) error {
+	if c.deletes == nil {
+		return c.delete(m)
+	}
+
+	c.deletes.add(m)
+	return nil
+}
+
+// flushDeletes deletes the messages that are buffered for a batch delete
+func (c *consumer) flushDeletes() {
+	if c.deletes != nil {
+		c.deletes.flush()
+	}
+}
+
+// deleteBatch deletes the messages with a DeleteMessageBatch request per source queue. Entries that fail, or every
+// entry if the request fails, are deleted one by one which logs the messages that still cannot be deleted
+func (c *consumer) deleteBatch(messages []*message) {
+	byQueue := map[string][]*message{}
+	for _, m := range messages {
+		queue := *c.sourceQueue(m)
+		byQueue[queue] = append(byQueue[queue], m)
+	}
+
+	for queue, messages := range byQueue {
+		input := &sqs.DeleteMessageBatchInput{QueueUrl: aws.String(queue)}
+		for i, m := range messages {
+			input.Entries = append(input.Entries, &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: m.ReceiptHandle})
+		}
+
+		out, err := c.sqs.DeleteMessageBatch(input)
+		if err != nil {
+			c.Logger().Println(ErrUnableToDelete.Context(err).Error(), "retrying the batch one by one")
+			for _, m := range messages {
+				c.delete(m)
+			}
+			continue
+		}
+
+		for i := 0; i < len(messages)-len(out.Failed); i++ {
+			c.meter().IncDeleted()
+		}
+
+		for _, failed := range out.Failed {
+			i, err := strconv.Atoi(aws.StringValue(failed.Id))
+			if err != nil || i < 0 || i >= len(messages) {
+				continue
+			}
+			c.delete(messages[i])
+		}
+	}
+}
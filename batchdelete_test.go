@@ -0,0 +1,154 @@
+package gosqs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// getStubBatchDeleteConsumer creates a consumer deleting processed messages in batches, entries with the failing
+// receipt handle are reported as failed. Its queue holds a single message
+func getStubBatchDeleteConsumer(t *testing.T, size int, interval time.Duration, failing string) (*consumer, *operations, chan *sqs.DeleteMessageBatchInput) {
+	var once sync.Once
+	batches := make(chan *sqs.DeleteMessageBatchInput, 10)
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name == "ReceiveMessage" {
+			once.Do(func() {
+				r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{newStubMessage("post_published", `{}`).Message}
+			})
+			return
+		}
+
+		in, ok := r.Params.(*sqs.DeleteMessageBatchInput)
+		if !ok {
+			return
+		}
+
+		out := r.Data.(*sqs.DeleteMessageBatchOutput)
+		for _, e := range in.Entries {
+			if *e.ReceiptHandle == failing {
+				out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{Id: e.Id, Code: aws.String("ReceiptHandleIsInvalid")})
+			}
+		}
+		batches <- in
+	})
+	c.deletes = newDeleteBatcher(c, size, interval)
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	return c, ops, batches
+}
+
+func TestBatchDelete(t *testing.T) {
+	t.Run("full", func(t *testing.T) {
+		c, ops, batches := getStubBatchDeleteConsumer(t, 3, time.Hour, "")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+					t.Errorf("should not return an error, got %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case in := <-batches:
+			if len(in.Entries) != 3 {
+				t.Errorf("expected a batch of 3 entries, got %d", len(in.Entries))
+			}
+		default:
+			t.Fatal("expected the full batch to be deleted right away")
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected no single deletes, got %d", n)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		c, _, batches := getStubBatchDeleteConsumer(t, 10, 10*time.Millisecond, "")
+
+		if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		select {
+		case in := <-batches:
+			if len(in.Entries) != 1 {
+				t.Errorf("expected a batch of 1 entry, got %d", len(in.Entries))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the batch to be deleted once the flush interval lapsed")
+		}
+	})
+
+	t.Run("failed_entries", func(t *testing.T) {
+		c, ops, batches := getStubBatchDeleteConsumer(t, 2, time.Hour, "failing")
+
+		c.run(context.Background(), newStubMessage("post_published", `{}`))
+		m := newStubMessage("post_published", `{}`)
+		m.ReceiptHandle = aws.String("failing")
+		c.run(context.Background(), m)
+		<-batches
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the failed entry to be deleted on its own, got %d deletes", n)
+		}
+	})
+
+	t.Run("flushed_on_stop", func(t *testing.T) {
+		c, _, batches := getStubBatchDeleteConsumer(t, 10, time.Hour, "")
+		c.exitAfterIdle = 1
+
+		c.Consume()
+
+		select {
+		case in := <-batches:
+			if len(in.Entries) != 1 {
+				t.Errorf("expected a batch of 1 entry, got %d", len(in.Entries))
+			}
+		default:
+			t.Fatal("expected the buffered messages to be deleted before Consume returns")
+		}
+	})
+}
+
+func TestBatchDeleteConfig(t *testing.T) {
+	queueURL := "http://local.goaws:4100/queue/dev-post-worker"
+	cases := []struct {
+		name     string
+		config   Config
+		expected int
+	}{
+		{"default", Config{}, 0},
+		{"batch_delete", Config{BatchDelete: true}, 10},
+		{"batch_delete_size", Config{BatchDelete: true, DeleteBatchSize: 5}, 5},
+		{"size", Config{DeleteBatchSize: 20}, 10},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cons, err := NewConsumerWithClient(&fakeSQS{}, queueURL, tc.config)
+			if err != nil {
+				t.Fatalf("error creating consumer, got %v", err)
+			}
+
+			var size int
+			if deletes := cons.(*consumer).deletes; deletes != nil {
+				size = deletes.size
+			}
+
+			if size != tc.expected {
+				t.Errorf("unexpected batch size, expected %d, got %d", tc.expected, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package gosqs
+
+import "encoding/json"
+
+// Codec encodes the bodies of outgoing messages and decodes the bodies of received messages, e.g. to use protobuf or
+// msgpack instead of json. sqs only accepts text bodies, a binary codec needs to encode its output as text, e.g. with
+// base64
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes and decodes bodies as json, it is the default Codec
+type JSONCodec struct{}
+
+// Marshal encodes v as json
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the json data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// encoder returns the function encoding the bodies of outgoing messages, the JSONEncoderFunc takes precedence over the
+// Codec. It returns nil for the default json encoding
+func (c Config) encoder() func(v interface{}) ([]byte, error) {
+	if c.JSONEncoderFunc != nil {
+		return c.JSONEncoderFunc
+	}
+
+	if c.Codec != nil {
+		return c.Codec.Marshal
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package gosqs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// base64Codec encodes bodies as base64 encoded json, emulating a binary codec
+type base64Codec struct{}
+
+func (base64Codec) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+func (base64Codec) Unmarshal(data []byte, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func TestCodec(t *testing.T) {
+	t.Run("round_trip", func(t *testing.T) {
+		sent := make(chan *sqs.SendMessageInput, 1)
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+				sent <- in
+			}
+		})
+		p.encode = Config{Codec: base64Codec{}}.encoder()
+
+		p.Message("post-worker", "post_published", testStruct{"val"})
+		in := <-sent
+
+		if *in.MessageBody != base64.StdEncoding.EncodeToString([]byte(`{"val":"val"}`)) {
+			t.Fatalf("expected the body to be encoded with the codec, got %s", *in.MessageBody)
+		}
+
+		c, _ := getStubConsumer(t, nil)
+		c.codec = base64Codec{}
+
+		var received testStruct
+		c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+			return m.Decode(&received)
+		}, HandlerOptions{WithoutExtension: true})
+
+		m := newMessage(&sqs.Message{Body: in.MessageBody, ReceiptHandle: aws.String("receipt-handle"), MessageAttributes: in.MessageAttributes})
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if received.Val != "val" {
+			t.Errorf("expected the body to be decoded with the codec, got %+v", received)
+		}
+	})
+
+	t.Run("encoder_precedence", func(t *testing.T) {
+		encode := Config{Codec: base64Codec{}, JSONEncoderFunc: json.Marshal}.encoder()
+		out, err := encode(testStruct{"val"})
+		if err != nil || string(out) != `{"val":"val"}` {
+			t.Errorf("expected the JSONEncoderFunc to take precedence, got %s %v", out, err)
+		}
+
+		if (Config{}).encoder() != nil {
+			t.Error("expected the default json encoding without a codec")
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		m := newStubMessage("post_published", `{"val":"val"}`)
+		m.codec = JSONCodec{}
+
+		var out testStruct
+		if err := m.Decode(&out); err != nil || out.Val != "val" {
+			t.Errorf("unexpected result, got %+v %v", out, err)
+		}
+	})
+}
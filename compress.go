@@ -0,0 +1,72 @@
+package gosqs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+)
+
+const (
+	// contentEncodingAttribute is the message attribute marking a compressed body
+	contentEncodingAttribute = "content-encoding"
+	// gzipEncoding is the content-encoding of a body compressed with gzip
+	gzipEncoding = "gzip"
+)
+
+// compressBody compresses the body with gzip and marks it with the content-encoding attribute. The compressed body is
+// base64 encoded since sqs only accepts text bodies
+func compressBody(body string, ca []customAttribute) (string, []customAttribute, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		return "", nil, ErrCompression.Context(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return "", nil, ErrCompression.Context(err)
+	}
+
+	encoding := customAttribute{contentEncodingAttribute, DataTypeString.String(), gzipEncoding}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), append(append(make([]customAttribute, 0, len(ca)+1), ca...), encoding), nil
+}
+
+// decompress restores the body of a message that was compressed with gzip, messages without the content-encoding
+// attribute are left as is
+func (c *consumer) decompress(m *message) error {
+	if m.Attribute(contentEncodingAttribute) != gzipEncoding {
+		return nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(string(m.payload))
+	if err != nil {
+		return ErrCompression.Context(err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return ErrCompression.Context(err)
+	}
+	defer zr.Close()
+
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return ErrCompression.Context(err)
+	}
+
+	m.payload = body
+	return nil
+}
+
+// prepareBody compresses the body of an outgoing message if compress is set and offloads it to the bucket if it still
+// exceeds the size limit. It is shared by the publisher and the consumer
+func prepareBody(body, event string, ca []customAttribute, compress bool, storage S3API, bucket string) (string, []customAttribute, error) {
+	if compress {
+		var err error
+		if body, ca, err = compressBody(body, ca); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return offload(storage, bucket, body, event, ca)
+}
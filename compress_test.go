@@ -0,0 +1,89 @@
+package gosqs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestCompress(t *testing.T) {
+	body := testStruct{Val: strings.Repeat(`{"id":1,"title":"post"}`, 1000)}
+
+	t.Run("round_trip", func(t *testing.T) {
+		sent := make(chan *sqs.SendMessageInput, 1)
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+				sent <- in
+			}
+		})
+		p.compress = true
+
+		p.Message("post-worker", "post_published", body)
+		in := <-sent
+
+		if encoding := in.MessageAttributes[contentEncodingAttribute]; encoding == nil || *encoding.StringValue != gzipEncoding {
+			t.Fatalf("expected the body to be marked as compressed, got %v", in.MessageAttributes)
+		}
+
+		if len(*in.MessageBody) >= len(body.Val) {
+			t.Errorf("expected the body to be compressed, got %d bytes", len(*in.MessageBody))
+		}
+
+		c, _ := getStubConsumer(t, nil)
+		var received testStruct
+		c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+			return m.Decode(&received)
+		}, HandlerOptions{WithoutExtension: true})
+
+		m := newMessage(&sqs.Message{Body: in.MessageBody, ReceiptHandle: aws.String("receipt-handle"), MessageAttributes: in.MessageAttributes})
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if received.Val != body.Val {
+			t.Errorf("expected the handler to receive the decompressed body, got %d bytes", len(received.Val))
+		}
+	})
+
+	t.Run("above_limit", func(t *testing.T) {
+		sent := make(chan *sqs.SendMessageInput, 1)
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+				sent <- in
+			}
+		})
+		p.compress = true
+
+		// the size limit is checked after compression, a compressible body above it is still sent
+		large := testStruct{Val: strings.Repeat(`{"id":1,"title":"post"}`, 20000)}
+		if len(large.Val) <= maxMessageSize {
+			t.Fatalf("expected the body to exceed the size limit, got %d bytes", len(large.Val))
+		}
+
+		p.Message("post-worker", "post_published", large)
+		if in := <-sent; len(*in.MessageBody) > maxMessageSize {
+			t.Errorf("expected the compressed body to fit the size limit, got %d bytes", len(*in.MessageBody))
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+		m := newStubMessage("post_published", `{}`)
+		m.MessageAttributes[contentEncodingAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(gzipEncoding)}
+
+		err := c.run(context.Background(), m)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrCompression.Err {
+			t.Errorf("expected %v, got %v", ErrCompression, err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the message to be left for redelivery, got %d deletes", n)
+		}
+	})
+}
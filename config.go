@@ -1,13 +1,20 @@
 package gosqs
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 // SessionProviderFunc can be used to add custom AWS session setup to the gosqs.Config.
@@ -15,6 +22,16 @@ import (
 // If Config.SessionProvider is not set (is nil), a default provider based on AWS Key/Secret will be used.
 type SessionProviderFunc func(c Config) (*session.Session, error)
 
+// SQSAPI is the sqs client used by gosqs. It is satisfied by *sqs.SQS as well as any fake implementing sqsiface.SQSAPI
+type SQSAPI = sqsiface.SQSAPI
+
+// SNSAPI is the sns client used by gosqs. It is satisfied by *sns.SNS as well as any fake implementing snsiface.SNSAPI
+type SNSAPI = snsiface.SNSAPI
+
+// S3API is the s3 client used to offload large bodies. It is satisfied by *s3.S3 as well as any fake implementing
+// s3iface.S3API
+type S3API = s3iface.S3API
+
 // Config defines the gosqs configuration
 type Config struct {
 	// a way to provide custom session setup. A default based on key/secret will be used if not provided
@@ -35,27 +52,253 @@ type Config struct {
 	TopicPrefix string
 	// optional address of the topic, if this is not provided it will be created using other variables
 	TopicARN string
+	// optional list of additional topics that every notification is fanned out to
+	FanOutTopicARNs []string
+	// limits the amount of sns publishes per second to stay under the throughput limits of the topic, publishes
+	// exceeding the rate are paced rather than sent in a burst. Default is 0 (no limit)
+	PublishRateLimit int
+	// tunes the retries of sns publishes that were throttled, they are retried separately from other publish failures
+	ThrottleBackoff ThrottleBackoff
 	// optional address of queue, if this is not provided it will be retrieved during setup
 	QueueURL string
+	// optional function to create the full name of a queue from the env and the queue name, it is used by the consumer
+	// to resolve its queue and by both the consumer and the publisher for direct messages. Default is env-name,
+	// e.g. dev-post-worker
+	QueueNameFunc func(env, name string) string
 	// used to extend the allowed processing time of a message
 	VisibilityTimeout int
-	// used to determine how many attempts exponential backoff should use before logging an error
+	// seconds before the visibility timeout lapses that its extension is requested, tune it to the latency of the
+	// extension request. Default is 10
+	VisibilityBuffer int
+	// used to determine how many attempts exponential backoff should use before logging an error. It also caps the
+	// retries of the direct messages sent by a consumer, 5 by default
 	RetryCount int
+	// the time to wait before retrying a receive or send that failed after the retries of the sdk. The delay doubles
+	// with every consecutive failure up to 2 minutes and is jittered. Default is 10s
+	RetryDelay time.Duration
 	// defines the total amount of goroutines that can be run by the consumer
 	WorkerPool int
+	// optional function to derive the worker pool size, e.g. from runtime.NumCPU(). It is evaluated once when
+	// Consume starts and takes precedence over WorkerPool. Returning 0 or less falls back to WorkerPool
+	WorkerPoolFunc func() int
 	// defines the total number of processing extensions that occur. Each proccessing extension will double the
 	// visibilitytimeout counter, ensuring the handler has more time to process the message. Default is 2 extensions (1m30s processing time)
 	// set to 0 to turn off extension processing
 	ExtensionLimit *int
+	// processes one message at a time: a single message is received, handled and deleted before the next receive, without
+	// the worker pool. It is the simplest correct mode for low-volume critical queues. WorkerPool and MaxInFlight are ignored
+	SerialMode bool
+	// defines the maximum number of messages that can be received from sqs but not yet consumed at any given time.
+	// When the limit is reached, the consumer stops receiving messages until in-flight messages are processed.
+	// Default is 0 (no limit)
+	MaxInFlight int
+	// defines the maximum number of messages requested from sqs per receive, fewer messages per receive spread the load
+	// of a low-throughput queue across consumers. It is clamped to the 1-10 range sqs allows. Default is 10
+	MaxMessages int
+	// buffers processed messages and deletes them with a single DeleteMessageBatch request once the given amount is
+	// buffered or the DeleteFlushInterval lapsed, reducing the requests to sqs. It is capped at 10. Messages that fail
+	// to be deleted in the batch are deleted one by one. Default is 0, every message is deleted right away
+	DeleteBatchSize int
+	// deletes processed messages in batches of 10 with DeleteMessageBatch, unless DeleteBatchSize sets another size.
+	// Default is false, every message is deleted right away
+	BatchDelete bool
+	// the time processed messages are buffered for a batch delete with DeleteBatchSize. Keep it well below the
+	// visibility timeout since buffered messages are redelivered once it lapses. Default is 1s
+	DeleteFlushInterval time.Duration
+	// optional clock used to measure the age of messages, e.g. to control time in tests. Defaults to time.Now
+	Clock func() time.Time
+	// how far the SentTimestamp of a message may be ahead of the local clock before the skew is logged, the age of
+	// such messages is measured from the moment they were received. Default is 1s
+	ClockSkewTolerance time.Duration
+	// caps the in-process retries of every handler registered with WithRetry, the lower of the two applies. Once the
+	// retries are exhausted the message is left for redelivery by SQS, unless RetryExhaustedDeadLetter is set.
+	// Default is 0 (no cap)
+	MaxInAppRetries int
+	// moves messages whose WithRetry retries are exhausted to the DLQUrl along with the last error, instead of leaving
+	// them for redelivery by SQS. It has no effect without a DLQUrl. Default is false
+	RetryExhaustedDeadLetter bool
+	// deletes messages whose handler panicked and was recovered by WithRecovery, as if they were processed successfully.
+	// By default a recovered panic fails the message so it is redelivered
+	PanicAsSuccess bool
+	// stops the consumer once the queue has been empty for the given number of consecutive receives, useful for short-lived
+	// workers that drain a queue and exit. Default is 0 (consume forever)
+	ExitAfterIdleReceives int
+	// optional callback that is run after every empty receive with the amount of consecutive empty receives, the count
+	// is reset once messages are received. Use it to scale idle consumers down, e.g. to zero after N empty receives.
+	// It runs on the receiving goroutine and delays the next receive until it returns
+	OnIdle func(consecutiveEmpty int)
+	// only deletes messages that were committed by the handler using Message.Commit. A handler that returns without
+	// an error but did not commit leaves the message for redelivery. By default messages are deleted when the handler
+	// returns without an error, unless they were already committed
+	RequireCommit bool
+	// makes messages without a registered handler visible again right away instead of waiting for their visibility
+	// timeout to lapse, so a sibling consumer with a different set of handlers can receive them from the same queue.
+	// Every consumer on the queue must know every route: a message that has been received 10 times without being
+	// handled is deleted to prevent endless redelivery, or moved to the DLQ earlier by a stricter redrive policy
+	IgnoreUnhandled bool
+	// deletes messages without a registered handler, logging ErrNoRoute. By default they are left in the queue so they
+	// are retried once their visibility timeout lapses and end up in the DLQ, instead of being silently consumed
+	DeleteOnNoHandler bool
+	// names of message attributes that are promoted to the handler context, e.g. correlation or tenant ids, so
+	// downstream code can read them with ContextAttribute without knowing about the message. Attributes that a
+	// message does not carry are skipped
+	ContextAttributes []string
+	// logs the body of a message along with the error when it fails, truncated to 1024 bytes. Off by default since
+	// bodies may hold personal data
+	LogBodyOnError bool
+	// optional function applied to the body before it is logged with LogBodyOnError, use it to strip personal data.
+	// It receives a copy of the body
+	Redact func([]byte) []byte
+	// allows Consumer.Subscribe to subscribe the queue to topics and change the queue policy accordingly
+	AllowSubscribe bool
+	// the time RunUntilSignal allows the received messages to be processed once a signal is received. Default is 30s
+	ShutdownGracePeriod time.Duration
+	// optional callback that is run when the queue was deleted during operation and could not be resolved again.
+	// The consumer stops consuming after the callback returns
+	OnQueueGone func(queueURL string)
+	// optional callback that is run whenever a handler returns an error, before the message is left for redelivery,
+	// e.g. to report the error to Sentry tagged with the route of the message. The error is logged regardless
+	OnError func(ctx context.Context, m Message, err error)
+
+	// sends []byte, json.RawMessage and string bodies of direct messages and notifications verbatim instead of
+	// encoding them as json, e.g. for proxying already encoded or non-json payloads. By default every body is encoded
+	PassthroughBodies bool
+	// optional function encoding the bodies of direct messages and notifications, e.g. to disable HTML escaping or
+	// standardize the time format across all events. Default is json.Marshal
+	JSONEncoderFunc func(v interface{}) ([]byte, error)
+	// optional codec encoding the bodies of outgoing messages and decoding the bodies of received messages with
+	// Message.Decode and DecodeModified, e.g. to use protobuf or msgpack. JSONEncoderFunc takes precedence for
+	// encoding. Default is JSONCodec
+	Codec Codec
+	// optional bucket that bodies exceeding the 256KB limit of sqs are uploaded to, a pointer to the object is sent
+	// instead like the Amazon SQS Extended Client does. Consumers fetch the body before it is decoded so handlers are
+	// unaware of it. The objects are not deleted since every subscriber of a topic reads the same object, expire them
+	// with a lifecycle rule. By default oversized bodies fail with ErrBodyOverflow
+	S3Bucket string
+	// optional s3 client used to offload and fetch large bodies, it is created from the session if nil
+	S3Client S3API
+	// compresses the bodies of notifications and direct messages with gzip and marks them with the content-encoding
+	// attribute, fitting roughly 3-4x more json under the size limit of sqs. Consumers decompress marked bodies before
+	// they are decoded regardless of this setting, enable it on the consumers before the publishers
+	Compress bool
 
 	// Add custom attributes to the message. This might be a correlationId or client meta information
 	// custom attributes will be viewable on the sqs dashboard as meta data
 	Attributes []customAttribute
+	// adds the time a message was sent as the publishedAt attribute, in RFC3339, to every notification and direct
+	// message. It is readable by the consumer with Message.Attribute("publishedAt"). A custom attribute of the same
+	// name takes precedence
+	AddTimestampAttribute bool
+	// optional function producing the deduplication id of the direct messages a consumer sends to a FIFO queue, from
+	// the body that is sent and the event. A deduplication id set with WithDeduplicationID takes precedence. Leave it
+	// unset for queues with content-based deduplication, ContentDeduplicationID hashes the body for queues without it
+	DeduplicationIDFunc func(body []byte, event string) string
 
 	// Add a custom logger, the default will be log.Println
 	Logger Logger
+	// optional hook receiving the counters of received, processed, failed, deleted and extended messages along with
+	// the latency of the handlers, and the counters of sent and failed messages of a publisher, e.g. to feed
+	// dashboards. The default discards them
+	Metrics Metrics
+
+	// optional parent context for every handler, use it to inject shared dependencies once, e.g. a database pool or
+	// a dispatcher using WithDispatcher. It lives as long as the consumer, cancelling it cancels the context of
+	// in-flight and future handlers but does not stop Consume. Defaults to context.Background(), ConsumeWithContext uses
+	// its own context instead
+	BaseContext context.Context
+
+	// optional route for messages received without a route attribute, e.g. S3 event notifications. Messages without a
+	// route are skipped if it is not set
+	DefaultRoute string
+
+	// optional transcoders keyed by the value of the content-type message attribute. When a message carries a
+	// content-type with a matching transcoder, the body is converted before it reaches the handler. Messages without
+	// a matching transcoder are passed through unchanged
+	Transcoders map[string]Transcoder
+
+	// optional function applied to the body of every received message before it is transcoded and decoded, e.g. to
+	// strip wrapper fields or unescape double-encoded json from producers that cannot be changed. It runs after the
+	// SNS envelope has been unwrapped, the default leaves the body unchanged
+	BodyPreprocessor func(body []byte) ([]byte, error)
+
+	// determines which failure metadata is attached as attributes when a message is dead-lettered by the consumer.
+	// Use gosqs.DLQAllMetadata to attach everything, the default attaches nothing. If the message has too many
+	// attributes for the metadata to fit the sqs limit of 10, it is attached as a single dlq_metadata json attribute
+	DLQMetadata DLQMetadata
+	// identifies the consumer in the dead-letter failure metadata, the default is the hostname
+	ConsumerID string
+	// the url of the queue Message.DeadLetter moves messages to, usually the DLQ of the redrive policy. Without it
+	// messages only reach the DLQ once the maxReceiveCount is exceeded
+	DLQUrl string
+
+	// sends a delivery receipt to the queue named in the replyTo attribute of a message, an ack once it was processed
+	// successfully and a nack every time the handler returns an error. Receipts are sent as direct messages with the
+	// route delivery_receipt and a gosqs.Receipt body, at least once like any other message
+	EnableReplyTo bool
+}
+
+// ThrottleBackoff tunes the exponential backoff with jitter that is applied when sns throttles a publish
+type ThrottleBackoff struct {
+	// the maximum delay before the first retry, it doubles with every retry. Default is 100ms
+	BaseDelay time.Duration
+	// caps the delay between retries. Default is 5s
+	MaxDelay time.Duration
+	// the amount of retries before a throttled publish is treated as a regular failure. Default is 8
+	Retries int
+}
+
+// withDefaults applies the defaults to the unset fields
+func (b ThrottleBackoff) withDefaults() ThrottleBackoff {
+	if b.BaseDelay <= 0 {
+		b.BaseDelay = 100 * time.Millisecond
+	}
+
+	if b.MaxDelay <= 0 {
+		b.MaxDelay = 5 * time.Second
+	}
+
+	if b.Retries <= 0 {
+		b.Retries = 8
+	}
+
+	return b
+}
+
+// delay returns a random delay between 0 and the exponential backoff of the attempt
+func (b ThrottleBackoff) delay(attempt int) time.Duration {
+	d := b.MaxDelay
+	if attempt < 32 && b.BaseDelay<<uint(attempt) < b.MaxDelay {
+		d = b.BaseDelay << uint(attempt)
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// fullQueueName creates the full name of a queue using the QueueNameFunc, falling back to defaultQueueName if it is unset
+func (c *consumer) fullQueueName(name string) string {
+	if c.queueNameFunc == nil {
+		return defaultQueueName(c.env, name)
+	}
+	return c.queueNameFunc(c.env, name)
 }
 
+// fullQueueName creates the full name of a queue using the QueueNameFunc, falling back to defaultQueueName if it is unset
+func (p *publisher) fullQueueName(name string) string {
+	if p.queueNameFunc == nil {
+		return defaultQueueName(p.env, name)
+	}
+	return p.queueNameFunc(p.env, name)
+}
+
+// defaultQueueName creates the full name of a queue by prefixing it with the env, e.g. dev-post-worker
+func defaultQueueName(env, name string) string {
+	return fmt.Sprintf("%s-%s", env, name)
+}
+
+// Transcoder converts the body of a received message from one format to another before it is handled, e.g. to
+// decode protobuf payloads into json during a migration
+type Transcoder func(body []byte) ([]byte, error)
+
 // customAttribute add custom attributes to SNS and SQS messages. This can include correlationIds, or any additional information you would like
 // separate from the payload body. These attributes can be easily seen from the SQS console.
 type customAttribute struct {
@@ -66,27 +309,43 @@ type customAttribute struct {
 	Value string
 }
 
+// CustomAttribute is a custom attribute of a single message, create it with NewAttribute
+type CustomAttribute = customAttribute
+
 // NewCustomAttribute adds a custom attribute to SNS and SQS messages. This can include correlationIds, logIds, or any additional information you would like
 // separate from the payload body. These attributes can be easily seen from the SQS console.
 //
 // must use gosqs.DataTypeNumber of gosqs.DataTypeString for the datatype, the value must match the type provided
 func (c *Config) NewCustomAttribute(dataType dataType, title string, value interface{}) error {
+	attr, err := NewAttribute(dataType, title, value)
+	if err != nil {
+		return err
+	}
+
+	c.Attributes = append(c.Attributes, attr)
+	return nil
+}
+
+// NewAttribute creates a custom attribute for a single message, e.g. a correlation id that is specific to a direct
+// message sent with Consumer.Message
+//
+// must use gosqs.DataTypeNumber of gosqs.DataTypeString for the datatype, the value must match the type provided
+func NewAttribute(dataType dataType, title string, value interface{}) (CustomAttribute, error) {
 	if dataType == DataTypeNumber {
 		val, ok := value.(int)
 		if !ok {
-			return ErrMarshal
+			return CustomAttribute{}, ErrMarshal
 		}
 
-		c.Attributes = append(c.Attributes, customAttribute{title, dataType.String(), strconv.Itoa(val)})
-		return nil
+		return customAttribute{title, dataType.String(), strconv.Itoa(val)}, nil
 	}
 
 	val, ok := value.(string)
 	if !ok {
-		return ErrMarshal
+		return CustomAttribute{}, ErrMarshal
 	}
-	c.Attributes = append(c.Attributes, customAttribute{title, dataType.String(), val})
-	return nil
+
+	return customAttribute{title, dataType.String(), val}, nil
 }
 
 type dataType string
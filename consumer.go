@@ -4,13 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
-var maxMessages = int64(10)
+// defaultVisibilityBuffer is the seconds before the visibility timeout lapses that an extension is requested
+const defaultVisibilityBuffer = 10
+
+// maxMessages is the most messages sqs returns from a single receive
+const maxMessages = int64(10)
 
 // Consumer provides an interface for receiving messages through AWS SQS and SNS
 type Consumer interface {
@@ -22,36 +33,192 @@ type Consumer interface {
 	// it will be considered unprocessable and sent to the DLQ automatically
 	//
 	// Consume uses long-polling to check and retrieve messages, if it is unable to make a connection, the aws-SDK will use its
-	// advanced retrying mechanism (including exponential backoff), if all of the retries fail, then we will wait 10s before
-	// trying again.
+	// advanced retrying mechanism (including exponential backoff), if all of the retries fail, then we will wait the
+	// RetryDelay (10s by default), backing off further on consecutive failures, before trying again.
 	//
 	// When a new message is received, it runs in a separate go-routine that will handle the full consuming of the message, error reporting
 	// and deleting
+	//
+	// If ExitAfterIdleReceives is configured, Consume returns once the queue has been empty for that many consecutive receives
+	// and all received messages have been processed
+	//
+	// Consume returns once Stop is called and all received messages have been processed
 	Consume()
+	// ConsumeWithContext is Consume with a parent context for every handler. Cancelling the context stops the
+	// consumer like Stop and cancels the context of the in-flight handlers
+	ConsumeWithContext(ctx context.Context)
+	// Run is ConsumeWithContext returning the fatal error that stopped it, or nil once it was stopped or ctx is done
+	Run(ctx context.Context) error
+	// Stop stops receiving messages and waits for the received messages to be processed. It returns ErrShutdownTimeout
+	// if the context is done first. A stopped consumer cannot be started again
+	Stop(ctx context.Context) error
+	// Shutdown is equivalent to Stop, it returns ErrShutdownTimeout stating the amount of abandoned messages if the
+	// context is done before the handlers of the received messages finished
+	Shutdown(ctx context.Context) error
+	// RunUntilSignal consumes until SIGINT or SIGTERM is received or the context is done, then stops the consumer
+	// allowing the ShutdownGracePeriod for the received messages to be processed
+	RunUntilSignal(ctx context.Context) error
 	// RegisterHandler registers an event listener and an associated handler. If the event matches, the handler will
 	// be run
 	RegisterHandler(name string, h Handler, adapters ...Adapter)
-	// Message serves as the direct messaging capability within the consumer. A worker can send direct messages to other workers
-	Message(ctx context.Context, queue, event string, body interface{})
+	// RegisterTopicHandler registers a handler for the route of messages published to the topic, it takes precedence
+	// over a handler registered for the route alone. The topic is read from the SNS envelope of the message
+	RegisterTopicHandler(topicARN, name string, h Handler, adapters ...Adapter)
+	// RegisterBatchHandler registers a handler that processes the messages of a route received together in a single call,
+	// the batch is deleted with DeleteMessageBatch if it succeeds
+	RegisterBatchHandler(name string, h BatchHandler)
+	// RegisterReplyHandler registers a handler whose reply is sent to the queue named in the replyTo attribute of the
+	// message along with its correlation id
+	RegisterReplyHandler(name string, h ReplyHandler, adapters ...Adapter)
+	// RegisterHandlerWeighted registers one of several handler variants for the same route, e.g. to canary a new
+	// implementation. Each message of the route is handled by a single variant, chosen at random in proportion to
+	// the weights
+	RegisterHandlerWeighted(name string, h Handler, weight int, adapters ...Adapter)
+	// RegisterHandlerWeightedWithOptions registers a handler variant like RegisterHandlerWeighted, the options apply
+	// to the messages handled by this variant only
+	RegisterHandlerWeightedWithOptions(name string, h Handler, weight int, opts HandlerOptions, adapters ...Adapter)
+	// RegisterHandlerWithOptions registers a handler like RegisterHandler, processing the messages of the route with
+	// the options instead of the settings of the consumer, e.g. without the visibility extension
+	RegisterHandlerWithOptions(name string, h Handler, opts HandlerOptions, adapters ...Adapter)
+	// Message serves as the direct messaging capability within the consumer. A worker can send direct messages to other workers.
+	// The attributes are sent in addition to the configured attributes and take precedence over them
+	Message(ctx context.Context, queue, event string, body interface{}, attributes ...CustomAttribute)
 	// MessageSelf serves as the self messaging capability within the consumer, a worker can send messages to itself for continued
-	// processing and resiliency
-	MessageSelf(ctx context.Context, event string, body interface{})
+	// processing and resiliency. The attributes are sent in addition to the configured attributes and take precedence over them
+	MessageSelf(ctx context.Context, event string, body interface{}, attributes ...CustomAttribute)
+	// IsFIFO reports whether the queue is a FIFO queue
+	IsFIFO() bool
+	// QueueDepth returns the approximate amount of messages available in the queue and the amount of messages that
+	// were received but not yet deleted, e.g. to feed autoscaling decisions
+	QueueDepth(ctx context.Context) (visible int, notVisible int, err error)
+	// Subscribe subscribes the queue to the topic with raw message delivery, optionally filtered to the provided routes,
+	// and allows the topic to send messages to the queue. It requires Config.AllowSubscribe
+	Subscribe(ctx context.Context, topicARN string, routes ...string) error
+
+	// The following settings can be adjusted while consuming. All other settings are applied when the consumer is created
+	// and require a restart
+
+	// SetVisibilityTimeout adjusts the visibility timeout used for extending messages, it applies to the next extension
+	SetVisibilityTimeout(seconds int)
+	// SetExtensionLimit adjusts the total amount of processing extensions, it applies to the next extension
+	SetExtensionLimit(n int)
+	// SetWorkerPool adjusts the amount of workers. If the consumer is running, workers are started or stopped immediately,
+	// a stopped worker finishes the message it is processing before exiting
+	SetWorkerPool(n int)
+	// EffectiveConfig returns the settings in use after the defaults were applied, including the adjustments made while
+	// consuming. Key and Secret are omitted so the result can be logged
+	EffectiveConfig() Config
+	// Config returns a snapshot of the queue and processing settings in use, e.g. for a diagnostics endpoint
+	Config() ConsumerInfo
+	// DumpToFile moves up to max messages from the queue to the end of a file, one json encoded DumpedMessage per line.
+	// Messages are only deleted once they were written to disk. It returns the amount of messages that were written
+	DumpToFile(ctx context.Context, path string, max int) (int, error)
+	// ReplayFromFile sends every message of a file written by DumpToFile to the queue at queueURL, malformed lines are
+	// skipped. It returns the amount of messages that were sent
+	ReplayFromFile(ctx context.Context, path, queueURL string) (int, error)
+	// ReplayFromFileAt is ReplayFromFile starting at a byte offset, it returns the offset to resume a partial replay
+	ReplayFromFileAt(ctx context.Context, path, queueURL string, offset int64) (int, int64, error)
+}
+
+// ConsumerInfo is a snapshot of the queue and processing settings a consumer uses after the defaults were applied
+type ConsumerInfo struct {
+	QueueURL          string `json:"queueUrl"`
+	VisibilityTimeout int    `json:"visibilityTimeout"`
+	ExtensionLimit    int    `json:"extensionLimit"`
+	WorkerPool        int    `json:"workerPool"`
+	MaxInFlight       int    `json:"maxInFlight"`
+	FIFO              bool   `json:"fifo"`
 }
 
 // consumer is a wrapper around sqs.SQS
 type consumer struct {
-	sqs               *sqs.SQS
-	handlers          map[string]Handler
+	// inFlight is accessed atomically and must remain 64-bit aligned
+	inFlight    int64
+	maxInFlight int64
+	maxMessages int64
+
+	sqs               SQSAPI
+	sns               SNSAPI
+	handlers          map[string]*route
+	topicHandlers     map[string]map[string]*route
+	batchHandlers     map[string]BatchHandler
 	env               string
+	queueName         string
 	QueueURL          string
 	Hostname          string
 	VisibilityTimeout int
 	workerPool        int
-	workerCount       int
+	workerPoolFunc    func() int
 	extensionLimit    int
+	visibilityBuffer  int
+	exitAfterIdle     int
+	onIdle            func(consecutiveEmpty int)
+	onQueueGone       func(queueURL string)
+	dlqMetadata       DLQMetadata
+	dlqURL            string
+	consumerID        string
+	transcoders       map[string]Transcoder
+	preprocess        func(body []byte) ([]byte, error)
+	maxReceiveCount   int
+	baseCtx           context.Context
+	defaultRoute      string
+	serial            bool
+	replyTo           bool
+	ignoreUnhandled   bool
+	deleteOnNoHandler bool
+	contextAttributes []string
+	logBodyOnError    bool
+	redact            func([]byte) []byte
+	deletes           *deleteBatcher
+	clock             func() time.Time
+	skewTolerance     time.Duration
+	skewReported      int32
+	s3                S3API
+	s3Bucket          string
+	compress          bool
+	allowSubscribe    bool
+	requireCommit     bool
+	queueNameFunc     func(env, name string) string
+	passthrough       bool
+	encode            func(v interface{}) ([]byte, error)
+	codec             Codec
+	metrics           Metrics
+	onError           func(ctx context.Context, m Message, err error)
+	maxInAppRetries   int
+	retryDLQ          bool
+	panicAsSuccess    bool
 	attributes        []customAttribute
+	timestamp         bool
+	dedupFunc         func(body []byte, event string) string
+	// intn picks the variant of a weighted route, it defaults to rand.Intn
+	intn func(n int) int
+	// config is the config the consumer was created with, it is used to report the effective config
+	config Config
+
+	// queues holds the queues of a priority consumer, it is only accessed by Consume
+	queues []*priorityQueue
+
+	fifoOnce sync.Once
+	fifo     bool
+
+	gracePeriod time.Duration
+	// retryDelay is the base delay of the backoff before a failed receive or direct message is retried
+	retryDelay time.Duration
+	// sendRetries is the amount of times a failed direct message is retried
+	sendRetries int
+	// stop is closed once the consumer is stopped, done is closed when Consume returns. Both are guarded by mu
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
 
 	logger Logger
+
+	// mu guards the settings that can be adjusted while consuming along with the running workers
+	mu          sync.RWMutex
+	jobs        chan job
+	workerCtx   context.Context
+	workerStops []chan struct{}
+	workers     sync.WaitGroup
 }
 
 // NewConsumer creates a new SQS instance and provides a configured consumer interface for
@@ -67,12 +234,52 @@ func NewConsumer(c Config, queueName string) (Consumer, error) {
 		return nil, err
 	}
 
+	cons := newConsumer(c, sqs.New(sess))
+	cons.sns = sns.New(sess)
+	if cons.s3 == nil {
+		cons.s3 = s3.New(sess)
+	}
+
+	cons.QueueURL = c.QueueURL
+	// custom QueueURLs can be provided for testing and mocking purposes
+	if cons.QueueURL == "" {
+		name := cons.queueNameFunc(c.Env, queueName)
+		o, err := cons.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: &name})
+		if err != nil {
+			return nil, err
+		}
+		cons.QueueURL = *o.QueueUrl
+		cons.queueName = name
+	}
+
+	return cons, nil
+}
+
+// NewConsumerWithClient provides a configured consumer interface using the supplied sqs client and queue url instead of
+// creating them from the config. This allows a pre-configured client or a fake to be injected, e.g. for unit tests.
+// The SessionProvider and QueueURL of the config are ignored. Subscribe is not available on the consumer
+func NewConsumerWithClient(client SQSAPI, queueURL string, c Config) (Consumer, error) {
+	if client == nil || queueURL == "" {
+		return nil, ErrQueueURL
+	}
+
+	cons := newConsumer(c, client)
+	cons.QueueURL = queueURL
+
+	return cons, nil
+}
+
+// newConsumer creates a consumer with the provided client and applies the config along with defaults
+func newConsumer(c Config, client SQSAPI) *consumer {
 	cons := &consumer{
-		sqs:               sqs.New(sess),
+		sqs:               client,
 		env:               c.Env,
 		VisibilityTimeout: 30,
 		workerPool:        30,
 		extensionLimit:    2,
+		visibilityBuffer:  defaultVisibilityBuffer,
+		maxMessages:       maxMessages,
+		config:            c,
 	}
 
 	if c.Logger != nil {
@@ -83,26 +290,99 @@ func NewConsumer(c Config, queueName string) (Consumer, error) {
 		cons.VisibilityTimeout = c.VisibilityTimeout
 	}
 
+	if c.VisibilityBuffer > 0 {
+		cons.visibilityBuffer = c.VisibilityBuffer
+	}
+
 	if c.WorkerPool != 0 {
 		cons.workerPool = c.WorkerPool
 	}
 
+	cons.workerPoolFunc = c.WorkerPoolFunc
+	cons.exitAfterIdle = c.ExitAfterIdleReceives
+	cons.onIdle = c.OnIdle
+	cons.onQueueGone = c.OnQueueGone
+	cons.dlqMetadata = c.DLQMetadata
+	cons.dlqURL = c.DLQUrl
+	cons.consumerID = c.ConsumerID
+	cons.transcoders = c.Transcoders
+	cons.preprocess = c.BodyPreprocessor
+	cons.baseCtx = c.BaseContext
+	cons.defaultRoute = c.DefaultRoute
+	cons.serial = c.SerialMode
+	cons.replyTo = c.EnableReplyTo
+	cons.ignoreUnhandled = c.IgnoreUnhandled
+	cons.deleteOnNoHandler = c.DeleteOnNoHandler
+	cons.contextAttributes = c.ContextAttributes
+	cons.logBodyOnError = c.LogBodyOnError
+	cons.redact = c.Redact
+	cons.clock = c.Clock
+	cons.s3 = c.S3Client
+	cons.s3Bucket = c.S3Bucket
+	cons.compress = c.Compress
+	cons.skewTolerance = c.ClockSkewTolerance
+	cons.allowSubscribe = c.AllowSubscribe
+	cons.requireCommit = c.RequireCommit
+	cons.passthrough = c.PassthroughBodies
+	cons.encode = c.encoder()
+	cons.codec = c.Codec
+	cons.metrics = c.Metrics
+	cons.onError = c.OnError
+	cons.attributes = c.Attributes
+	cons.timestamp = c.AddTimestampAttribute
+	cons.dedupFunc = c.DeduplicationIDFunc
+
+	cons.gracePeriod = c.ShutdownGracePeriod
+	if cons.gracePeriod <= 0 {
+		cons.gracePeriod = defaultGracePeriod
+	}
+
+	cons.retryDelay = c.RetryDelay
+	if cons.retryDelay <= 0 {
+		cons.retryDelay = defaultRetryDelay
+	}
+
+	cons.sendRetries = c.RetryCount
+	if cons.sendRetries <= 0 {
+		cons.sendRetries = maxRetryCount
+	}
+
+	cons.queueNameFunc = c.QueueNameFunc
+	if cons.queueNameFunc == nil {
+		cons.queueNameFunc = defaultQueueName
+	}
+	cons.maxInAppRetries = c.MaxInAppRetries
+	cons.retryDLQ = c.RetryExhaustedDeadLetter
+	cons.panicAsSuccess = c.PanicAsSuccess
+
 	if c.ExtensionLimit != nil {
 		cons.extensionLimit = *c.ExtensionLimit
 	}
 
-	cons.QueueURL = c.QueueURL
-	// custom QueueURLs can be provided for testing and mocking purposes
-	if cons.QueueURL == "" {
-		name := fmt.Sprintf("%s-%s", c.Env, queueName)
-		o, err := cons.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: &name})
-		if err != nil {
-			return nil, err
-		}
-		cons.QueueURL = *o.QueueUrl
+	if c.MaxInFlight > 0 {
+		cons.maxInFlight = int64(c.MaxInFlight)
 	}
 
-	return cons, nil
+	deleteBatchSize := c.DeleteBatchSize
+	if c.BatchDelete && deleteBatchSize == 0 {
+		deleteBatchSize = int(maxMessages)
+	}
+
+	if deleteBatchSize > 1 {
+		cons.deletes = newDeleteBatcher(cons, deleteBatchSize, c.DeleteFlushInterval)
+	}
+
+	// sqs returns between 1 and 10 messages per receive
+	switch {
+	case c.MaxMessages > int(maxMessages):
+		cons.maxMessages = maxMessages
+	case c.MaxMessages < 0:
+		cons.maxMessages = 1
+	case c.MaxMessages > 0:
+		cons.maxMessages = int64(c.MaxMessages)
+	}
+
+	return cons
 }
 
 // Logger accesses the logging field or applies a default logger
@@ -113,24 +393,61 @@ func (c *consumer) Logger() Logger {
 	return c.logger
 }
 
+// route holds a registered handler along with the settings that apply to that route only
+type route struct {
+	handler Handler
+	// extend determines whether the visibility extension runs while the handler is processing
+	extend bool
+	// variants holds the handlers of a route registered with RegisterHandlerWeighted
+	variants []*variant
+	// manualAck leaves deleting the message to Message.Ack, see HandlerOptions.ManualAck
+	manualAck bool
+	// visibilityTimeout and extensionLimit override the settings of the consumer, see RegisterHandlerWithOptions
+	visibilityTimeout int
+	extensionLimit    *int
+}
+
 // RegisterHandler registers an event listener and an associated handler. If the event matches, the handler will
 // be run along with any included middleware
+//
+// Use RegisterHandlerWithOptions to disable the visibility extension or the automatic delete for this route
 func (c *consumer) RegisterHandler(name string, h Handler, adapters ...Adapter) {
-	if c.handlers == nil {
-		c.handlers = make(map[string]Handler)
+	c.RegisterHandlerWithOptions(name, h, HandlerOptions{}, adapters...)
+}
+
+// newRoute wraps the handler with the adapters and applies the route options
+func newRoute(h Handler, opts HandlerOptions, adapters ...Adapter) *route {
+	r := &route{extend: !opts.WithoutExtension, manualAck: opts.ManualAck}
+	if opts.VisibilityTimeout > 0 {
+		r.visibilityTimeout = opts.VisibilityTimeout
+	}
+
+	if opts.ExtensionLimit != nil {
+		limit := *opts.ExtensionLimit
+		r.extensionLimit = &limit
 	}
 
 	for i := len(adapters) - 1; i >= 0; i-- {
 		h = adapters[i](h)
 	}
 
-	c.handlers[name] = func(ctx context.Context, m Message) error {
+	r.handler = func(ctx context.Context, m Message) error {
 		return h(ctx, m)
 	}
+
+	return r
 }
 
 var (
 	all = "All"
+
+	// systemAttributes are the sqs system attributes that are requested with every message
+	systemAttributes = []*string{
+		aws.String(sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp),
+		aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount),
+		aws.String(sqs.MessageSystemAttributeNameAwstraceHeader),
+		aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+	}
 )
 
 // Consume polls for new messages and if it finds one, decodes it, sends it to the handler and deletes it
@@ -141,160 +458,1067 @@ var (
 // it will be considered unprocessable and sent to the DLQ automatically
 //
 // Consume uses long-polling to check and retrieve messages, if it is unable to make a connection, the aws-SDK will use its
-// advanced retrying mechanism (including exponential backoff), if all of the retries fail, then we will wait 10s before
-// trying again.
+// advanced retrying mechanism (including exponential backoff), if all of the retries fail, then we will wait the
+// RetryDelay (10s by default), backing off further on consecutive failures, before trying again.
 //
 // When a new message is received, it runs in a separate go-routine that will handle the full consuming of the message, error reporting
 // and deleting
+//
+// If ExitAfterIdleReceives is configured, Consume returns once the queue has been empty for that many consecutive receives
+// and all received messages have been processed
+//
+// In SerialMode, a single message is received and processed before the next one is received. No workers are
+// started
+//
+// If the queue is deleted during operation, Consume attempts to resolve it again in case it was recreated. Otherwise
+// OnQueueGone is called and Consume returns once all received messages have been processed
+//
+// Consume returns once Stop is called and all received messages have been processed
 func (c *consumer) Consume() {
-	jobs := make(chan *message)
-	for w := 1; w <= c.workerPool; w++ {
-		go c.worker(w, jobs)
+	c.consume(context.Background(), c.baseContext(), false)
+}
+
+// ConsumeWithContext is Consume with ctx as the parent context of every handler instead of BaseContext, so values
+// attached to it at startup, e.g. a dispatcher using WithDispatcher, are seen by every handler. Once ctx is done no
+// more messages are received, the received messages are still processed before ConsumeWithContext returns but their
+// handlers see the cancellation and visibility extension stops, handlers that respect ctx.Done() can bail early
+func (c *consumer) ConsumeWithContext(ctx context.Context) {
+	c.consume(ctx, ctx, false)
+}
+
+// Run is ConsumeWithContext returning the error that stopped it, to supervise the consumer e.g. with an errgroup. It
+// returns nil once ctx is done, Stop is called or ExitAfterIdleReceives is reached. Fatal errors stop it after the
+// received messages have been processed: ErrQueueGone when the queue was deleted, and ErrGetMessage when receiving
+// is denied, e.g. for invalid credentials or missing permissions. Other receive errors are retried
+func (c *consumer) Run(ctx context.Context) error {
+	return c.consume(ctx, ctx, true)
+}
+
+// consume receives messages until parent is done or the consumer is stopped, handlers run with the handler context.
+// It returns the error that stopped it, with exitOnFatal errors that cannot be recovered by retrying stop it as well
+func (c *consumer) consume(parent, handlerCtx context.Context, exitOnFatal bool) error {
+	defer close(c.started())
+	// the workers have finished once consume returns, delete the messages that are still buffered
+	defer c.flushDeletes()
+
+	// receiving is cancelled once the consumer is stopped
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stopSignal():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	c.loadRedrivePolicy()
+
+	var jobs chan<- job
+	if !c.serial {
+		jobs = c.startWorkers(handlerCtx)
 	}
 
+	var idle, failures int
 	for {
-		output, err := c.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{QueueUrl: &c.QueueURL, MaxNumberOfMessages: &maxMessages, MessageAttributeNames: []*string{&all}})
+		if ctx.Err() != nil {
+			// the consumer was stopped, wait for the workers to finish the remaining messages
+			c.stopWorkers()
+			return nil
+		}
+
+		max := c.capacity()
+		// the visibility timeout starts when sqs returns the messages, measuring from the request errs on the safe side
+		received := time.Now()
+		output, queueURL, err := c.receive(ctx, max)
 		if err != nil {
-			c.Logger().Println("%s , retrying in 10s", ErrGetMessage.Context(err).Error())
-			time.Sleep(10 * time.Second)
+			if ctx.Err() != nil {
+				continue
+			}
+
+			if isQueueGone(err) {
+				if c.resolveQueue() {
+					continue
+				}
+
+				// the queue was deleted and has not been recreated, stop consuming instead of polling a dead queue
+				c.Logger().Println(ErrQueueGone.Context(err).Error())
+				if c.onQueueGone != nil {
+					c.onQueueGone(queueURL)
+				}
+				c.stopWorkers()
+				return ErrQueueGone.Context(err)
+			}
+
+			if exitOnFatal && isFatal(err) {
+				c.Logger().Println(ErrGetMessage.Context(err).Error())
+				c.stopWorkers()
+				return ErrGetMessage.Context(err)
+			}
+
+			delay := retryBackoff(c.retryDelay, failures)
+			failures++
+			c.Logger().Println(ErrGetMessage.Context(err).Error(), "retrying in", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
 			continue
 		}
+		failures = 0
 
+		if len(output.Messages) == 0 {
+			idle++
+			if c.onIdle != nil {
+				c.onIdle(idle)
+			}
+			if c.exitAfterIdle > 0 && idle >= c.exitAfterIdle {
+				// the queue has been drained, wait for the workers to finish the remaining messages
+				c.stopWorkers()
+				return nil
+			}
+			continue
+		}
+		idle = 0
+
+		visibilityTimeout, _ := c.settings()
+		var batches map[string][]*message
 		for _, m := range output.Messages {
-			if _, ok := m.MessageAttributes["route"]; !ok {
+			c.meter().IncReceived()
+			msg := newMessage(m)
+			msg.queueURL = queueURL
+			c.stamp(msg)
+			msg.setVisibleAt(received.Add(time.Duration(visibilityTimeout) * time.Second))
+			if c.defaultRoute != "" {
+				msg.defaultRoute(c.defaultRoute)
+			}
+
+			if _, ok := msg.MessageAttributes["route"]; !ok {
 				//a message will be sent to the DLQ automatically after 4 tries if it is received but not deleted
 				c.Logger().Println(ErrNoRoute.Error())
 				continue
 			}
 
-			jobs <- newMessage(m)
+			if c.isBatchRoute(msg) {
+				if batches == nil {
+					batches = make(map[string][]*message)
+				}
+				batches[msg.Route()] = append(batches[msg.Route()], msg)
+				continue
+			}
+
+			atomic.AddInt64(&c.inFlight, 1)
+			if c.serial {
+				c.process(handlerCtx, msg)
+				continue
+			}
+			jobs <- job{message: msg}
 		}
+
+		for _, batch := range batches {
+			atomic.AddInt64(&c.inFlight, int64(len(batch)))
+			if c.serial {
+				c.processBatch(handlerCtx, batch)
+				continue
+			}
+			jobs <- job{batch: batch}
+		}
+	}
+}
+
+// defaultClockSkewTolerance is how far a message may appear to be sent in the future before clock skew is reported
+const defaultClockSkewTolerance = time.Second
+
+// now returns the current time of the configured Clock
+func (c *consumer) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
+
+// stamp records the time the message was received at. A message that appears to be sent in the future by more than
+// the ClockSkewTolerance means the local clock is behind AWS, which is logged once
+func (c *consumer) stamp(m *message) {
+	m.clock = c.clock
+	m.receivedAt = c.now()
+
+	sent := m.systemTime(sqs.MessageSystemAttributeNameSentTimestamp)
+	if sent.IsZero() {
+		return
+	}
+
+	tolerance := c.skewTolerance
+	if tolerance <= 0 {
+		tolerance = defaultClockSkewTolerance
+	}
+
+	if skew := sent.Sub(m.receivedAt); skew > tolerance && atomic.CompareAndSwapInt32(&c.skewReported, 0, 1) {
+		c.Logger().Println(ErrClockSkew.Context(fmt.Errorf("a message was sent %v in the future", skew)).Error())
+	}
+}
+
+// fifoSuffix is the suffix that the name of every FIFO queue must have
+const fifoSuffix = ".fifo"
+
+// IsFIFO reports whether the queue is a FIFO queue. It is determined once from the queue url since the name of a
+// FIFO queue must end with .fifo
+func (c *consumer) IsFIFO() bool {
+	c.fifoOnce.Do(func() {
+		c.fifo = strings.HasSuffix(c.queueURL(), fifoSuffix)
+	})
+
+	return c.fifo
+}
+
+// receive retrieves up to max messages from the queue and returns them along with the url of the queue they were
+// received from. A priority consumer receives from its queues in order of priority
+func (c *consumer) receive(ctx context.Context, max int64) (*sqs.ReceiveMessageOutput, string, error) {
+	if len(c.queues) == 0 {
+		queueURL := c.queueURL()
+		out, err := c.sqs.ReceiveMessageWithContext(ctx, receiveInput(queueURL, max))
+		return out, queueURL, err
+	}
+
+	return c.receivePriority(ctx, max)
+}
+
+// receiveInput creates the request for receiving messages from the queue along with their attributes
+func receiveInput(queueURL string, max int64) *sqs.ReceiveMessageInput {
+	return &sqs.ReceiveMessageInput{QueueUrl: &queueURL, MaxNumberOfMessages: &max, MessageAttributeNames: []*string{&all}, AttributeNames: systemAttributes}
+}
+
+// QueueDepth returns the ApproximateNumberOfMessages and ApproximateNumberOfMessagesNotVisible attributes of the
+// queue. The values are eventually consistent and may lag behind by a minute
+func (c *consumer) QueueDepth(ctx context.Context) (int, int, error) {
+	o, err := c.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(c.queueURL()),
+		AttributeNames: []*string{
+			aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages),
+			aws.String(sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible),
+		},
+	})
+	if err != nil {
+		return 0, 0, ErrQueueAttributes.Context(err)
+	}
+
+	visible, err := strconv.Atoi(aws.StringValue(o.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+	if err != nil {
+		return 0, 0, ErrQueueAttributes.Context(err)
+	}
+
+	notVisible, err := strconv.Atoi(aws.StringValue(o.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]))
+	if err != nil {
+		return 0, 0, ErrQueueAttributes.Context(err)
+	}
+
+	return visible, notVisible, nil
+}
+
+// redrivePolicy is the json structure of the RedrivePolicy queue attribute
+type redrivePolicy struct {
+	DeadLetterTargetArn string          `json:"deadLetterTargetArn"`
+	MaxReceiveCount     json.RawMessage `json:"maxReceiveCount"`
+}
+
+// loadRedrivePolicy retrieves the maxReceiveCount of the queue's redrive policy. Queues without a redrive policy or
+// a failure to retrieve it leave the extension behaviour unchanged
+func (c *consumer) loadRedrivePolicy() {
+	o, err := c.sqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(c.queueURL()),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameRedrivePolicy)},
+	})
+	if err != nil {
+		c.Logger().Println(ErrQueueAttributes.Context(err).Error())
+		return
+	}
+
+	v, ok := o.Attributes[sqs.QueueAttributeNameRedrivePolicy]
+	if !ok || v == nil {
+		return
+	}
+
+	var p redrivePolicy
+	if err := json.Unmarshal([]byte(*v), &p); err != nil {
+		c.Logger().Println(ErrQueueAttributes.Context(err).Error())
+		return
+	}
+
+	// the maxReceiveCount is returned either as a number or as a string
+	n, err := strconv.Atoi(strings.Trim(string(p.MaxReceiveCount), `"`))
+	if err != nil {
+		c.Logger().Println(ErrQueueAttributes.Context(err).Error())
+		return
+	}
+
+	c.maxReceiveCount = n
+}
+
+// redriveImminent determines whether the message is on one of its last attempts before sqs moves it to the DLQ
+func (c *consumer) redriveImminent(m *message) bool {
+	return c.maxReceiveCount > 0 && m.ReceiveCount() >= c.maxReceiveCount-1
+}
+
+// queueResolveAttempts is the amount of times the queue url is resolved after the queue was deleted, in case it was recreated
+var queueResolveAttempts = 3
+
+// queueResolveInterval is the time to wait between attempts to resolve a deleted queue
+var queueResolveInterval = 10 * time.Second
+
+// isQueueGone determines whether the error was caused by the queue no longer existing
+func isQueueGone(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == sqs.ErrCodeQueueDoesNotExist
+}
+
+// isFatal determines whether receiving failed for a reason that retrying cannot resolve, e.g. invalid credentials or
+// missing permissions
+func isFatal(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case "AccessDenied", "AccessDeniedException", "InvalidClientTokenId", "UnrecognizedClientException", "SignatureDoesNotMatch":
+		return true
 	}
+
+	return false
+}
+
+// resolveQueue attempts to resolve the queue url again after the queue was deleted. It returns true if the queue exists.
+// Queues that were configured with a custom QueueURL cannot be resolved
+func (c *consumer) resolveQueue() bool {
+	if c.queueName == "" {
+		return false
+	}
+
+	for i := 0; i < queueResolveAttempts; i++ {
+		if i > 0 {
+			time.Sleep(queueResolveInterval)
+		}
+
+		o, err := c.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: &c.queueName})
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		c.QueueURL = *o.QueueUrl
+		c.mu.Unlock()
+		return true
+	}
+
+	return false
 }
 
-// worker is an always-on concurrent worker that will take tasks when they are added into the messages buffer
-func (c *consumer) worker(id int, messages <-chan *message) {
-	for m := range messages {
-		if err := c.run(m); err != nil {
+// queueURL returns the url of the queue, it changes when the queue is resolved again after it was deleted
+func (c *consumer) queueURL() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.QueueURL
+}
+
+// startWorkers starts the worker pool and returns the channel that feeds messages to the workers
+func (c *consumer) startWorkers(ctx context.Context) chan<- job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.jobs = make(chan job)
+	c.workerCtx = ctx
+	pool := c.poolSize()
+	for w := 1; w <= pool; w++ {
+		c.addWorker()
+	}
+
+	return c.jobs
+}
+
+// addWorker starts a single worker, c.mu must be held
+func (c *consumer) addWorker() {
+	stop := make(chan struct{})
+	c.workerStops = append(c.workerStops, stop)
+
+	c.workers.Add(1)
+	go func(ctx context.Context, id int, jobs <-chan job) {
+		defer c.workers.Done()
+		c.worker(ctx, id, jobs, stop)
+	}(c.workerCtx, len(c.workerStops), c.jobs)
+}
+
+// stopWorkers closes the jobs channel and waits for the workers to finish processing the remaining messages
+func (c *consumer) stopWorkers() {
+	if c.serial {
+		return
+	}
+
+	c.mu.Lock()
+	close(c.jobs)
+	c.jobs = nil
+	c.workerStops = nil
+	c.mu.Unlock()
+
+	c.workers.Wait()
+}
+
+// SetWorkerPool adjusts the amount of workers. If the consumer is running, workers are started or stopped immediately,
+// a stopped worker finishes the message it is processing before exiting
+func (c *consumer) SetWorkerPool(n int) {
+	if n <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.workerPool = n
+	c.workerPoolFunc = nil
+	if c.jobs == nil {
+		// not consuming, the pool size is applied when Consume starts
+		return
+	}
+
+	for len(c.workerStops) < n {
+		c.addWorker()
+	}
+
+	for len(c.workerStops) > n {
+		last := len(c.workerStops) - 1
+		close(c.workerStops[last])
+		c.workerStops = c.workerStops[:last]
+	}
+}
+
+// SetVisibilityTimeout adjusts the visibility timeout used for extending messages, it applies to the next extension
+func (c *consumer) SetVisibilityTimeout(seconds int) {
+	if seconds <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.VisibilityTimeout = seconds
+	c.mu.Unlock()
+}
+
+// SetExtensionLimit adjusts the total amount of processing extensions, it applies to the next extension
+func (c *consumer) SetExtensionLimit(n int) {
+	if n < 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.extensionLimit = n
+	c.mu.Unlock()
+}
+
+// settings returns the current visibility timeout and extension limit
+func (c *consumer) settings() (visibilityTimeout, extensionLimit int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.VisibilityTimeout, c.extensionLimit
+}
+
+// EffectiveConfig returns the settings in use after the defaults were applied, including the adjustments made while
+// consuming. Key and Secret are omitted so the result can be logged
+func (c *consumer) EffectiveConfig() Config {
+	cfg := c.config
+	cfg.Key, cfg.Secret = "", ""
+	cfg.QueueURL = c.queueURL()
+	cfg.QueueNameFunc = c.queueNameFunc
+	cfg.ShutdownGracePeriod = c.gracePeriod
+	cfg.RetryDelay = c.retryDelay
+	cfg.Logger = c.Logger()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	extensionLimit := c.extensionLimit
+	cfg.ExtensionLimit = &extensionLimit
+	cfg.VisibilityTimeout = c.VisibilityTimeout
+	cfg.WorkerPool = c.workerPool
+	cfg.WorkerPoolFunc = c.workerPoolFunc
+	cfg.MaxMessages = int(c.maxMessages)
+	cfg.VisibilityBuffer = c.visibilityBuffer
+
+	return cfg
+}
+
+// Config returns a snapshot of the queue and processing settings in use, e.g. for a diagnostics endpoint
+func (c *consumer) Config() ConsumerInfo {
+	info := ConsumerInfo{
+		QueueURL:    c.queueURL(),
+		MaxInFlight: int(c.maxInFlight),
+		FIFO:        c.IsFIFO(),
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	info.VisibilityTimeout = c.VisibilityTimeout
+	info.ExtensionLimit = c.extensionLimit
+	info.WorkerPool = c.workerPool
+
+	return info
+}
+
+// poolSize returns the amount of workers to start. WorkerPoolFunc is evaluated if it is provided, otherwise the
+// static worker pool is used
+func (c *consumer) poolSize() int {
+	if c.workerPoolFunc != nil {
+		if n := c.workerPoolFunc(); n > 0 {
+			return n
+		}
+	}
+
+	return c.workerPool
+}
+
+// inFlightInterval is the time to wait before checking again if the in-flight limit has been reached
+var inFlightInterval = 100 * time.Millisecond
+
+// capacity returns the amount of messages that can be requested from sqs. If MaxInFlight is configured and has been
+// reached, capacity blocks until in-flight messages are consumed
+func (c *consumer) capacity() int64 {
+	if c.serial {
+		return 1
+	}
+
+	if c.maxInFlight <= 0 {
+		return c.maxMessages
+	}
+
+	for {
+		available := c.maxInFlight - atomic.LoadInt64(&c.inFlight)
+		if available > 0 {
+			if available > c.maxMessages {
+				return c.maxMessages
+			}
+			return available
+		}
+
+		time.Sleep(inFlightInterval)
+	}
+}
+
+// worker is an always-on concurrent worker that will take tasks when they are added into the messages buffer. It runs
+// until the messages buffer is closed or it is stopped
+func (c *consumer) worker(ctx context.Context, id int, jobs <-chan job, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case j, ok := <-jobs:
+			if !ok {
+				return
+			}
+
+			if j.batch != nil {
+				c.processBatch(ctx, j.batch)
+				continue
+			}
+			c.process(ctx, j.message)
+		}
+	}
+}
+
+// process runs the message and logs any errors
+func (c *consumer) process(ctx context.Context, m *message) {
+	if err := c.run(ctx, m); err != nil {
+		if c.logBodyOnError {
+			c.Logger().Println(err.Error(), "body:", string(c.loggedBody(m)))
+		} else {
 			c.Logger().Println(err.Error())
 		}
 	}
+
+	// the message has either been deleted or released back to the queue
+	atomic.AddInt64(&c.inFlight, -1)
+}
+
+// maxLoggedBody is the amount of bytes of the body that are logged with LogBodyOnError
+const maxLoggedBody = 1024
+
+// loggedBody returns the body of the message as it is logged with LogBodyOnError, the Redact function is applied
+// before the body is truncated to maxLoggedBody
+func (c *consumer) loggedBody(m *message) []byte {
+	body := append([]byte(nil), m.payload...)
+	if c.redact != nil {
+		body = c.redact(body)
+	}
+
+	if len(body) > maxLoggedBody {
+		body = append(body[:maxLoggedBody:maxLoggedBody], "..."...)
+	}
+
+	return body
+}
+
+// baseContext returns the parent context of every handler
+func (c *consumer) baseContext() context.Context {
+	if c.baseCtx == nil {
+		return context.Background()
+	}
+	return c.baseCtx
 }
 
-// run should be run within a worker
+// run should be run within a worker, ctx is the parent context of the handler
 
-// if there is no handler for that route, then the message will be deleted and fully consumed
+// if there is no handler for that route, then the message is left in the queue unless DeleteOnNoHandler is set. With
+// IgnoreUnhandled it is released back to the queue right away
 //
 // if the handler exists, it will wait for the err channel to be processed. Once it receives feedback from the handler in the form
 // of a channel, it will either log the error, or consume the message
-func (c *consumer) run(m *message) error {
-	if h, ok := c.handlers[m.Route()]; ok {
-		ctx := context.Background()
+func (c *consumer) run(ctx context.Context, m *message) error {
+	r, ok := c.routeFor(m)
+	if !ok {
+		return c.unhandled(m)
+	}
 
-		go c.extend(ctx, m)
-		if err := h(ctx, m); err != nil {
-			return m.ErrorResponse(ctx, err)
-		}
+	// the variant of a weighted route is chosen up front so that its own options apply to the message
+	if len(r.variants) > 0 {
+		r = c.pickVariant(r.variants).route
+	}
 
-		// finish the extension channel if the message was processed successfully
+	if c.maxInAppRetries > 0 {
+		ctx = context.WithValue(ctx, retryCapKey, c.maxInAppRetries)
+	}
+	if c.retryDLQ && c.dlqURL != "" {
+		ctx = context.WithValue(ctx, retryDLQKey, true)
+	}
+	if c.panicAsSuccess {
+		ctx = context.WithValue(ctx, panicAsSuccessKey, true)
+	}
+	if h := m.TraceHeader(); h != "" {
+		ctx = WithTraceHeader(ctx, h)
+	}
+	ctx = c.attributeContext(ctx, m)
+
+	if err := c.fetchOffloaded(ctx, m); err != nil {
+		return err
+	}
+
+	if err := c.decompress(m); err != nil {
+		return err
+	}
+
+	if err := c.preprocessBody(m); err != nil {
+		return err
+	}
+
+	if err := c.transcode(m); err != nil {
+		return err
+	}
+
+	m.codec = c.codec
+	m.commit = c.delete
+	m.deadLetter = c.deadLetter
+	m.changeVisibility = c.changeVisibility
+
+	// extending a message that is about to be moved to the DLQ only delays the inevitable
+	if r.extend && !c.redriveImminent(m) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go c.extend(ctx, m, r, cancel)
+	}
+	start := time.Now()
+	err := r.handler(ctx, m)
+	c.meter().ObserveLatency(m.Route(), time.Since(start))
+	if m.isDeferred() {
+		// the handler rescheduled the message, it is neither a failure nor deleted
 		m.Success(ctx)
+		return nil
+	}
+
+	if err != nil {
+		c.meter().IncFailed(m.Route(), err)
+		if c.onError != nil {
+			c.onError(ctx, m, err)
+		}
+		c.reply(ctx, m, err)
+		if IsTerminal(err) {
+			m.ErrorResponse(ctx, err)
+			return c.discard(ctx, m, err)
+		}
+		return m.ErrorResponse(ctx, err)
+	}
+
+	// finish the extension channel if the message was processed successfully
+	m.Success(ctx)
+	c.meter().IncProcessed(m.Route())
+
+	// once the visibility lapsed the message may have been redelivered, deleting it now would remove it from
+	// underneath the consumer that is processing it
+	if m.visibilityLapsed() {
+		return ErrLateCompletion.Context(fmt.Errorf("route: %s", m.Route()))
+	}
+
+	if c.requireCommit && !m.isCommitted() {
+		return ErrNotCommitted.Context(fmt.Errorf("route: %s", m.Route()))
+	}
+
+	c.reply(ctx, m, nil)
+
+	// the message was acked by the handler or is left for it to be acked
+	if m.isCommitted() || r.manualAck {
+		return nil
+	}
+
+	//deletes message if the handler was successful
+	return c.deleteProcessed(m) //MESSAGE CONSUMED
+}
+
+// discard removes a message whose handler failed with a terminal error from the queue so it is not redelivered. It is
+// moved to the DLQ along with the error when a DLQUrl is configured and deleted otherwise
+func (c *consumer) discard(ctx context.Context, m *message, err error) error {
+	// the handler already removed the message, or it may have been redelivered since
+	if m.isCommitted() || m.visibilityLapsed() {
+		return ErrTerminal.Context(err)
+	}
+
+	var rerr error
+	if c.dlqURL != "" {
+		rerr = c.deadLetter(ctx, m, err)
+	} else {
+		rerr = c.delete(m)
+	}
+
+	if rerr != nil {
+		return rerr
 	}
 
-	//deletes message if the handler was successful or if there was no handler with that route
-	return c.delete(m) //MESSAGE CONSUMED
+	return ErrTerminal.Context(err)
+}
+
+// unhandled leaves a message without a registered handler in the queue, it becomes visible again once its visibility
+// timeout lapses and is moved to the DLQ by the redrive policy. With IgnoreUnhandled it is released right away and
+// with DeleteOnNoHandler it is deleted
+func (c *consumer) unhandled(m *message) error {
+	switch {
+	case c.ignoreUnhandled:
+		return c.ignore(m)
+	case c.deleteOnNoHandler:
+		c.Logger().Println(ErrNoRoute.Context(fmt.Errorf("no handler for route %s, deleting", m.Route())).Error())
+		return c.delete(m)
+	}
+
+	c.Logger().Println(ErrNoRoute.Context(fmt.Errorf("no handler for route %s, leaving it in the queue", m.Route())).Error())
+	return nil
+}
+
+// preprocessBody applies the BodyPreprocessor to the body of the message, it runs after the SNS envelope has been
+// unwrapped and before the body is transcoded
+func (c *consumer) preprocessBody(m *message) error {
+	if c.preprocess == nil {
+		return nil
+	}
+
+	out, err := c.preprocess(m.payload)
+	if err != nil {
+		return ErrPreprocess.Context(err)
+	}
+
+	m.payload = out
+	return nil
+}
+
+// maxUnhandledReceives is the amount of times a message without a handler can be ignored before it is deleted
+var maxUnhandledReceives = 10
+
+// ignore releases a message without a handler back to the queue so a sibling consumer can receive it
+func (c *consumer) ignore(m *message) error {
+	if m.ReceiveCount() >= maxUnhandledReceives {
+		c.Logger().Println(ErrUnhandledLimit.Error(), m.Route())
+		return c.delete(m)
+	}
+
+	var visible int64
+	if _, err := c.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{QueueUrl: c.sourceQueue(m), ReceiptHandle: m.ReceiptHandle, VisibilityTimeout: &visible}); err != nil {
+		// the message becomes visible once its visibility timeout lapses
+		c.Logger().Println(ErrUnableToExtend.Context(err).Error())
+	}
+
+	return nil
+}
+
+// contentTypeAttribute is the message attribute used to select a Transcoder
+const contentTypeAttribute = "content-type"
+
+// transcode converts the body of the message using the transcoder registered for its content-type
+func (c *consumer) transcode(m *message) error {
+	t, ok := c.transcoders[m.Attribute(contentTypeAttribute)]
+	if !ok {
+		return nil
+	}
+
+	out, err := t(m.payload)
+	if err != nil {
+		return ErrTranscode.Context(err)
+	}
+
+	m.payload = out
+	return nil
 }
 
 // MessageSelf serves as the self messaging capability within the consumer, a worker can send messages to itself for continued
 // processing and resiliency
-func (c *consumer) MessageSelf(ctx context.Context, event string, body interface{}) {
-	o, err := json.Marshal(body)
+//
+// The attributes are sent in addition to the configured attributes and take precedence over them, create them with
+// NewAttribute
+//
+// On a FIFO queue the message is sent to the group set with WithMessageGroupID on the context, along with the
+// deduplication id set with WithDeduplicationID or produced by the DeduplicationIDFunc
+func (c *consumer) MessageSelf(ctx context.Context, event string, body interface{}, attributes ...CustomAttribute) {
+	out, err := marshalBody(body, c.passthrough, c.encode)
 	if err != nil {
-		log.Println(ErrMarshal.Context(err).Error(), event)
+		c.Logger().Println(ErrMarshal.Context(err).Error(), event)
 		return
 	}
 
-	out := string(o)
+	attributes = outgoingAttributes(mergeAttributes(c.attributes, attributes), c.timestamp)
+	out, attributes, err = prepareBody(out, event, attributes, c.compress, c.s3, c.s3Bucket)
+	if err != nil {
+		c.Logger().Println(err.Error(), event)
+		return
+	}
+
+	if err := validateAttributes(out, event, attributes); err != nil {
+		c.Logger().Println(err.Error(), event)
+		return
+	}
 
 	sqsInput := &sqs.SendMessageInput{
-		MessageBody:       &out,
-		MessageAttributes: defaultSQSAttributes(event, c.attributes...),
-		QueueUrl:          &c.QueueURL,
+		MessageBody:             &out,
+		MessageAttributes:       defaultSQSAttributes(event, attributes...),
+		MessageSystemAttributes: traceAttributes(ctx),
+		QueueUrl:                aws.String(c.queueURL()),
 	}
+	applyFIFO(ctx, sqsInput, event, c.dedupFunc)
+	applyDelay(sqsInput, Delay(ctx))
 
 	go c.sendDirectMessage(ctx, sqsInput, event)
 }
 
 // Message serves as the direct messaging capability within the consumer. A worker can send direct messages to other workers
-func (c *consumer) Message(ctx context.Context, queue, event string, body interface{}) {
-	name := fmt.Sprintf("%s-%s", c.env, queue)
+//
+// The attributes are sent in addition to the configured attributes and take precedence over them, create them with
+// NewAttribute
+//
+// On a FIFO queue the message is sent to the group set with WithMessageGroupID on the context, along with the
+// deduplication id set with WithDeduplicationID or produced by the DeduplicationIDFunc
+func (c *consumer) Message(ctx context.Context, queue, event string, body interface{}, attributes ...CustomAttribute) {
+	name := c.fullQueueName(queue)
+	attributes = mergeAttributes(c.attributes, attributes)
 
 	queueResp, err := c.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: &name})
 	if err != nil {
-		log.Printf("%s, queue: %s", ErrQueueURL.Context(err).Error(), name)
+		c.Logger().Println(ErrQueueURL.Context(err).Error(), "queue:", name)
 		return
 	}
 
-	o, err := json.Marshal(body)
+	out, err := marshalBody(body, c.passthrough, c.encode)
 	if err != nil {
-		log.Println(ErrMarshal.Context(err).Error(), event)
+		c.Logger().Println(ErrMarshal.Context(err).Error(), event)
 		return
 	}
 
-	out := string(o)
+	out, attributes, err = prepareBody(out, event, outgoingAttributes(attributes, c.timestamp), c.compress, c.s3, c.s3Bucket)
+	if err != nil {
+		c.Logger().Println(err.Error(), event)
+		return
+	}
+
+	if err := validateAttributes(out, event, attributes); err != nil {
+		c.Logger().Println(err.Error(), event)
+		return
+	}
 
 	sqsInput := &sqs.SendMessageInput{
-		MessageBody:       &out,
-		MessageAttributes: defaultSQSAttributes(event, c.attributes...),
-		QueueUrl:          queueResp.QueueUrl,
+		MessageBody:             &out,
+		MessageAttributes:       defaultSQSAttributes(event, attributes...),
+		MessageSystemAttributes: traceAttributes(ctx),
+		QueueUrl:                queueResp.QueueUrl,
 	}
+	applyFIFO(ctx, sqsInput, event, c.dedupFunc)
+	applyDelay(sqsInput, Delay(ctx))
 
 	go c.sendDirectMessage(ctx, sqsInput, event)
 }
 
 // sendDirectMessage is a helper that should be run concurrently since it will block the main thread if there is a connection issue
+//
+// Like the direct messages of the publisher, a failed send is retried up to the RetryCount (5 by default) before the
+// message is dropped. A message exceeding the size limit is dropped right away since it fails on every retry
 func (c *consumer) sendDirectMessage(ctx context.Context, input *sqs.SendMessageInput, event string) {
-	if _, err := c.sqs.SendMessage(input); err != nil {
-		log.Printf("%s, event: %s \nretrying in 10s", ErrPublish.Context(err).Error(), event)
-		time.Sleep(10 * time.Second)
-		c.sendDirectMessage(ctx, input, event)
+	for attempt := 0; ; attempt++ {
+		_, err := c.sqs.SendMessage(input)
+		if err == nil {
+			return
+		}
+
+		if isOversize(err) {
+			c.Logger().Println(ErrBodyOverflow.Context(err).Error(), event)
+			return
+		}
+
+		if attempt >= c.sendRetries {
+			c.Logger().Println(ErrPublish.Context(fmt.Errorf("dropped after %d retries: %w", attempt, err)).Error(), event)
+			return
+		}
+
+		delay := retryBackoff(c.retryDelay, attempt)
+		c.Logger().Println(ErrPublish.Context(err).Error(), event, "retrying in", delay)
+		time.Sleep(delay)
 	}
 }
 
+// sourceQueue returns the url of the queue the message was received from
+func (c *consumer) sourceQueue(m *message) *string {
+	if m.queueURL != "" {
+		return &m.queueURL
+	}
+
+	return aws.String(c.queueURL())
+}
+
 // delete will remove a message from the queue, this is necessary to fully and successfully consume a message
 func (c *consumer) delete(m *message) error {
-	_, err := c.sqs.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: &c.QueueURL, ReceiptHandle: m.ReceiptHandle})
+	_, err := c.sqs.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: c.sourceQueue(m), ReceiptHandle: m.ReceiptHandle})
 	if err != nil {
 		c.Logger().Println(ErrUnableToDelete.Context(err).Error())
+		c.meter().IncDeleteFailed()
 		return ErrUnableToDelete.Context(err)
 	}
+	c.meter().IncDeleted()
 	return nil
 }
 
-func (c *consumer) extend(ctx context.Context, m *message) {
+// renewAfter returns how long extend waits before renewing the visibility of a message, leaving the VisibilityBuffer
+// for the request. If the visibility timeout is too short to leave any processing time, it renews halfway through
+func (c *consumer) renewAfter(visibilityTimeout int) time.Duration {
+	if wait := visibilityTimeout - c.visibilityBuffer; wait > 0 {
+		return time.Duration(wait) * time.Second
+	}
+
+	if visibilityTimeout <= 0 {
+		return time.Second
+	}
+
+	return time.Duration(visibilityTimeout) * time.Second / 2
+}
+
+// extend renews the visibility of the message until the handler finishes, the processing is abandoned or the
+// extension limit is reached. It returns as soon as the handler finishes instead of waiting for the next renewal.
+// Once the limit is reached the handler context is cancelled when the visibility lapses, since the message may be
+// redelivered from then on
+//
+// The visibility timeout and extension limit of the route apply, a nil route uses the ones of the consumer
+func (c *consumer) extend(ctx context.Context, m *message, r *route, cancel context.CancelFunc) {
 	var count int
-	extension := int64(c.VisibilityTimeout)
+	visibilityTimeout, _ := c.routeSettings(r)
+	extension := int64(visibilityTimeout)
+
+	// the message was received with the visibility timeout of the consumer
+	if received, _ := c.settings(); received != visibilityTimeout && !c.extendVisibility(ctx, m, extension) {
+		return
+	}
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
 	for {
+		visibilityTimeout, extensionLimit := c.routeSettings(r)
+
 		//only allow 1 extensions (Default 1m30s)
-		if count >= c.extensionLimit {
+		if count >= extensionLimit {
 			c.Logger().Println(ErrMessageProcessing.Error(), m.Route())
+			cancelOnLapse(ctx, m, timer, cancel, time.Duration(visibilityTimeout)*time.Second)
 			return
 		}
 
 		count++
-		// allow 10 seconds to process the extension request
-		time.Sleep(time.Duration(c.VisibilityTimeout-10) * time.Second)
+		// allow the visibility buffer to process the extension request
+		timer.Reset(c.renewAfter(visibilityTimeout))
 		select {
-		case <-m.err:
+		case <-m.done:
 			// goroutine finished
 			return
-		default:
-			// double the allowed processing time
-			extension = extension + int64(c.VisibilityTimeout)
-			_, err := c.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{QueueUrl: &c.QueueURL, ReceiptHandle: m.ReceiptHandle, VisibilityTimeout: &extension})
-			if err != nil {
-				c.Logger().Println(ErrUnableToExtend.Error(), err.Error())
-				return
-			}
+		case <-ctx.Done():
+			// processing was abandoned
+			return
+		case <-timer.C:
+		}
+
+		// double the allowed processing time
+		extension = extension + int64(visibilityTimeout)
+		if !c.extendVisibility(ctx, m, extension) {
+			return
 		}
 	}
 }
+
+// cancelOnLapse calls cancel once the visibility of the message lapsed, unless the handler finished first. The
+// deadline is followed if the handler extends it, if it is unknown the visibility timeout is waited
+func cancelOnLapse(ctx context.Context, m *message, timer *time.Timer, cancel context.CancelFunc, visibilityTimeout time.Duration) {
+	fallback := time.Now().Add(visibilityTimeout)
+	for {
+		deadline := fallback
+		if v := atomic.LoadInt64(&m.visibleAt); v != 0 {
+			deadline = time.Unix(0, v)
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			cancel()
+			return
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-m.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// extendVisibility changes the visibility timeout of the message unless the handler finished in the meantime, it
+// reports whether the visibility was extended
+func (c *consumer) extendVisibility(ctx context.Context, m *message, extension int64) bool {
+	m.extendMu.Lock()
+	defer m.extendMu.Unlock()
+
+	select {
+	case <-m.done:
+		return false
+	default:
+	}
+
+	if err := c.changeVisibility(ctx, m, extension); err != nil {
+		c.Logger().Println(err.Error())
+		return false
+	}
+
+	c.meter().IncExtended(m.Route())
+	return true
+}
+
+// changeVisibility sets the visibility timeout of the message, counting from now
+func (c *consumer) changeVisibility(ctx context.Context, m *message, seconds int64) error {
+	requested := time.Now()
+	_, err := c.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{QueueUrl: c.sourceQueue(m), ReceiptHandle: m.ReceiptHandle, VisibilityTimeout: &seconds})
+	if err != nil {
+		return ErrUnableToExtend.Context(err)
+	}
+	m.setVisibleAt(requested.Add(time.Duration(seconds) * time.Second))
+
+	return nil
+}
@@ -1,15 +1,27 @@
 package gosqs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 type testStruct struct {
@@ -61,7 +73,10 @@ func getConsumer(t *testing.T) *consumer {
 		env:               conf.Env,
 		VisibilityTimeout: 30,
 		extensionLimit:    2,
+		visibilityBuffer:  defaultVisibilityBuffer,
+		maxMessages:       maxMessages,
 		workerPool:        15,
+		queueNameFunc:     defaultQueueName,
 	}
 
 	cons.sqs.PurgeQueue(&sqs.PurgeQueueInput{QueueUrl: &conf.QueueURL})
@@ -70,6 +85,64 @@ func getConsumer(t *testing.T) *consumer {
 	return cons
 }
 
+// operations records the names of the sqs operations that were requested
+type operations struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (o *operations) add(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.names = append(o.names, name)
+}
+
+// count returns the total amount of times the operation was requested
+func (o *operations) count(name string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var n int
+	for _, op := range o.names {
+		if op == name {
+			n++
+		}
+	}
+	return n
+}
+
+// getStubConsumer creates a consumer whose requests never leave the process. Every request is recorded and passed
+// to respond which can populate r.Data or r.Error to emulate sqs
+func getStubConsumer(t *testing.T, respond func(r *request.Request)) (*consumer, *operations) {
+	ops := &operations{}
+
+	svc := sqs.New(stubSession)
+	stubClient(&svc.Handlers, ops, respond)
+
+	cons := &consumer{
+		sqs:               svc,
+		env:               "dev",
+		QueueURL:          "http://local.goaws:4100/queue/dev-post-worker",
+		VisibilityTimeout: 30,
+		extensionLimit:    2,
+		visibilityBuffer:  defaultVisibilityBuffer,
+		maxMessages:       maxMessages,
+		workerPool:        1,
+		queueNameFunc:     defaultQueueName,
+	}
+
+	return cons, ops
+}
+
+// newStubMessage creates a message with the provided route and body as if it was received from sqs
+func newStubMessage(route, body string) *message {
+	return newMessage(&sqs.Message{
+		Body:              &body,
+		ReceiptHandle:     aws.String("receipt-handle"),
+		MessageAttributes: defaultSQSAttributes(route),
+	})
+}
+
 func TestNewConsumer(t *testing.T) {
 	conf := Config{
 		Region:   "us-west2",
@@ -196,7 +269,7 @@ func TestRun(t *testing.T) {
 	t.Run("no_error", func(t *testing.T) {
 		c.Message(context.TODO(), "post-worker", "post_published", testStruct{"val"})
 		m := retrieveMessage(t, c)
-		if err := c.run(m.(*message)); err != nil {
+		if err := c.run(context.Background(), m.(*message)); err != nil {
 			t.Errorf("should not return an error, got %v", err)
 		}
 	})
@@ -204,7 +277,7 @@ func TestRun(t *testing.T) {
 	t.Run("error", func(t *testing.T) {
 		c.Message(context.TODO(), "post-worker", "post_event", testStruct{"val"})
 		m := retrieveMessage(t, c)
-		if err := c.run(m.(*message)); err != ErrGetMessage {
+		if err := c.run(context.Background(), m.(*message)); err != ErrGetMessage {
 			t.Errorf("unexpected result, expected %v, got %v", ErrGetMessage, err)
 		}
 	})
@@ -212,7 +285,7 @@ func TestRun(t *testing.T) {
 	t.Run("no_event", func(t *testing.T) {
 		c.Message(context.TODO(), "post-worker", "no_event", testStruct{"val"})
 		m := retrieveMessage(t, c)
-		if err := c.run(m.(*message)); err != nil {
+		if err := c.run(context.Background(), m.(*message)); err != nil {
 			t.Errorf("unexpected result, expected %v, got %v", nil, err)
 		}
 	})
@@ -221,9 +294,1538 @@ func TestRun(t *testing.T) {
 		c.VisibilityTimeout = 11
 		c.Message(context.TODO(), "post-worker", "extend", testStruct{"val"})
 		m := retrieveMessage(t, c)
-		if err := c.run(m.(*message)); err != nil {
+		if err := c.run(context.Background(), m.(*message)); err != nil {
 			t.Errorf("unexpected result, expected %v, got %v", nil, err)
 		}
 	})
 
 }
+
+func TestQueueNameFunc(t *testing.T) {
+	queueName := func(env, name string) string {
+		return fmt.Sprintf("%s_%s_queue", name, env)
+	}
+
+	names := make(chan string, 1)
+	respond := func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueUrlInput:
+			names <- *in.QueueName
+			r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/" + *in.QueueName)
+		case *sqs.SendMessageInput:
+			names <- *in.QueueUrl
+		}
+	}
+
+	t.Run("new_consumer", func(t *testing.T) {
+		conf := Config{Env: "dev", QueueNameFunc: queueName, SessionProvider: func(c Config) (*session.Session, error) {
+			// the sqs client adds its own unmarshal handlers, they are cleared for each request instead
+			sess := stubSession.Copy()
+			stubClient(&sess.Handlers, &operations{}, func(r *request.Request) {
+				stubClient(&r.Handlers, &operations{}, nil)
+				respond(r)
+			})
+			return sess, nil
+		}}
+
+		if _, err := NewConsumer(conf, "post-worker"); err != nil {
+			t.Fatalf("error creating consumer, got %v", err)
+		}
+
+		if name := <-names; name != "post-worker_dev_queue" {
+			t.Errorf("unexpected queue name, got %s", name)
+		}
+	})
+
+	t.Run("consumer_message", func(t *testing.T) {
+		c, _ := getStubConsumer(t, respond)
+		c.queueNameFunc = queueName
+
+		c.Message(context.TODO(), "user-worker", "user_created", &sample{})
+		if name := <-names; name != "user-worker_dev_queue" {
+			t.Errorf("unexpected queue name, got %s", name)
+		}
+		<-names
+	})
+
+	t.Run("publisher_message", func(t *testing.T) {
+		p, _ := getStubPublisher(t, respond)
+		p.queueNameFunc = queueName
+
+		p.Message("user-worker", "user_created", &sample{})
+		if u := <-names; u != "http://local.goaws:4100/queue/user-worker_dev_queue" {
+			t.Errorf("unexpected queue url, got %s", u)
+		}
+	})
+}
+
+func TestMessageAttributes(t *testing.T) {
+	sent := make(chan *sqs.SendMessageInput, 1)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueUrlInput:
+			r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/" + *in.QueueName)
+		case *sqs.SendMessageInput:
+			sent <- in
+		}
+	})
+	c.attributes = []customAttribute{{"tenant", "String", "acme"}, {"correlationId", "String", "default"}}
+
+	correlation, err := NewAttribute(DataTypeString, "correlationId", "abc-123")
+	if err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	hop, _ := NewAttribute(DataTypeNumber, "hop", 2)
+
+	expected := map[string]string{"route": "post_published", "tenant": "acme", "correlationId": "abc-123", "hop": "2"}
+	assertAttributes := func(t *testing.T, in *sqs.SendMessageInput) {
+		got := map[string]string{}
+		for k, v := range in.MessageAttributes {
+			got[k] = *v.StringValue
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("unexpected attributes, expected %v, got %v", expected, got)
+		}
+	}
+
+	t.Run("message", func(t *testing.T) {
+		c.Message(context.TODO(), "post-worker", "post_published", testStruct{"val"}, correlation, hop)
+		assertAttributes(t, <-sent)
+	})
+
+	t.Run("message_self", func(t *testing.T) {
+		c.MessageSelf(context.TODO(), "post_published", testStruct{"val"}, correlation, hop)
+		assertAttributes(t, <-sent)
+	})
+
+	if len(c.attributes) != 2 || c.attributes[1].Value != "default" {
+		t.Errorf("expected the configured attributes to be unchanged, got %v", c.attributes)
+	}
+
+	if _, err := NewAttribute(DataTypeNumber, "hop", "2"); err != ErrMarshal {
+		t.Errorf("expected %v for a mismatched value, got %v", ErrMarshal, err)
+	}
+}
+
+func TestIsFIFO(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	if c.IsFIFO() {
+		t.Errorf("expected a standard queue")
+	}
+
+	c, _ = getStubConsumer(t, nil)
+	c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker.fifo"
+	if !c.IsFIFO() {
+		t.Errorf("expected a FIFO queue")
+	}
+
+	c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker"
+	if !c.IsFIFO() {
+		t.Errorf("expected the result to be cached")
+	}
+}
+
+func TestConsumerEffectiveConfig(t *testing.T) {
+	c := newConsumer(Config{Key: "key", Secret: "secret", VisibilityTimeout: 60}, nil)
+	c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker"
+	c.SetWorkerPool(5)
+
+	cfg := c.EffectiveConfig()
+	if cfg.VisibilityTimeout != 60 || cfg.WorkerPool != 5 || *cfg.ExtensionLimit != 2 {
+		t.Errorf("unexpected settings, got visibility timeout %d, worker pool %d, extension limit %d", cfg.VisibilityTimeout, cfg.WorkerPool, *cfg.ExtensionLimit)
+	}
+
+	if cfg.QueueURL != c.QueueURL || cfg.ShutdownGracePeriod != defaultGracePeriod || cfg.RetryDelay != defaultRetryDelay || cfg.QueueNameFunc == nil {
+		t.Errorf("expected the resolved settings, got %+v", cfg)
+	}
+
+	if cfg.Key != "" || cfg.Secret != "" {
+		t.Errorf("expected the credentials to be omitted, got %s %s", cfg.Key, cfg.Secret)
+	}
+}
+
+func TestConsumerConfig(t *testing.T) {
+	c := newConsumer(Config{MaxInFlight: 20}, nil)
+	c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker"
+	c.SetExtensionLimit(4)
+
+	expected := ConsumerInfo{
+		QueueURL:          "http://local.goaws:4100/queue/dev-post-worker",
+		VisibilityTimeout: 30,
+		ExtensionLimit:    4,
+		WorkerPool:        30,
+		MaxInFlight:       20,
+	}
+
+	if info := c.Config(); info != expected {
+		t.Errorf("unexpected settings, expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestRunRecoveredPanic(t *testing.T) {
+	var recovered interface{}
+	panicking := func(ctx context.Context, m Message) error {
+		panic("boom")
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.RegisterHandlerWithOptions("post_published", panicking, HandlerOptions{WithoutExtension: true}, WithRecovery(func() { recovered = recover() }))
+
+		err := c.run(context.Background(), newStubMessage("post_published", `{"val":"val"}`))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrPanic.Err {
+			t.Fatalf("expected %v, got %v", ErrPanic, err)
+		}
+
+		if recovered != "boom" {
+			t.Errorf("expected the recovery to receive the panic, got %v", recovered)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the message not to be deleted, got %d deletes", n)
+		}
+	})
+
+	t.Run("panic_as_success", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.panicAsSuccess = true
+		c.RegisterHandlerWithOptions("post_published", panicking, HandlerOptions{WithoutExtension: true}, WithRecovery(func() { recover() }))
+
+		if err := c.run(context.Background(), newStubMessage("post_published", `{"val":"val"}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the message to be deleted, got %d deletes", n)
+		}
+	})
+}
+
+func TestRunWithoutExtension(t *testing.T) {
+	c, ops := getStubConsumer(t, nil)
+	c.VisibilityTimeout = 11
+	c.RegisterHandlerWithOptions("extend", extend, HandlerOptions{WithoutExtension: true})
+
+	if c.handlers["extend"].extend {
+		t.Fatalf("did not disable the extension for the route")
+	}
+
+	if err := c.run(context.Background(), newStubMessage("extend", `{"val":"val"}`)); err != nil {
+		t.Fatalf("unexpected result, expected %v, got %v", nil, err)
+	}
+
+	if n := ops.count("ChangeMessageVisibility"); n != 0 {
+		t.Errorf("expected no visibility extensions, got %d", n)
+	}
+
+	if n := ops.count("DeleteMessage"); n != 1 {
+		t.Errorf("expected the message to be deleted, got %d deletes", n)
+	}
+}
+
+func TestRunLateCompletion(t *testing.T) {
+	c, ops := getStubConsumer(t, nil)
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	t.Run("lapsed", func(t *testing.T) {
+		m := newStubMessage("post_published", `{"val":"val"}`)
+		m.setVisibleAt(time.Now().Add(-time.Second))
+
+		err := c.run(context.Background(), m)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrLateCompletion.Err {
+			t.Fatalf("expected %v, got %v", ErrLateCompletion, err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the delete to be skipped, got %d deletes", n)
+		}
+	})
+
+	t.Run("in_time", func(t *testing.T) {
+		m := newStubMessage("post_published", `{"val":"val"}`)
+		m.setVisibleAt(time.Now().Add(time.Minute))
+
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the message to be deleted, got %d deletes", n)
+		}
+	})
+}
+
+func TestRunCommit(t *testing.T) {
+	commit := func(ctx context.Context, m Message) error {
+		if err := m.Commit(ctx); err != nil {
+			return err
+		}
+		// committing twice is a no-op
+		return m.Commit(ctx)
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.RegisterHandlerWithOptions("post_published", commit, HandlerOptions{WithoutExtension: true})
+
+		if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected a single delete, got %d", n)
+		}
+	})
+
+	t.Run("commit_failure", func(t *testing.T) {
+		c, ops := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name == "DeleteMessage" {
+				r.Error = awserr.New("InternalError", "unavailable", nil)
+			}
+		})
+		c.RegisterHandlerWithOptions("post_published", commit, HandlerOptions{WithoutExtension: true})
+
+		err := c.run(context.Background(), newStubMessage("post_published", `{}`))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrUnableToDelete.Err {
+			t.Fatalf("expected the handler to observe %v, got %v", ErrUnableToDelete, err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected a single delete, got %d", n)
+		}
+	})
+
+	t.Run("required", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.requireCommit = true
+		c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+		err := c.run(context.Background(), newStubMessage("post_published", `{"val":"val"}`))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrNotCommitted.Err {
+			t.Fatalf("expected %v, got %v", ErrNotCommitted, err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the delete to be skipped, got %d deletes", n)
+		}
+	})
+}
+
+func TestProcessLogBodyOnError(t *testing.T) {
+	getConsumer := func(t *testing.T) (*consumer, *recordLogger) {
+		c, _ := getStubConsumer(t, nil)
+		logger := &recordLogger{}
+		c.logger = logger
+		c.RegisterHandlerWithOptions("post_published", err, HandlerOptions{WithoutExtension: true})
+		return c, logger
+	}
+
+	t.Run("off", func(t *testing.T) {
+		c, logger := getConsumer(t)
+		atomic.AddInt64(&c.inFlight, 1)
+		c.process(context.Background(), newStubMessage("post_published", `{"email":"jane@example.com"}`))
+
+		if len(logger.lines) != 1 || strings.Contains(logger.lines[0], "jane@example.com") {
+			t.Errorf("expected the body not to be logged, got %v", logger.lines)
+		}
+	})
+
+	t.Run("redacted", func(t *testing.T) {
+		c, logger := getConsumer(t)
+		c.logBodyOnError = true
+		c.redact = func(body []byte) []byte {
+			return bytes.ReplaceAll(body, []byte("jane@example.com"), []byte("[redacted]"))
+		}
+		atomic.AddInt64(&c.inFlight, 1)
+		c.process(context.Background(), newStubMessage("post_published", `{"email":"jane@example.com"}`))
+
+		if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], `{"email":"[redacted]"}`) {
+			t.Errorf("expected the redacted body to be logged, got %v", logger.lines)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		c, _ := getConsumer(t)
+		m := newStubMessage("post_published", `"`+strings.Repeat("a", 2*maxLoggedBody)+`"`)
+
+		if body := c.loggedBody(m); len(body) != maxLoggedBody+3 || !bytes.HasSuffix(body, []byte("...")) {
+			t.Errorf("expected the body to be truncated, got %d bytes", len(body))
+		}
+	})
+}
+
+func TestRunUnhandled(t *testing.T) {
+	t.Run("left_in_queue", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+		if err := c.run(context.Background(), newStubMessage("post_deleted", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage") + ops.count("ChangeMessageVisibility"); n != 0 {
+			t.Errorf("expected the message to be left untouched, got %d operations", n)
+		}
+	})
+
+	t.Run("delete_on_no_handler", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.deleteOnNoHandler = true
+		c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+		if err := c.run(context.Background(), newStubMessage("post_deleted", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the message to be deleted, got %d deletes", n)
+		}
+	})
+}
+
+func TestRunOnError(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+
+	var routes []string
+	var errs []error
+	c.onError = func(ctx context.Context, m Message, err error) {
+		routes = append(routes, m.Route())
+		errs = append(errs, err)
+	}
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+	c.RegisterHandlerWithOptions("post_failed", err, HandlerOptions{WithoutExtension: true})
+
+	c.run(context.Background(), newStubMessage("post_published", `{}`))
+	c.run(context.Background(), newStubMessage("post_failed", `{}`))
+
+	if len(routes) != 1 || routes[0] != "post_failed" {
+		t.Fatalf("expected the callback to run for the failed message only, got %v", routes)
+	}
+
+	if errs[0] != ErrGetMessage {
+		t.Errorf("expected the original error, got %v", errs[0])
+	}
+}
+
+func TestRunTerminal(t *testing.T) {
+	malformed := errors.New("malformed payload")
+	getConsumer := func(t *testing.T, handlerErr error) (*consumer, *operations) {
+		c, ops := getStubConsumer(t, nil)
+		c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+			return handlerErr
+		}, HandlerOptions{WithoutExtension: true})
+		return c, ops
+	}
+
+	t.Run("deleted", func(t *testing.T) {
+		c, ops := getConsumer(t, fmt.Errorf("decoding: %w", Terminal(malformed)))
+
+		err := c.run(context.Background(), newStubMessage("post_published", `{}`))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrTerminal.Err || !strings.Contains(err.Error(), "malformed payload") {
+			t.Errorf("expected %v, got %v", ErrTerminal, err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the message to be deleted, got %d deletes", n)
+		}
+	})
+
+	t.Run("dead_lettered", func(t *testing.T) {
+		c, ops := getConsumer(t, Terminal(malformed))
+		c.dlqURL = "http://local.goaws:4100/queue/dev-post-worker-dlq"
+
+		c.run(context.Background(), newStubMessage("post_published", `{}`))
+		if ops.count("SendMessage") != 1 || ops.count("DeleteMessage") != 1 {
+			t.Errorf("expected the message to be moved to the dlq, got %v", ops.names)
+		}
+	})
+
+	t.Run("retryable", func(t *testing.T) {
+		c, ops := getConsumer(t, malformed)
+
+		if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != malformed {
+			t.Errorf("expected the handler error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the message to be left for redelivery, got %d deletes", n)
+		}
+	})
+
+	if !errors.Is(Terminal(malformed), malformed) || IsTerminal(malformed) || Terminal(nil) != nil {
+		t.Error("expected Terminal to wrap the error")
+	}
+}
+
+func TestRunAck(t *testing.T) {
+	var visibility []int64
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sqs.ChangeMessageVisibilityInput); ok {
+			visibility = append(visibility, *in.VisibilityTimeout)
+		}
+	})
+
+	acked := make(chan error, 1)
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		go func() {
+			acked <- m.Ack(context.Background())
+		}()
+		return nil
+	}, HandlerOptions{WithoutExtension: true, ManualAck: true})
+	c.RegisterHandlerWithOptions("post_rejected", func(ctx context.Context, m Message) error {
+		return m.Nack(ctx)
+	}, HandlerOptions{WithoutExtension: true})
+
+	t.Run("ack", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if err := <-acked; err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the message to be deleted once it is acked, got %d deletes", n)
+		}
+	})
+
+	t.Run("nack", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_rejected", `{}`)); err != nil {
+			t.Fatalf("expected a nacked message not to fail, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the nacked message not to be deleted, got %d deletes", n)
+		}
+
+		if expected := []int64{0}; !reflect.DeepEqual(visibility, expected) {
+			t.Errorf("expected the message to be released, got %v", visibility)
+		}
+	})
+}
+
+func TestRunDefer(t *testing.T) {
+	var visibility []int64
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sqs.ChangeMessageVisibilityInput); ok {
+			visibility = append(visibility, *in.VisibilityTimeout)
+		}
+	})
+	c.RegisterHandler("post_published", func(ctx context.Context, m Message) error {
+		return m.Defer(1500 * time.Millisecond)
+	})
+	c.RegisterHandler("post_throttled", func(ctx context.Context, m Message) error {
+		if err := m.Defer(time.Minute); err != nil {
+			return err
+		}
+		return ErrGetMessage
+	})
+
+	if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if err := c.run(context.Background(), newStubMessage("post_throttled", `{}`)); err != nil {
+		t.Fatalf("expected a deferred message not to fail, got %v", err)
+	}
+
+	if n := ops.count("DeleteMessage"); n != 0 {
+		t.Errorf("expected deferred messages not to be deleted, got %d deletes", n)
+	}
+
+	if expected := []int64{2, 60}; !reflect.DeepEqual(visibility, expected) {
+		t.Errorf("expected the visibility to be set to %v, got %v", expected, visibility)
+	}
+
+	if err := newStubMessage("post_published", `{}`).Defer(time.Second); err == nil {
+		t.Errorf("expected an error for a message that is not being consumed")
+	}
+}
+
+func TestRunExtend(t *testing.T) {
+	var visibility []int64
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sqs.ChangeMessageVisibilityInput); ok {
+			visibility = append(visibility, *in.VisibilityTimeout)
+		}
+	})
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		return m.Extend(ctx, 120)
+	}, HandlerOptions{WithoutExtension: true})
+
+	m := newStubMessage("post_published", `{}`)
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if expected := []int64{120}; !reflect.DeepEqual(visibility, expected) {
+		t.Errorf("expected the visibility to be set to %v, got %v", expected, visibility)
+	}
+
+	if until := time.Until(time.Unix(0, atomic.LoadInt64(&m.visibleAt))); until < 110*time.Second {
+		t.Errorf("expected the visibility deadline to be moved, got %v", until)
+	}
+
+	if n := ops.count("DeleteMessage"); n != 1 {
+		t.Errorf("expected the message to be deleted, got %d deletes", n)
+	}
+
+	if err := newStubMessage("post_published", `{}`).Extend(context.Background(), 60); err == nil {
+		t.Errorf("expected an error for a message that is not being consumed")
+	}
+}
+
+func TestRunIgnoreUnhandled(t *testing.T) {
+	c, ops := getStubConsumer(t, nil)
+	c.ignoreUnhandled = true
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	t.Run("released", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_deleted", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the message to remain in the queue, got %d deletes", n)
+		}
+
+		if n := ops.count("ChangeMessageVisibility"); n != 1 {
+			t.Errorf("expected the message to be released, got %d visibility changes", n)
+		}
+	})
+
+	t.Run("receive_limit", func(t *testing.T) {
+		m := newStubMessage("post_deleted", `{}`)
+		m.Attributes = map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(strconv.Itoa(maxUnhandledReceives)),
+		}
+
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the message to be deleted, got %d deletes", n)
+		}
+	})
+
+	t.Run("handled", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_published", `{"val":"val"}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 2 {
+			t.Errorf("expected the handled message to be deleted, got %d deletes", n)
+		}
+	})
+}
+
+func TestConsumeMaxInFlight(t *testing.T) {
+	var mu sync.Mutex
+	var receives, served int
+	block := make(chan struct{})
+
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		in := r.Params.(*sqs.ReceiveMessageInput)
+
+		mu.Lock()
+		receives++
+		// the consumer may resume before every in-flight message was consumed, the batch size is limited accordingly
+		n := *in.MaxNumberOfMessages
+		if remaining := int64(6 - served); n > remaining {
+			n = remaining
+		}
+		served += int(n)
+		mu.Unlock()
+
+		// only serve six messages, then hang like a long poll on an empty queue
+		if n == 0 {
+			<-block
+		}
+
+		out := r.Data.(*sqs.ReceiveMessageOutput)
+		for i := int64(0); i < n; i++ {
+			out.Messages = append(out.Messages, newStubMessage("post_published", `{"val":"val"}`).Message)
+		}
+	})
+	c.maxInFlight = 3
+	c.workerPool = 5
+
+	release := make(chan struct{})
+	var active, peak, handled int32
+	c.RegisterHandler("post_published", func(ctx context.Context, m Message) error {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		active--
+		handled++
+		mu.Unlock()
+		return nil
+	})
+
+	go c.Consume()
+
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	if receives != 1 {
+		t.Errorf("expected the consumer to stop receiving at the limit, got %d receives", receives)
+	}
+	if peak != 3 {
+		t.Errorf("expected 3 messages in flight, got %d", peak)
+	}
+	mu.Unlock()
+
+	close(release)
+	// the in-flight limit is polled, allow for slow schedulers instead of relying on a fixed sleep
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := handled
+		mu.Unlock()
+		if n >= 6 {
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if handled != 6 {
+		t.Errorf("expected the consumer to resume once in-flight messages were consumed, handled %d", handled)
+	}
+	if peak > 3 {
+		t.Errorf("exceeded the in-flight limit, got %d", peak)
+	}
+}
+
+func TestRenewAfter(t *testing.T) {
+	cases := []struct {
+		name              string
+		buffer            int
+		visibilityTimeout int
+		expected          time.Duration
+	}{
+		{"default", 0, 30, 20 * time.Second},
+		{"configured", 3, 12, 9 * time.Second},
+		{"short_timeout", 0, 8, 4 * time.Second},
+		{"no_timeout", 0, 0, time.Second},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConsumer(Config{VisibilityBuffer: tc.buffer}, nil)
+			if got := c.renewAfter(tc.visibilityTimeout); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExtendReturnsOnCompletion(t *testing.T) {
+	c, ops := getStubConsumer(t, nil)
+	m := newStubMessage("post_published", `{}`)
+
+	done := make(chan struct{})
+	go func() {
+		c.extend(context.Background(), m, nil, func() {})
+		close(done)
+	}()
+
+	m.Success(context.Background())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected extend to return once the handler finished instead of waiting for the renewal")
+	}
+
+	if n := ops.count("ChangeMessageVisibility"); n != 0 {
+		t.Errorf("expected no visibility changes, got %d", n)
+	}
+}
+
+func TestRunCancelledAtExtensionLimit(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	c.extensionLimit = 0
+
+	var cancelled error
+	c.RegisterHandler("post_published", func(ctx context.Context, m Message) error {
+		select {
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+
+	m := newStubMessage("post_published", `{}`)
+	m.setVisibleAt(time.Now().Add(50 * time.Millisecond))
+	c.run(context.Background(), m)
+
+	if cancelled != context.Canceled {
+		t.Errorf("expected the handler context to be cancelled once the visibility lapsed, got %v", cancelled)
+	}
+}
+
+func TestRunFastHandlerNotExtended(t *testing.T) {
+	c, ops := getStubConsumer(t, nil)
+	// renews after half a second
+	c.VisibilityTimeout = 1
+	c.RegisterHandler("post_published", test)
+
+	for i := 0; i < 20; i++ {
+		if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+	}
+	time.Sleep(700 * time.Millisecond)
+
+	if n := ops.count("ChangeMessageVisibility"); n != 0 {
+		t.Errorf("expected no visibility changes for fast handlers, got %d", n)
+	}
+
+	// a renewal that is due once the handler finished is not requested
+	m := newStubMessage("post_published", `{}`)
+	m.Success(context.Background())
+	if c.extendVisibility(context.Background(), m, 60) {
+		t.Errorf("expected no extension after Success")
+	}
+
+	if n := ops.count("ChangeMessageVisibility"); n != 0 {
+		t.Errorf("expected no visibility changes after Success, got %d", n)
+	}
+}
+
+func TestMaxMessages(t *testing.T) {
+	cases := []struct {
+		configured int
+		expected   int64
+	}{
+		{0, 10},
+		{4, 4},
+		{25, 10},
+		{-1, 1},
+	}
+
+	for _, tc := range cases {
+		c := newConsumer(Config{MaxMessages: tc.configured}, nil)
+		if got := c.capacity(); got != tc.expected {
+			t.Errorf("MaxMessages %d: expected %d messages per receive, got %d", tc.configured, tc.expected, got)
+		}
+	}
+
+	c := newConsumer(Config{MaxMessages: 4, MaxInFlight: 20}, nil)
+	if got := c.capacity(); got != 4 {
+		t.Errorf("expected MaxMessages to cap the in-flight capacity, got %d", got)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	c.workerPool = 15
+
+	if n := c.poolSize(); n != 15 {
+		t.Errorf("expected the static worker pool, got %d", n)
+	}
+
+	c.workerPoolFunc = func() int { return runtime.NumCPU() * 4 }
+	if n := c.poolSize(); n != runtime.NumCPU()*4 {
+		t.Errorf("expected %d workers, got %d", runtime.NumCPU()*4, n)
+	}
+
+	c.workerPoolFunc = func() int { return 0 }
+	if n := c.poolSize(); n != 15 {
+		t.Errorf("expected to fall back to the static worker pool, got %d", n)
+	}
+}
+
+func TestConsumeExitAfterIdleReceives(t *testing.T) {
+	var mu sync.Mutex
+	var receives int
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		mu.Lock()
+		receives++
+		n := receives
+		mu.Unlock()
+
+		// serve a single batch followed by an empty queue
+		if n == 1 {
+			out := r.Data.(*sqs.ReceiveMessageOutput)
+			out.Messages = []*sqs.Message{
+				newStubMessage("post_published", `{"val":"val"}`).Message,
+				newStubMessage("post_published", `{"val":"val"}`).Message,
+			}
+		}
+	})
+	c.exitAfterIdle = 3
+
+	var handled int32
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}, HandlerOptions{WithoutExtension: true})
+
+	done := make(chan struct{})
+	go func() {
+		c.Consume()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("consume did not exit after the queue went idle")
+	}
+
+	if n := ops.count("ReceiveMessage"); n != 4 {
+		t.Errorf("expected 4 receives, got %d", n)
+	}
+
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Errorf("expected the received messages to be processed before exiting, got %d", n)
+	}
+}
+
+func TestConsumeOnIdle(t *testing.T) {
+	var receives int
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		// the queue is empty twice, receives a message and is empty three more times
+		receives++
+		if receives == 3 {
+			r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{newStubMessage("post_published", `{"val":"val"}`).Message}
+		}
+	})
+	c.serial = true
+	c.exitAfterIdle = 3
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	var counts []int
+	c.onIdle = func(consecutiveEmpty int) {
+		counts = append(counts, consecutiveEmpty)
+	}
+
+	c.Consume()
+
+	if expected := []int{1, 2, 1, 2, 3}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("unexpected consecutive empty receives, expected %v, got %v", expected, counts)
+	}
+}
+
+func TestRunFatal(t *testing.T) {
+	t.Run("access_denied", func(t *testing.T) {
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name == "ReceiveMessage" {
+				r.Error = awserr.New("AccessDenied", "Access to the resource is denied", nil)
+				r.Retryable = aws.Bool(false)
+			}
+		})
+
+		err := c.Run(context.Background())
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrGetMessage.Err {
+			t.Fatalf("expected %v, got %v", ErrGetMessage, err)
+		}
+	})
+
+	t.Run("queue_gone", func(t *testing.T) {
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name == "ReceiveMessage" {
+				r.Error = awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist", nil)
+				r.Retryable = aws.Bool(false)
+			}
+		})
+
+		err := c.Run(context.Background())
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrQueueGone.Err {
+			t.Fatalf("expected %v, got %v", ErrQueueGone, err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name == "ReceiveMessage" {
+				r.Error = awserr.New("InternalError", "unavailable", nil)
+				r.Retryable = aws.Bool(false)
+			}
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := c.Run(ctx); err != nil {
+			t.Fatalf("expected a retried error to end cleanly once the context is done, got %v", err)
+		}
+	})
+}
+
+func TestConsumeQueueGone(t *testing.T) {
+	queueResolveInterval = time.Millisecond
+
+	t.Run("deleted", func(t *testing.T) {
+		c, ops := getStubConsumer(t, func(r *request.Request) {
+			r.Error = awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist", nil)
+		})
+		c.queueName = "dev-post-worker"
+
+		var gone string
+		c.onQueueGone = func(queueURL string) {
+			gone = queueURL
+		}
+
+		done := make(chan struct{})
+		go func() {
+			c.Consume()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("consume did not stop after the queue was deleted")
+		}
+
+		if gone != c.QueueURL {
+			t.Errorf("expected OnQueueGone to be called with %s, got %q", c.QueueURL, gone)
+		}
+
+		if n := ops.count("GetQueueUrl"); n != queueResolveAttempts {
+			t.Errorf("expected %d attempts to resolve the queue, got %d", queueResolveAttempts, n)
+		}
+	})
+
+	t.Run("recreated", func(t *testing.T) {
+		var once sync.Once
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			switch r.Operation.Name {
+			case "ReceiveMessage":
+				once.Do(func() {
+					r.Error = awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist", nil)
+				})
+			case "GetQueueUrl":
+				r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/dev-post-worker")
+			}
+		})
+		c.queueName = "dev-post-worker"
+		c.exitAfterIdle = 1
+		c.onQueueGone = func(queueURL string) {
+			t.Errorf("OnQueueGone should not be called for a recreated queue")
+		}
+
+		c.Consume()
+	})
+
+	t.Run("concurrent_readers", func(t *testing.T) {
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name == "GetQueueUrl" {
+				r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/dev-post-worker")
+			}
+		})
+		c.queueName = "dev-post-worker"
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				c.resolveQueue()
+			}
+		}()
+
+		// run with -race, reading the url while it is resolved must not race
+		for i := 0; i < 10; i++ {
+			c.Config()
+			c.EffectiveConfig()
+			c.sourceQueue(newStubMessage("post_published", `{}`))
+		}
+		wg.Wait()
+	})
+}
+
+// fakeSQS is an in-memory sqs client that records the requests it receives
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	mu      sync.Mutex
+	sent    []*sqs.SendMessageInput
+	deleted []string
+}
+
+func (f *fakeSQS) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, in)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessage(in *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, *in.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestNewConsumerWithClient(t *testing.T) {
+	if _, err := NewConsumerWithClient(&fakeSQS{}, "", Config{}); err != ErrQueueURL {
+		t.Fatalf("expected %v without a queue url, got %v", ErrQueueURL, err)
+	}
+
+	fake := &fakeSQS{}
+	queueURL := "http://local.goaws:4100/queue/dev-post-worker"
+	cons, err := NewConsumerWithClient(fake, queueURL, Config{WorkerPool: 5})
+	if err != nil {
+		t.Fatalf("error creating consumer, got %v", err)
+	}
+
+	c := cons.(*consumer)
+	if c.QueueURL != queueURL {
+		t.Errorf("unexpected queue url, expected %s, got %s", queueURL, c.QueueURL)
+	}
+
+	if c.workerPool != 5 || c.VisibilityTimeout != 30 || c.extensionLimit != 2 {
+		t.Errorf("did not apply the config and defaults, got %+v", c)
+	}
+
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+	if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if len(fake.deleted) != 1 || fake.deleted[0] != "receipt-handle" {
+		t.Errorf("expected the injected client to delete the message, got %v", fake.deleted)
+	}
+}
+
+func TestRunTranscode(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	c.transcoders = map[string]Transcoder{
+		"text/plain": func(body []byte) ([]byte, error) {
+			return json.Marshal(testStruct{string(body)})
+		},
+		"application/broken": func(body []byte) ([]byte, error) {
+			return nil, ErrMarshal
+		},
+	}
+
+	var got testStruct
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		got = testStruct{}
+		return m.Decode(&got)
+	}, HandlerOptions{WithoutExtension: true})
+
+	withContentType := func(body, contentType string) *message {
+		m := newStubMessage("post_published", body)
+		m.MessageAttributes[contentTypeAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: &contentType}
+		return m
+	}
+
+	t.Run("transcoded", func(t *testing.T) {
+		if err := c.run(context.Background(), withContentType("val", "text/plain")); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if got.Val != "val" {
+			t.Errorf("did not transcode the body, got %+v", got)
+		}
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		if err := c.run(context.Background(), withContentType(`{"val":"json"}`, "application/json")); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if got.Val != "json" {
+			t.Errorf("did not pass the body through, got %+v", got)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		err := c.run(context.Background(), withContentType("val", "application/broken"))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrTranscode.Err {
+			t.Fatalf("expected %v, got %v", ErrTranscode, err)
+		}
+	})
+}
+
+func TestRunBodyPreprocessor(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	c.preprocess = func(body []byte) ([]byte, error) {
+		var s string
+		if err := json.Unmarshal(body, &s); err != nil {
+			return body, nil
+		}
+		return []byte(s), nil
+	}
+
+	var got testStruct
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		got = testStruct{}
+		return m.Decode(&got)
+	}, HandlerOptions{WithoutExtension: true})
+
+	t.Run("double_encoded", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_published", `"{\"val\":\"val\"}"`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if got.Val != "val" {
+			t.Errorf("did not unwrap the double-encoded body, got %+v", got)
+		}
+	})
+
+	t.Run("plain", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_published", `{"val":"plain"}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if got.Val != "plain" {
+			t.Errorf("did not pass the body through, got %+v", got)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		c.preprocess = func(body []byte) ([]byte, error) { return nil, ErrMarshal }
+		err := c.run(context.Background(), newStubMessage("post_published", `{}`))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrPreprocess.Err {
+			t.Fatalf("expected %v, got %v", ErrPreprocess, err)
+		}
+	})
+}
+
+func TestQueueDepth(t *testing.T) {
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name == "GetQueueAttributes" {
+			r.Data.(*sqs.GetQueueAttributesOutput).Attributes = map[string]*string{
+				sqs.QueueAttributeNameApproximateNumberOfMessages:           aws.String("42"),
+				sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: aws.String("7"),
+			}
+		}
+	})
+
+	visible, notVisible, err := c.QueueDepth(context.Background())
+	if err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if visible != 42 || notVisible != 7 {
+		t.Errorf("unexpected depth, expected 42 and 7, got %d and %d", visible, notVisible)
+	}
+
+	t.Run("missing_attributes", func(t *testing.T) {
+		c, _ := getStubConsumer(t, nil)
+		if _, _, err := c.QueueDepth(context.Background()); err == nil {
+			t.Fatal("expected an error")
+		} else if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrQueueAttributes.Err {
+			t.Errorf("expected %v, got %v", ErrQueueAttributes, err)
+		}
+	})
+}
+
+func TestRunRedriveImminent(t *testing.T) {
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name == "GetQueueAttributes" {
+			r.Data.(*sqs.GetQueueAttributesOutput).Attributes = map[string]*string{
+				sqs.QueueAttributeNameRedrivePolicy: aws.String(`{"deadLetterTargetArn":"arn:aws:sqs:local:000000000000:dev-post-worker-dlq","maxReceiveCount":"4"}`),
+			}
+		}
+	})
+	c.loadRedrivePolicy()
+
+	if c.maxReceiveCount != 4 {
+		t.Fatalf("did not load the redrive policy, expected 4, got %d", c.maxReceiveCount)
+	}
+
+	c.VisibilityTimeout = 11
+	// a second extension would race the handler returning after 2s
+	c.extensionLimit = 1
+	c.RegisterHandler("extend", extend)
+
+	m := newStubMessage("extend", `{}`)
+	m.Attributes = map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3")}
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if n := ops.count("ChangeMessageVisibility"); n != 0 {
+		t.Errorf("expected no visibility extensions for a message about to be redriven, got %d", n)
+	}
+
+	m = newStubMessage("extend", `{}`)
+	m.Attributes = map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("1")}
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if n := ops.count("ChangeMessageVisibility"); n != 1 {
+		t.Errorf("expected the visibility to be extended for an early attempt, got %d", n)
+	}
+}
+
+func TestConsumeContext(t *testing.T) {
+	type dbKey struct{}
+
+	getConsumer := func(t *testing.T) (*consumer, *interface{}) {
+		var once sync.Once
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name != "ReceiveMessage" {
+				return
+			}
+
+			once.Do(func() {
+				r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{newStubMessage("post_published", `{}`).Message}
+			})
+		})
+		c.exitAfterIdle = 1
+
+		var got interface{}
+		c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+			got = ctx.Value(dbKey{})
+			return nil
+		}, HandlerOptions{WithoutExtension: true})
+
+		return c, &got
+	}
+
+	t.Run("base_context", func(t *testing.T) {
+		c, got := getConsumer(t)
+		c.baseCtx = context.WithValue(context.Background(), dbKey{}, "pool")
+
+		c.Consume()
+
+		if *got != "pool" {
+			t.Errorf("expected the handler to receive the base context value, got %v", *got)
+		}
+	})
+
+	t.Run("consume_with_context", func(t *testing.T) {
+		c, got := getConsumer(t)
+
+		c.ConsumeWithContext(context.WithValue(context.Background(), dbKey{}, "startup"))
+
+		if *got != "startup" {
+			t.Errorf("expected the handler to receive the consume context value, got %v", *got)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		c, ops, handled := getStubRunningConsumer(t, func(ctx context.Context, m Message) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			c.ConsumeWithContext(ctx)
+			close(done)
+		}()
+		<-handled
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected ConsumeWithContext to return once the context is cancelled")
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the abandoned message not to be deleted, got %d deletes", n)
+		}
+	})
+}
+
+func TestConsumeAdjustSettings(t *testing.T) {
+	var mu sync.Mutex
+	var receives int
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		mu.Lock()
+		receives++
+		n := receives
+		mu.Unlock()
+
+		// serve messages for a while so settings are adjusted during consumption, then go idle
+		if n <= 20 {
+			time.Sleep(5 * time.Millisecond)
+			r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{newStubMessage("post_published", `{}`).Message}
+		}
+	})
+	c.exitAfterIdle = 1
+	c.workerPool = 2
+	c.VisibilityTimeout = 11
+
+	var handled int32
+	c.RegisterHandler("post_published", func(ctx context.Context, m Message) error {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		c.Consume()
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.SetVisibilityTimeout(10 + i)
+			c.SetExtensionLimit(i % 3)
+			c.SetWorkerPool(i%4 + 1)
+		}(i)
+	}
+	wg.Wait()
+
+	c.SetWorkerPool(3)
+	c.mu.RLock()
+	if c.jobs != nil && len(c.workerStops) != 3 {
+		t.Errorf("expected 3 running workers, got %d", len(c.workerStops))
+	}
+	c.mu.RUnlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consume did not exit")
+	}
+
+	if n := atomic.LoadInt32(&handled); n != 20 {
+		t.Errorf("expected all messages to be handled, got %d", n)
+	}
+
+	if vt, _ := c.settings(); c.workerPool != 3 || vt < 11 {
+		t.Errorf("did not apply the adjusted settings, got workerPool %d visibilityTimeout %d", c.workerPool, vt)
+	}
+}
+
+func TestConsumeSerialMode(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, r.Operation.Name)
+
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		if n := *r.Params.(*sqs.ReceiveMessageInput).MaxNumberOfMessages; n != 1 {
+			t.Errorf("expected a single message to be requested, got %d", n)
+		}
+
+		// serve three messages, one per receive, then go idle
+		var receives int
+		for _, op := range order {
+			if op == "ReceiveMessage" {
+				receives++
+			}
+		}
+		if receives <= 3 {
+			r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{newStubMessage("post_published", `{}`).Message}
+		}
+	})
+	c.serial = true
+	c.exitAfterIdle = 1
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	c.Consume()
+
+	expected := []string{"GetQueueAttributes",
+		"ReceiveMessage", "DeleteMessage",
+		"ReceiveMessage", "DeleteMessage",
+		"ReceiveMessage", "DeleteMessage",
+		"ReceiveMessage",
+	}
+
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected every message to be processed before the next receive,\nexpected %v,\ngot: %v", expected, order)
+	}
+
+	if c.jobs != nil {
+		t.Errorf("did not expect workers to be started")
+	}
+}
+
+func TestConsumerSendDirectMessageRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"exhausted", awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil), 3},
+		{"oversize", awserr.New("InvalidParameterValue", "One or more parameters are invalid. Reason: Message must be shorter than 262144 bytes", nil), 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, ops := getStubConsumer(t, func(r *request.Request) {
+				r.Error = tc.err
+				r.Retryable = aws.Bool(false)
+			})
+			logger := &recordLogger{}
+			c.logger = logger
+			c.sendRetries = 2
+
+			input := &sqs.SendMessageInput{MessageBody: aws.String(`{}`), QueueUrl: &c.QueueURL}
+			c.sendDirectMessage(context.Background(), input, "post_published")
+
+			if n := ops.count("SendMessage"); n != tc.expected {
+				t.Errorf("unexpected attempts, expected %d, got %d", tc.expected, n)
+			}
+
+			// every retry is logged along with the dropped message
+			if len(logger.lines) != tc.expected {
+				t.Errorf("expected the retries and the dropped message to be logged, got %v", logger.lines)
+			}
+		})
+	}
+}
+
+func TestConsumerMessageLogger(t *testing.T) {
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if _, ok := r.Params.(*sqs.GetQueueUrlInput); ok {
+			r.Error = awserr.New(sqs.ErrCodeQueueDoesNotExist, "queue does not exist", nil)
+			r.Retryable = aws.Bool(false)
+		}
+	})
+	logger := &recordLogger{}
+	c.logger = logger
+
+	c.Message(context.Background(), "missing-worker", "post_published", testStruct{"val"})
+	c.MessageSelf(context.Background(), "post_published", make(chan int))
+
+	if len(logger.lines) != 2 {
+		t.Fatalf("expected both failures to be logged through the configured logger, got %v", logger.lines)
+	}
+
+	if !strings.Contains(logger.lines[0], "dev-missing-worker") {
+		t.Errorf("expected the queue to be logged, got %s", logger.lines[0])
+	}
+}
@@ -0,0 +1,170 @@
+package gosqs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DLQMetadata determines which failure metadata is attached as attributes to a dead-lettered message. Options can be
+// combined, e.g. gosqs.DLQRoute | gosqs.DLQReason
+type DLQMetadata int
+
+const (
+	// DLQRoute attaches the original route of the message as dlq_route
+	DLQRoute DLQMetadata = 1 << iota
+	// DLQReason attaches the error that caused the message to be dead-lettered as dlq_reason
+	DLQReason
+	// DLQAttempts attaches the amount of times the message was received as dlq_attempts
+	DLQAttempts
+	// DLQFirstFailure attaches the time the message was first received as dlq_first_failure in RFC3339 format
+	DLQFirstFailure
+	// DLQConsumer attaches the identity of the consumer that dead-lettered the message as dlq_consumer
+	DLQConsumer
+
+	// DLQAllMetadata attaches all of the available failure metadata
+	DLQAllMetadata = DLQRoute | DLQReason | DLQAttempts | DLQFirstFailure | DLQConsumer
+)
+
+// has determines whether the option is included
+func (d DLQMetadata) has(opt DLQMetadata) bool {
+	return d&opt != 0
+}
+
+// deadLetter sends the message to the DLQ along with the configured failure metadata and deletes it from its queue.
+// The original body is sent, including the SNS envelope, so the message can be redriven as it was received
+func (c *consumer) deadLetter(ctx context.Context, m *message, reason error) error {
+	if c.dlqURL == "" {
+		return ErrDeadLetter.Context(errors.New("no DLQUrl configured"))
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(c.dlqURL),
+		MessageBody:       m.Message.Body,
+		MessageAttributes: c.deadLetterAttributes(m, reason),
+	}
+	// a FIFO DLQ receives the messages of a route in a group, they are deduplicated by their id
+	if strings.HasSuffix(c.dlqURL, fifoSuffix) {
+		input.MessageGroupId = aws.String(m.Route())
+		input.MessageDeduplicationId = m.MessageId
+	}
+
+	if _, err := c.sqs.SendMessageWithContext(ctx, input); err != nil {
+		return ErrDeadLetter.Context(err)
+	}
+
+	return c.delete(m)
+}
+
+// deadLetterAttributes copies the attributes of the message and attaches the configured failure metadata
+//
+// Attributes that were unwrapped from an SNS envelope are not copied, they are still part of the body. If the
+// metadata would exceed the sqs limit of 10 attributes it is attached as a single dlq_metadata json attribute
+// instead, and it is dropped if not even that fits
+func (c *consumer) deadLetterAttributes(m *message, reason error) map[string]*sqs.MessageAttributeValue {
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(m.MessageAttributes)+5)
+	for k, v := range m.MessageAttributes {
+		if m.fromEnvelope(k, v) {
+			continue
+		}
+		attrs[k] = v
+	}
+
+	var metadata []customAttribute
+	st, nt := DataTypeString.String(), DataTypeNumber.String()
+	set := func(key, dataType, val string) {
+		metadata = append(metadata, customAttribute{key, dataType, val})
+	}
+
+	if c.dlqMetadata.has(DLQRoute) {
+		set("dlq_route", st, m.Route())
+	}
+
+	if c.dlqMetadata.has(DLQReason) && reason != nil {
+		set("dlq_reason", st, reason.Error())
+	}
+
+	if c.dlqMetadata.has(DLQAttempts) {
+		attempts := m.ReceiveCount()
+		if attempts == 0 {
+			attempts = 1
+		}
+		set("dlq_attempts", nt, strconv.Itoa(attempts))
+	}
+
+	if c.dlqMetadata.has(DLQFirstFailure) {
+		first := m.FirstReceiveTime()
+		if first.IsZero() {
+			first = time.Now()
+		}
+		set("dlq_first_failure", st, first.UTC().Format(time.RFC3339))
+	}
+
+	if c.dlqMetadata.has(DLQConsumer) {
+		set("dlq_consumer", st, c.identity())
+	}
+
+	switch {
+	case len(metadata) == 0:
+	case len(attrs)+len(metadata) <= maxAttributes:
+		for _, attr := range metadata {
+			attrs[attr.Title] = &sqs.MessageAttributeValue{DataType: aws.String(attr.DataType), StringValue: aws.String(attr.Value)}
+		}
+	case len(attrs) < maxAttributes:
+		combined := make(map[string]string, len(metadata))
+		for _, attr := range metadata {
+			combined[attr.Title] = attr.Value
+		}
+		b, _ := json.Marshal(combined)
+		attrs[dlqMetadataAttribute] = &sqs.MessageAttributeValue{DataType: aws.String(st), StringValue: aws.String(string(b))}
+	default:
+		c.Logger().Println(ErrTooManyAttributes.Context(fmt.Errorf("dropped the dlq metadata of message %s, it already has %d attributes", aws.StringValue(m.MessageId), len(attrs))).Error())
+	}
+
+	return attrs
+}
+
+// dlqMetadataAttribute holds the failure metadata as a json object when the message has too many attributes for them
+// to be attached individually
+const dlqMetadataAttribute = "dlq_metadata"
+
+// fromEnvelope determines whether the attribute was unwrapped from the SNS envelope of the message rather than set on
+// the sqs message
+func (m *message) fromEnvelope(key string, v *sqs.MessageAttributeValue) bool {
+	if m.envelope == nil {
+		return false
+	}
+
+	attr, ok := m.envelope.MessageAttributes[key]
+	if !ok || attr.Type != aws.StringValue(v.DataType) {
+		return false
+	}
+
+	if v.BinaryValue != nil {
+		return attr.Value == base64.StdEncoding.EncodeToString(v.BinaryValue)
+	}
+	return v.StringValue != nil && attr.Value == *v.StringValue
+}
+
+// identity returns the name the consumer identifies itself with in failure metadata
+func (c *consumer) identity() string {
+	if c.consumerID != "" {
+		return c.consumerID
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return c.queueURL()
+	}
+
+	return host
+}
@@ -0,0 +1,181 @@
+package gosqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestDeadLetterAttributes(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+	c.consumerID = "post-worker-1"
+
+	m := newStubMessage("post_created", `{}`)
+	m.MessageAttributes["correlationId"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("abc-123")}
+	m.Attributes = map[string]*string{
+		sqs.MessageSystemAttributeNameApproximateReceiveCount:          aws.String("4"),
+		sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: aws.String("1612984812465"),
+	}
+
+	t.Run("all", func(t *testing.T) {
+		c.dlqMetadata = DLQAllMetadata
+		attrs := c.deadLetterAttributes(m, errors.New("malformed payload"))
+
+		expected := map[string]string{
+			"route":             "post_created",
+			"correlationId":     "abc-123",
+			"dlq_route":         "post_created",
+			"dlq_reason":        "malformed payload",
+			"dlq_attempts":      "4",
+			"dlq_first_failure": time.Unix(1612984812, 0).UTC().Format(time.RFC3339),
+			"dlq_consumer":      "post-worker-1",
+		}
+
+		if len(attrs) != len(expected) {
+			t.Fatalf("expected %d attributes, got %d", len(expected), len(attrs))
+		}
+
+		for k, v := range expected {
+			if a, ok := attrs[k]; !ok || *a.StringValue != v {
+				t.Errorf("unexpected attribute %s, expected %s, got %+v", k, v, a)
+			}
+		}
+
+		if *attrs["dlq_attempts"].DataType != DataTypeNumber.String() {
+			t.Errorf("expected dlq_attempts to be a number, got %s", *attrs["dlq_attempts"].DataType)
+		}
+	})
+
+	t.Run("selected", func(t *testing.T) {
+		c.dlqMetadata = DLQRoute | DLQReason
+		attrs := c.deadLetterAttributes(m, errors.New("malformed payload"))
+
+		for _, k := range []string{"dlq_route", "dlq_reason"} {
+			if _, ok := attrs[k]; !ok {
+				t.Errorf("expected %s to be attached", k)
+			}
+		}
+
+		for _, k := range []string{"dlq_attempts", "dlq_first_failure", "dlq_consumer"} {
+			if _, ok := attrs[k]; ok {
+				t.Errorf("did not expect %s to be attached", k)
+			}
+		}
+	})
+
+	t.Run("too_many_attributes", func(t *testing.T) {
+		c.dlqMetadata = DLQAllMetadata
+		m := newStubMessage("post_created", `{}`)
+		for i := 0; i < 8; i++ {
+			m.MessageAttributes[fmt.Sprintf("attr%d", i)] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("val")}
+		}
+
+		attrs := c.deadLetterAttributes(m, errors.New("malformed payload"))
+		if len(attrs) != maxAttributes {
+			t.Fatalf("expected the attributes to fit the limit of %d, got %d", maxAttributes, len(attrs))
+		}
+
+		var metadata map[string]string
+		if err := json.Unmarshal([]byte(aws.StringValue(attrs[dlqMetadataAttribute].StringValue)), &metadata); err != nil {
+			t.Fatalf("expected the metadata as json, got %v", err)
+		}
+
+		if metadata["dlq_route"] != "post_created" || metadata["dlq_reason"] != "malformed payload" || len(metadata) != 5 {
+			t.Errorf("unexpected metadata, got %v", metadata)
+		}
+
+		t.Run("full", func(t *testing.T) {
+			logger := &recordLogger{}
+			c.logger = logger
+			defer func() { c.logger = nil }()
+
+			m.MessageAttributes["attr8"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("val")}
+			attrs := c.deadLetterAttributes(m, errors.New("malformed payload"))
+			if len(attrs) != maxAttributes {
+				t.Errorf("expected only the original attributes, got %d", len(attrs))
+			}
+
+			if len(logger.lines) != 1 {
+				t.Errorf("expected the dropped metadata to be logged, got %v", logger.lines)
+			}
+		})
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		c.dlqMetadata = DLQRoute
+		m := newMessage(&sqs.Message{Body: aws.String(snsNotification)})
+
+		attrs := c.deadLetterAttributes(m, nil)
+		if len(attrs) != 1 || attrs["dlq_route"] == nil {
+			t.Errorf("expected the attributes of the envelope to be left in the body, got %+v", attrs)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		c.dlqMetadata = 0
+		if attrs := c.deadLetterAttributes(m, nil); len(attrs) != 2 {
+			t.Errorf("expected only the original attributes, got %+v", attrs)
+		}
+	})
+}
+
+func TestRunDeadLetter(t *testing.T) {
+	dlqURL := "http://local.goaws:4100/queue/dev-post-worker-dlq"
+	getConsumer := func(t *testing.T) (*consumer, *operations, chan *sqs.SendMessageInput) {
+		sent := make(chan *sqs.SendMessageInput, 1)
+		c, ops := getStubConsumer(t, func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+				sent <- in
+			}
+		})
+		c.dlqMetadata = DLQRoute
+
+		c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+			return m.DeadLetter(ctx)
+		}, HandlerOptions{WithoutExtension: true})
+
+		return c, ops, sent
+	}
+
+	t.Run("moved", func(t *testing.T) {
+		c, ops, sent := getConsumer(t)
+		c.dlqURL = dlqURL
+
+		if err := c.run(context.Background(), newStubMessage("post_published", `{"val":"malformed"`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		in := <-sent
+		if *in.QueueUrl != dlqURL || *in.MessageBody != `{"val":"malformed"` {
+			t.Errorf("expected the original body to be sent to the dlq, got %s %s", *in.QueueUrl, *in.MessageBody)
+		}
+
+		if _, ok := in.MessageAttributes["dlq_route"]; !ok {
+			t.Errorf("expected the failure metadata to be attached, got %v", in.MessageAttributes)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the original to be deleted once, got %d deletes", n)
+		}
+	})
+
+	t.Run("no_dlq", func(t *testing.T) {
+		c, ops, _ := getConsumer(t)
+
+		err := c.run(context.Background(), newStubMessage("post_published", `{}`))
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrDeadLetter.Err {
+			t.Errorf("expected %v, got %v", ErrDeadLetter, err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 0 {
+			t.Errorf("expected the message to be left in the queue, got %d deletes", n)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package gosqs
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxDelaySeconds is the longest delay sqs allows for a message, 15 minutes
+const maxDelaySeconds = 900
+
+const delayKey = contextKey("delay")
+
+// WithDelay adds a delivery delay to the context. Messages sent by Consumer.Message and Consumer.MessageSelf with this
+// context only become visible in the receiving queue once the delay passed, e.g. to retry with a backoff or to send
+// short reminders. It is rounded up to whole seconds and capped at the 15 minutes sqs allows
+func WithDelay(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, delayKey, d)
+}
+
+// Delay retrieves the delivery delay from the context
+func Delay(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(delayKey).(time.Duration)
+	return d
+}
+
+// delaySeconds converts the delay to the seconds sqs accepts, 0 means no delay
+func delaySeconds(d time.Duration) int64 {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds > maxDelaySeconds {
+		seconds = maxDelaySeconds
+	}
+
+	return seconds
+}
+
+// applyDelay sets the delay on input. FIFO queues reject a delay per message, it is ignored for them and the delay
+// of the queue applies instead
+func applyDelay(input *sqs.SendMessageInput, d time.Duration) {
+	if input.QueueUrl != nil && strings.HasSuffix(*input.QueueUrl, fifoSuffix) {
+		return
+	}
+
+	if seconds := delaySeconds(d); seconds > 0 {
+		input.DelaySeconds = &seconds
+	}
+}
@@ -0,0 +1,82 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestMessageDelay(t *testing.T) {
+	sent := make(chan *sqs.SendMessageInput, 1)
+	respond := func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueUrlInput:
+			r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/" + *in.QueueName)
+		case *sqs.SendMessageInput:
+			sent <- in
+		}
+	}
+	c, _ := getStubConsumer(t, respond)
+	ctx := WithDelay(context.Background(), 90*time.Second)
+
+	t.Run("message_self", func(t *testing.T) {
+		c.MessageSelf(ctx, "post_published", testStruct{"val"})
+
+		if in := <-sent; aws.Int64Value(in.DelaySeconds) != 90 {
+			t.Errorf("expected a delay of 90s, got %v", in.DelaySeconds)
+		}
+	})
+
+	t.Run("message", func(t *testing.T) {
+		c.Message(ctx, "post-worker", "post_published", testStruct{"val"})
+
+		if in := <-sent; aws.Int64Value(in.DelaySeconds) != 90 {
+			t.Errorf("expected a delay of 90s, got %v", in.DelaySeconds)
+		}
+	})
+
+	t.Run("message_fifo", func(t *testing.T) {
+		c.Message(ctx, "post-worker.fifo", "post_published", testStruct{"val"})
+
+		if in := <-sent; in.DelaySeconds != nil {
+			t.Errorf("expected no delay for a fifo queue, got %v", in.DelaySeconds)
+		}
+	})
+
+	t.Run("without_delay", func(t *testing.T) {
+		c.MessageSelf(context.Background(), "post_published", testStruct{"val"})
+
+		if in := <-sent; in.DelaySeconds != nil {
+			t.Errorf("expected no delay, got %v", in.DelaySeconds)
+		}
+	})
+
+	t.Run("publisher", func(t *testing.T) {
+		p, _ := getStubPublisher(t, respond)
+		p.MessageWithDelay("post-worker", "post_published", testStruct{"val"}, time.Hour)
+
+		if in := <-sent; aws.Int64Value(in.DelaySeconds) != maxDelaySeconds {
+			t.Errorf("expected the delay to be capped at %d, got %v", maxDelaySeconds, in.DelaySeconds)
+		}
+	})
+}
+
+func TestDelaySeconds(t *testing.T) {
+	cases := map[time.Duration]int64{
+		-time.Second:            0,
+		0:                       0,
+		1500 * time.Millisecond: 2,
+		time.Minute:             60,
+		time.Hour:               maxDelaySeconds,
+	}
+
+	for d, expected := range cases {
+		if s := delaySeconds(d); s != expected {
+			t.Errorf("unexpected seconds for %v, expected %d, got %d", d, expected, s)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package gosqs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DumpedMessage is a message written to a file by DumpToFile, the file holds one json encoded message per line
+type DumpedMessage struct {
+	MessageID  string                     `json:"messageId"`
+	Body       string                     `json:"body"`
+	Attributes map[string]DumpedAttribute `json:"attributes,omitempty"`
+}
+
+// DumpedAttribute is a message attribute of a DumpedMessage
+type DumpedAttribute struct {
+	DataType    string `json:"dataType"`
+	StringValue string `json:"stringValue,omitempty"`
+	BinaryValue []byte `json:"binaryValue,omitempty"`
+}
+
+// newDumpedMessage copies the raw body and the message attributes of the message, an SNS envelope is kept as is
+func newDumpedMessage(m *sqs.Message) DumpedMessage {
+	d := DumpedMessage{MessageID: aws.StringValue(m.MessageId), Body: aws.StringValue(m.Body)}
+
+	for k, v := range m.MessageAttributes {
+		if d.Attributes == nil {
+			d.Attributes = make(map[string]DumpedAttribute, len(m.MessageAttributes))
+		}
+		d.Attributes[k] = DumpedAttribute{DataType: aws.StringValue(v.DataType), StringValue: aws.StringValue(v.StringValue), BinaryValue: v.BinaryValue}
+	}
+
+	return d
+}
+
+// DumpToFile moves up to max messages from the queue to the end of the file at path, e.g. to preserve the messages
+// of a filling DLQ while a downstream is down. 0 or less moves messages until the queue is empty. Each message is
+// written as a json encoded DumpedMessage on its own line, the file is created if it does not exist
+//
+// A batch of messages is only deleted from the queue once it was written and synced to disk. Messages that cannot be
+// deleted afterwards are received and written again. It returns the amount of messages that were written
+func (c *consumer) DumpToFile(ctx context.Context, path string, max int) (int, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, ErrDump.Context(err)
+	}
+	defer f.Close()
+
+	var written int
+	for max <= 0 || written < max {
+		batch := maxMessages
+		if max > 0 && int64(max-written) < batch {
+			batch = int64(max - written)
+		}
+
+		out, err := c.sqs.ReceiveMessageWithContext(ctx, receiveInput(c.queueURL(), batch))
+		if err != nil {
+			return written, ErrGetMessage.Context(err)
+		}
+
+		if len(out.Messages) == 0 {
+			return written, nil
+		}
+
+		if err := writeDump(f, out.Messages); err != nil {
+			return written, ErrDump.Context(err)
+		}
+		written += len(out.Messages)
+
+		for _, m := range out.Messages {
+			// a message that is not deleted is redelivered and dumped again, the delete failure is logged
+			c.delete(&message{Message: m})
+		}
+	}
+
+	return written, nil
+}
+
+// writeDump appends the messages to the file and syncs it to disk
+func writeDump(f *os.File, messages []*sqs.Message) error {
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, m := range messages {
+		if err := enc.Encode(newDumpedMessage(m)); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// messageAttributes converts the dumped attributes back to sqs message attributes
+func (d DumpedMessage) messageAttributes() map[string]*sqs.MessageAttributeValue {
+	if len(d.Attributes) == 0 {
+		return nil
+	}
+
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(d.Attributes))
+	for k, v := range d.Attributes {
+		attr := &sqs.MessageAttributeValue{DataType: aws.String(v.DataType), BinaryValue: v.BinaryValue}
+		if v.StringValue != "" {
+			attr.StringValue = aws.String(v.StringValue)
+		}
+		attrs[k] = attr
+	}
+
+	return attrs
+}
+
+// ReplayFromFile sends every message of a file written by DumpToFile to the queue at queueURL with its original body
+// and attributes. Malformed lines are logged and skipped. It returns the amount of messages that were sent
+func (c *consumer) ReplayFromFile(ctx context.Context, path, queueURL string) (int, error) {
+	n, _, err := c.ReplayFromFileAt(ctx, path, queueURL, 0)
+	return n, err
+}
+
+// ReplayFromFileAt is ReplayFromFile starting at the byte offset of a line in the file. Along with the amount of
+// messages that were sent it returns the offset of the first line that was not replayed, passing it back continues a
+// partial replay without sending the replayed messages again. Once the whole file was replayed the offset is its size
+func (c *consumer) ReplayFromFileAt(ctx context.Context, path, queueURL string, offset int64) (int, int64, error) {
+	return replayFile(ctx, c.sqs, c.Logger(), path, queueURL, offset)
+}
+
+// ReplayFromFile sends every message of a file written by Consumer.DumpToFile to the queue at queueURL with its
+// original body and attributes. Malformed lines are logged and skipped. It returns the amount of messages that were sent
+func (p *publisher) ReplayFromFile(ctx context.Context, path, queueURL string) (int, error) {
+	n, _, err := p.ReplayFromFileAt(ctx, path, queueURL, 0)
+	return n, err
+}
+
+// ReplayFromFileAt is ReplayFromFile starting at the byte offset of a line in the file, it returns the offset to
+// resume a partial replay
+func (p *publisher) ReplayFromFileAt(ctx context.Context, path, queueURL string, offset int64) (int, int64, error) {
+	return replayFile(ctx, p.sqs, p.logger, path, queueURL, offset)
+}
+
+// replayFile sends the messages of a dump file to the queue, starting at the offset
+func replayFile(ctx context.Context, client SQSAPI, logger Logger, path, queueURL string, offset int64) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, offset, ErrReplay.Context(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, offset, ErrReplay.Context(err)
+	}
+
+	var sent int
+	r := bufio.NewReader(f)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return sent, offset, ErrReplay.Context(readErr)
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var d DumpedMessage
+			if err := json.Unmarshal(trimmed, &d); err != nil {
+				logger.Println(ErrMarshal.Context(fmt.Errorf("skipping malformed line at offset %d: %v", offset, err)).Error())
+			} else {
+				input := &sqs.SendMessageInput{QueueUrl: &queueURL, MessageBody: aws.String(d.Body), MessageAttributes: d.messageAttributes()}
+				if _, err := client.SendMessageWithContext(ctx, input); err != nil {
+					return sent, offset, ErrReplay.Context(err)
+				}
+				sent++
+			}
+		}
+		offset += int64(len(line))
+
+		if readErr == io.EOF {
+			return sent, offset, nil
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package gosqs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// getStubDumpConsumer creates a consumer whose queue holds the provided amount of messages
+func getStubDumpConsumer(t *testing.T, pending int) (*consumer, *operations) {
+	var mu sync.Mutex
+	var served int
+
+	return getStubConsumer(t, func(r *request.Request) {
+		in, ok := r.Params.(*sqs.ReceiveMessageInput)
+		if !ok {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		out := r.Data.(*sqs.ReceiveMessageOutput)
+		for i := int64(0); i < *in.MaxNumberOfMessages && served < pending; i++ {
+			m := newStubMessage("post_published", fmt.Sprintf(`{"val":"%d"}`, served)).Message
+			m.MessageId = aws.String(fmt.Sprintf("message-%d", served))
+			out.Messages = append(out.Messages, m)
+			served++
+		}
+	})
+}
+
+func TestDumpToFile(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		c, ops := getStubDumpConsumer(t, 25)
+		path := filepath.Join(t.TempDir(), "dump.jsonl")
+
+		n, err := c.DumpToFile(context.TODO(), path, 0)
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n != 25 || ops.count("DeleteMessage") != 25 {
+			t.Errorf("expected 25 messages to be written and deleted, got %d written and %d deleted", n, ops.count("DeleteMessage"))
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("unable to open dump, got %v", err)
+		}
+		defer f.Close()
+
+		var lines []DumpedMessage
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var d DumpedMessage
+			if err := json.Unmarshal(s.Bytes(), &d); err != nil {
+				t.Fatalf("invalid line %s, got %v", s.Text(), err)
+			}
+			lines = append(lines, d)
+		}
+
+		if len(lines) != 25 {
+			t.Fatalf("expected 25 lines, got %d", len(lines))
+		}
+
+		expected := DumpedMessage{
+			MessageID:  "message-3",
+			Body:       `{"val":"3"}`,
+			Attributes: map[string]DumpedAttribute{"route": {DataType: "String", StringValue: "post_published"}},
+		}
+		if d := lines[3]; !reflect.DeepEqual(d, expected) {
+			t.Errorf("unexpected message, expected %+v, got %+v", expected, d)
+		}
+	})
+
+	t.Run("max", func(t *testing.T) {
+		c, ops := getStubDumpConsumer(t, 25)
+
+		n, err := c.DumpToFile(context.TODO(), filepath.Join(t.TempDir(), "dump.jsonl"), 12)
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n != 12 || ops.count("DeleteMessage") != 12 {
+			t.Errorf("expected 12 messages to be written and deleted, got %d written and %d deleted", n, ops.count("DeleteMessage"))
+		}
+	})
+
+	t.Run("not_deleted_until_written", func(t *testing.T) {
+		if _, err := os.Stat("/dev/full"); err != nil {
+			t.Skip("requires /dev/full to fail writes")
+		}
+
+		c, ops := getStubDumpConsumer(t, 5)
+
+		n, err := c.DumpToFile(context.TODO(), "/dev/full", 0)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrDump.Err {
+			t.Fatalf("expected %v, got %v", ErrDump, err)
+		}
+
+		if n != 0 || ops.count("DeleteMessage") != 0 {
+			t.Errorf("expected no messages to be deleted, got %d written and %d deleted", n, ops.count("DeleteMessage"))
+		}
+	})
+}
+
+// getStubReplayConsumer creates a consumer that records the sent messages, sends fail once failAfter messages were
+// sent unless it is negative
+func getStubReplayConsumer(t *testing.T, failAfter int) (*consumer, *[]*sqs.SendMessageInput) {
+	var sent []*sqs.SendMessageInput
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		in, ok := r.Params.(*sqs.SendMessageInput)
+		if !ok {
+			return
+		}
+
+		if failAfter >= 0 && len(sent) >= failAfter {
+			r.Error = awserr.New("InternalError", "unavailable", nil)
+			r.Retryable = aws.Bool(false)
+			return
+		}
+		sent = append(sent, in)
+	})
+
+	return c, &sent
+}
+
+func TestReplayFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+	lines := []string{
+		`{"messageId":"message-0","body":"{\"val\":\"0\"}","attributes":{"route":{"dataType":"String","stringValue":"post_published"}}}`,
+		`not json`,
+		``,
+		`{"messageId":"message-1","body":"{\"val\":\"1\"}"}`,
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("skips_malformed", func(t *testing.T) {
+		c, sent := getStubReplayConsumer(t, -1)
+
+		n, err := c.ReplayFromFile(context.TODO(), path, "https://sqs.us-west-1.amazonaws.com/1/dev-replay")
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n != 2 || len(*sent) != 2 {
+			t.Fatalf("expected 2 messages to be sent, got %d", len(*sent))
+		}
+
+		first := (*sent)[0]
+		if *first.QueueUrl != "https://sqs.us-west-1.amazonaws.com/1/dev-replay" || *first.MessageBody != `{"val":"0"}` {
+			t.Errorf("unexpected message, got %v", first)
+		}
+
+		if route := first.MessageAttributes["route"]; route == nil || *route.StringValue != "post_published" {
+			t.Errorf("expected the attributes to be restored, got %v", first.MessageAttributes)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		c, sent := getStubReplayConsumer(t, 1)
+
+		n, offset, err := c.ReplayFromFileAt(context.TODO(), path, "queue-url", 0)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrReplay.Err {
+			t.Fatalf("expected %v, got %v", ErrReplay, err)
+		}
+
+		if n != 1 {
+			t.Fatalf("expected 1 message to be sent before the failure, got %d", n)
+		}
+
+		// the offset points at the line that failed, the malformed and empty lines before it were consumed
+		if expected := int64(len(lines[0]) + len(lines[1]) + len(lines[2]) + 3); offset != expected {
+			t.Fatalf("expected offset %d, got %d", expected, offset)
+		}
+
+		c, sent = getStubReplayConsumer(t, -1)
+		n, offset, err = c.ReplayFromFileAt(context.TODO(), path, "queue-url", offset)
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n != 1 || *(*sent)[0].MessageBody != `{"val":"1"}` {
+			t.Errorf("expected only the remaining message to be sent, got %d", n)
+		}
+
+		if info, _ := os.Stat(path); offset != info.Size() {
+			t.Errorf("expected the offset to be the file size %d, got %d", info.Size(), offset)
+		}
+	})
+
+	t.Run("publisher", func(t *testing.T) {
+		var sent []*sqs.SendMessageInput
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+				sent = append(sent, in)
+			}
+		})
+		logger := &recordLogger{}
+		p.logger = logger
+
+		n, err := p.ReplayFromFile(context.TODO(), path, "queue-url")
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n != 2 || len(sent) != 2 || *sent[1].MessageBody != `{"val":"1"}` {
+			t.Errorf("expected 2 messages to be sent, got %d", len(sent))
+		}
+
+		if len(logger.lines) != 1 {
+			t.Errorf("expected the malformed line to be logged, got %v", logger.lines)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package gosqs
 
 import (
+	"errors"
 	"fmt"
 	"log"
 )
@@ -43,6 +44,38 @@ func (e *SQSError) Context(err error) *SQSError {
 	return ctxErr
 }
 
+// terminalError marks a handler error as terminal, see Terminal
+type terminalError struct {
+	err error
+}
+
+// Error returns the message of the wrapped error
+func (e *terminalError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error so it can be inspected with errors.Is and errors.As
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
+// Terminal marks an error returned by a handler as terminal, e.g. for a payload that can never be processed. The
+// message is moved to the DLQUrl if it is configured or deleted otherwise, instead of being redelivered until the
+// redrive policy gives up. Other errors are retryable and leave the message for redelivery
+func Terminal(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &terminalError{err: err}
+}
+
+// IsTerminal determines whether the error, or any error it wraps, was marked with Terminal
+func IsTerminal(err error) bool {
+	var t *terminalError
+	return errors.As(err, &t)
+}
+
 // newSQSErr creates a new SQS Error
 func newSQSErr(msg string) *SQSError {
 	e := new(SQSError)
@@ -53,6 +86,9 @@ func newSQSErr(msg string) *SQSError {
 // ErrUndefinedPublisher invalid credentials
 var ErrUndefinedPublisher = newSQSErr("sqs publisher is undefined")
 
+// ErrInvalidNotifier the notifier must not be nil and must have a model name
+var ErrInvalidNotifier = newSQSErr("invalid notifier, a model name is required")
+
 // ErrInvalidCreds invalid credentials
 var ErrInvalidCreds = newSQSErr("invalid aws credentials")
 
@@ -62,26 +98,109 @@ var ErrUnableToDelete = newSQSErr("unable to delete item in queue")
 // ErrUnableToExtend unable to extend message processing time
 var ErrUnableToExtend = newSQSErr("unable to extend message processing time")
 
+// ErrEmptyPrefix a queue name prefix is required for bulk queue operations
+var ErrEmptyPrefix = newSQSErr("a queue name prefix is required")
+
+// ErrNotConfirmed bulk queue operations must be explicitly confirmed
+var ErrNotConfirmed = newSQSErr("bulk queue operation was not confirmed")
+
+// ErrBulkOperation a bulk queue operation failed, the queues affected up to the failure are returned along with it
+var ErrBulkOperation = newSQSErr("bulk queue operation failed")
+
+// ErrSubscribeNotAllowed subscribing changes IAM policies and must be enabled explicitly
+var ErrSubscribeNotAllowed = newSQSErr("subscribing is not allowed, enable it with Config.AllowSubscribe")
+
+// ErrSubscribe unable to subscribe the queue to the topic
+var ErrSubscribe = newSQSErr("unable to subscribe queue to topic")
+
 // ErrQueueURL undefined queueURL
 var ErrQueueURL = newSQSErr("undefined queueURL")
 
 // ErrMarshal unable to marshal request
 var ErrMarshal = newSQSErr("unable to marshal request")
 
+// ErrTranscode unable to convert the message body using the transcoder for its content-type
+var ErrTranscode = newSQSErr("unable to transcode message body")
+
+// ErrPreprocess unable to preprocess the message body using the BodyPreprocessor
+var ErrPreprocess = newSQSErr("unable to preprocess message body")
+
 // ErrInvalidVal the custom attribute value must match the type of the custom attribute Datatype
 var ErrInvalidVal = newSQSErr("value type does not match specified datatype")
 
+// ErrAttributeNotFound the message does not carry the requested attribute
+var ErrAttributeNotFound = newSQSErr("attribute not found")
+
+// ErrAttributeType the attribute does not hold a value of the requested type
+var ErrAttributeType = newSQSErr("attribute does not match the requested type")
+
+// ErrInvalidTarget the decoding target must be a non-nil pointer to a struct
+var ErrInvalidTarget = newSQSErr("decode target must be a non-nil pointer to a struct")
+
+// ErrInvalidS3Event the message body is not an S3 event notification
+var ErrInvalidS3Event = newSQSErr("message is not an s3 event notification")
+
 // ErrNoRoute message received without a route
 var ErrNoRoute = newSQSErr("message received without a route")
 
+// ErrUnhandledLimit occurs when a message without a handler has been ignored too many times, it is deleted
+var ErrUnhandledLimit = newSQSErr("message without a handler exceeded the receive limit, deleting")
+
 // ErrGetMessage fires when a request to retrieve messages from sqs fails
 var ErrGetMessage = newSQSErr("unable to retrieve message")
 
+// ErrQueueAttributes unable to retrieve or parse the attributes of the queue
+var ErrQueueAttributes = newSQSErr("unable to retrieve queue attributes")
+
+// ErrClockSkew occurs when the local clock is behind AWS, ages computed from sqs timestamps are clamped to 0
+var ErrClockSkew = newSQSErr("local clock is behind aws, message ages are measured from their receipt")
+
+// ErrQueueGone fires when the queue was deleted while the consumer was running
+var ErrQueueGone = newSQSErr("queue no longer exists, stopping consumer")
+
+// ErrShutdownTimeout the received messages were not processed before the shutdown deadline
+var ErrShutdownTimeout = newSQSErr("shutdown deadline exceeded before all messages were processed")
+
 // ErrMessageProcessing occurs when a message has exceeded the consumption time limit set by aws SQS
 var ErrMessageProcessing = newSQSErr("processing time exceeding limit")
 
+// ErrNotCommitted occurs when a handler succeeds without committing the message while commits are required, the message
+// is left for redelivery
+var ErrNotCommitted = newSQSErr("message processed without a commit, skipping delete")
+
+// ErrDump unable to write messages to the dump file, the messages that were not written remain in the queue
+var ErrDump = newSQSErr("unable to dump messages to file")
+
+// ErrReplay unable to send the messages of a dump file, the offset returned by ReplayFromFileAt resumes the replay
+var ErrReplay = newSQSErr("unable to replay messages from file")
+
+// ErrPanic occurs when a handler wrapped with WithRecovery panicked, the message is not deleted
+var ErrPanic = newSQSErr("handler panicked, skipping delete")
+
+// ErrTerminal occurs when a handler returns an error marked with Terminal, the message is not redelivered
+var ErrTerminal = newSQSErr("handler failed with a terminal error, message discarded")
+
+// ErrLateCompletion occurs when a handler succeeds after the visibility timeout of the message lapsed. The message is not
+// deleted since it might already be processed by another consumer
+var ErrLateCompletion = newSQSErr("message processed after its visibility timeout lapsed, skipping delete")
+
+// ErrDeadLetter occurs when a message cannot be moved to the DLQ, e.g. because no DLQUrl is configured
+var ErrDeadLetter = newSQSErr("unable to move the message to the dead-letter queue")
+
 // ErrBodyOverflow AWS SQS can only hold payloads of 262144 bytes. Messages must either be routed to s3 or truncated
 var ErrBodyOverflow = newSQSErr("message surpasses sqs limit of 262144, please truncate body")
 
-// ErrPublish If there is an error publishing a message. gosqs will wait 10 seconds and try again up to the configured retry count
+// ErrOffload occurs when a body exceeding the sqs limit cannot be uploaded to S3, or an offloaded body cannot be fetched
+var ErrOffload = newSQSErr("unable to offload the message body to s3")
+
+// ErrCompression occurs when a body cannot be compressed, or a compressed body cannot be decompressed
+var ErrCompression = newSQSErr("unable to compress the message body")
+
+// ErrTooManyAttributes occurs when a message carries more than the 10 attributes sqs allows, including the route
+var ErrTooManyAttributes = newSQSErr("message surpasses sqs limit of 10 attributes")
+
+// ErrAttributeSizeExceeded occurs when the attributes push a message beyond the sqs size limit of 262144 bytes
+var ErrAttributeSizeExceeded = newSQSErr("message attributes surpass sqs limit of 262144 bytes along with the body")
+
+// ErrPublish If there is an error publishing a message. gosqs will wait the RetryDelay and try again up to the configured retry count
 var ErrPublish = newSQSErr("message publish failure. Retrying...")
@@ -0,0 +1,71 @@
+package gosqs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	messageGroupIDKey  = contextKey("messageGroupID")
+	deduplicationIDKey = contextKey("deduplicationID")
+)
+
+// WithMessageGroupID adds a FIFO message group id to the context. Messages sent to a FIFO queue by Consumer.Message
+// and Consumer.MessageSelf with this context are sent to the group, it is ignored for standard queues
+func WithMessageGroupID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageGroupIDKey, id)
+}
+
+// WithDeduplicationID adds a FIFO deduplication id to the context. Messages sent to a FIFO queue by Consumer.Message
+// and Consumer.MessageSelf with this context carry it, it is ignored for standard queues
+func WithDeduplicationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, deduplicationIDKey, id)
+}
+
+// MessageGroupID retrieves the FIFO message group id from the context
+func MessageGroupID(ctx context.Context) string {
+	id, _ := ctx.Value(messageGroupIDKey).(string)
+	return id
+}
+
+// DeduplicationID retrieves the FIFO deduplication id from the context
+func DeduplicationID(ctx context.Context) string {
+	id, _ := ctx.Value(deduplicationIDKey).(string)
+	return id
+}
+
+// ContentDeduplicationID is a Config.DeduplicationIDFunc for FIFO queues without content-based deduplication. Like
+// content-based deduplication it is the SHA-256 hash of the body, it includes the event so identical bodies sent to
+// different routes are not deduplicated
+func ContentDeduplicationID(body []byte, event string) string {
+	h := sha256.New()
+	h.Write([]byte(event))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// applyFIFO sets the message group and deduplication ids of the context on input if it is sent to a FIFO queue, sqs
+// rejects them for standard queues. Without a deduplication id on the context, dedup produces one if it is set
+func applyFIFO(ctx context.Context, input *sqs.SendMessageInput, event string, dedup func(body []byte, event string) string) {
+	if input.QueueUrl == nil || !strings.HasSuffix(*input.QueueUrl, fifoSuffix) {
+		return
+	}
+
+	if id := MessageGroupID(ctx); id != "" {
+		input.MessageGroupId = &id
+	}
+
+	if id := DeduplicationID(ctx); id != "" {
+		input.MessageDeduplicationId = &id
+	} else if dedup != nil {
+		if id := dedup([]byte(aws.StringValue(input.MessageBody)), event); id != "" {
+			input.MessageDeduplicationId = &id
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestMessageFIFOContext(t *testing.T) {
+	sent := make(chan *sqs.SendMessageInput, 1)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueUrlInput:
+			r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/" + *in.QueueName)
+		case *sqs.SendMessageInput:
+			sent <- in
+		}
+	})
+	c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker.fifo"
+
+	ctx := WithDeduplicationID(WithMessageGroupID(context.Background(), "tenant-1"), "post-42")
+
+	t.Run("message_self", func(t *testing.T) {
+		c.MessageSelf(ctx, "post_published", testStruct{"val"})
+
+		in := <-sent
+		if aws.StringValue(in.MessageGroupId) != "tenant-1" || aws.StringValue(in.MessageDeduplicationId) != "post-42" {
+			t.Errorf("expected the group and deduplication ids of the context, got %v and %v", in.MessageGroupId, in.MessageDeduplicationId)
+		}
+	})
+
+	t.Run("message_fifo", func(t *testing.T) {
+		c.Message(ctx, "post-worker.fifo", "post_published", testStruct{"val"})
+
+		in := <-sent
+		if aws.StringValue(in.MessageGroupId) != "tenant-1" || aws.StringValue(in.MessageDeduplicationId) != "post-42" {
+			t.Errorf("expected the group and deduplication ids of the context, got %v and %v", in.MessageGroupId, in.MessageDeduplicationId)
+		}
+	})
+
+	t.Run("message_standard", func(t *testing.T) {
+		c.Message(ctx, "post-worker", "post_published", testStruct{"val"})
+
+		in := <-sent
+		if in.MessageGroupId != nil || in.MessageDeduplicationId != nil {
+			t.Errorf("expected no fifo ids for a standard queue, got %v and %v", in.MessageGroupId, in.MessageDeduplicationId)
+		}
+	})
+
+	if id := MessageGroupID(context.Background()); id != "" {
+		t.Errorf("expected no group id, got %s", id)
+	}
+}
+
+func TestMessageDeduplicationIDFunc(t *testing.T) {
+	sent := make(chan *sqs.SendMessageInput, 1)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+			sent <- in
+		}
+	})
+	c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker.fifo"
+	ctx := WithMessageGroupID(context.Background(), "tenant-1")
+
+	t.Run("content_based", func(t *testing.T) {
+		c.MessageSelf(ctx, "post_published", testStruct{"val"})
+
+		if in := <-sent; in.MessageDeduplicationId != nil {
+			t.Errorf("expected the queue's content-based deduplication to be relied on, got %v", in.MessageDeduplicationId)
+		}
+	})
+
+	c.dedupFunc = ContentDeduplicationID
+
+	t.Run("func", func(t *testing.T) {
+		c.MessageSelf(ctx, "post_published", testStruct{"val"})
+
+		expected := ContentDeduplicationID([]byte(`{"val":"val"}`), "post_published")
+		if in := <-sent; aws.StringValue(in.MessageDeduplicationId) != expected {
+			t.Errorf("expected %s, got %v", expected, in.MessageDeduplicationId)
+		}
+	})
+
+	t.Run("context_precedence", func(t *testing.T) {
+		c.MessageSelf(WithDeduplicationID(ctx, "post-42"), "post_published", testStruct{"val"})
+
+		if in := <-sent; aws.StringValue(in.MessageDeduplicationId) != "post-42" {
+			t.Errorf("expected the deduplication id of the context, got %v", in.MessageDeduplicationId)
+		}
+	})
+
+	t.Run("standard", func(t *testing.T) {
+		c.QueueURL = "http://local.goaws:4100/queue/dev-post-worker"
+		c.MessageSelf(ctx, "post_published", testStruct{"val"})
+
+		if in := <-sent; in.MessageDeduplicationId != nil {
+			t.Errorf("expected no deduplication id for a standard queue, got %v", in.MessageDeduplicationId)
+		}
+	})
+}
+
+func TestContentDeduplicationID(t *testing.T) {
+	id := ContentDeduplicationID([]byte(`{"val":"val"}`), "post_published")
+	if len(id) != 64 {
+		t.Errorf("expected a hex encoded sha256 hash, got %s", id)
+	}
+
+	if other := ContentDeduplicationID([]byte(`{"val":"val"}`), "post_published"); other != id {
+		t.Errorf("expected the id to be stable, got %s and %s", id, other)
+	}
+
+	if other := ContentDeduplicationID([]byte(`{"val":"val"}`), "post_deleted"); other == id {
+		t.Error("expected the event to change the id")
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/qhenkart/gosqs
 
-go 1.15
+go 1.18
 
 require github.com/aws/aws-sdk-go v1.34.13
+
+require github.com/jmespath/go-jmespath v0.3.0 // indirect
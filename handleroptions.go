@@ -0,0 +1,52 @@
+package gosqs
+
+// HandlerOptions overrides the settings of the consumer for the messages of a single route
+type HandlerOptions struct {
+	// the visibility timeout in seconds the messages of the route are processed with, e.g. to give a slow handler
+	// minutes on a queue of fast handlers. 0 uses the VisibilityTimeout of the consumer
+	VisibilityTimeout int
+	// the amount of times the visibility of a message of the route is extended. nil uses the ExtensionLimit of the
+	// consumer
+	ExtensionLimit *int
+	// disables the visibility extension for the route. Use it for fast, idempotent handlers that will never exceed the
+	// visibility timeout, it avoids spawning an extension goroutine for every message. VisibilityTimeout and
+	// ExtensionLimit have no effect with it
+	WithoutExtension bool
+	// leaves the decision to delete a message of the route to the handler, e.g. for handlers that complete their work
+	// asynchronously. A message is only deleted once Message.Ack is called, Message.Nack releases it for redelivery.
+	// A message that is neither acked nor nacked is received again once its visibility timeout lapses, use
+	// Message.Extend if the work takes longer
+	ManualAck bool
+}
+
+// RegisterHandlerWithOptions registers a handler like RegisterHandler, processing the messages of the route with the
+// options instead of the settings of the consumer
+//
+// Messages are received with the visibility timeout of the consumer, it is changed to the one of the route as soon as
+// the handler starts
+func (c *consumer) RegisterHandlerWithOptions(name string, h Handler, opts HandlerOptions, adapters ...Adapter) {
+	if c.handlers == nil {
+		c.handlers = make(map[string]*route)
+	}
+
+	c.handlers[name] = newRoute(h, opts, adapters...)
+}
+
+// routeSettings returns the visibility timeout and extension limit the messages of the route are processed with, the
+// settings of the consumer apply unless the route overrides them. A nil route uses the settings of the consumer
+func (c *consumer) routeSettings(r *route) (visibilityTimeout, extensionLimit int) {
+	visibilityTimeout, extensionLimit = c.settings()
+	if r == nil {
+		return visibilityTimeout, extensionLimit
+	}
+
+	if r.visibilityTimeout > 0 {
+		visibilityTimeout = r.visibilityTimeout
+	}
+
+	if r.extensionLimit != nil {
+		extensionLimit = *r.extensionLimit
+	}
+
+	return visibilityTimeout, extensionLimit
+}
@@ -0,0 +1,64 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestRegisterHandlerWithOptions(t *testing.T) {
+	visibility := make(chan int64, 10)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sqs.ChangeMessageVisibilityInput); ok {
+			visibility <- *in.VisibilityTimeout
+		}
+	})
+	c.VisibilityTimeout = 30
+
+	limit := 5
+	c.RegisterHandlerWithOptions("post_exported", func(ctx context.Context, m Message) error {
+		select {
+		case v := <-visibility:
+			if v != 300 {
+				t.Errorf("expected the visibility timeout of the route, got %d", v)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected the visibility timeout of the route to be applied when the handler starts")
+		}
+		return nil
+	}, HandlerOptions{VisibilityTimeout: 300, ExtensionLimit: &limit})
+	c.RegisterHandler("post_published", test)
+
+	if err := c.run(context.Background(), newStubMessage("post_exported", `{}`)); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	t.Run("settings", func(t *testing.T) {
+		if vt, el := c.routeSettings(c.handlers["post_exported"]); vt != 300 || el != 5 {
+			t.Errorf("expected the settings of the route, got %d and %d", vt, el)
+		}
+
+		if vt, el := c.routeSettings(c.handlers["post_published"]); vt != 30 || el != c.extensionLimit {
+			t.Errorf("expected the settings of the consumer, got %d and %d", vt, el)
+		}
+
+		if vt, _ := c.routeSettings(nil); vt != 30 {
+			t.Errorf("expected the settings of the consumer without a route, got %d", vt)
+		}
+	})
+
+	t.Run("consumer_timeout", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		select {
+		case v := <-visibility:
+			t.Errorf("expected no change of the visibility for a route using the consumer settings, got %d", v)
+		default:
+		}
+	})
+}
@@ -2,8 +2,17 @@ package gosqs
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
@@ -11,27 +20,225 @@ import (
 type Message interface {
 	// Route returns the event name that is used for routing within a worker, e.g. post_published
 	Route() string
-	// Decode will unmarshal the message into a supplied output using json
+	// Decode will unmarshal the message into a supplied output using the Codec of the consumer, json by default
 	Decode(out interface{}) error
 	// DecodeModified is used for decoding the modification message, it will populate the body with the actual message and a
 	// map[string]interface{} to view original values from that message
 	DecodeModified(out interface{}, changes interface{}) error
+	// Peek returns a top-level string field of the json body without decoding the rest of it, e.g. to read a
+	// discriminator that selects the type the body is decoded into
+	Peek(field string) (string, error)
 	// Attribute will return the custom attribute that was sent through out the request.
 	Attribute(key string) string
+	// AttributeInt returns the value of a Number attribute. It returns ErrAttributeNotFound if the attribute was
+	// not sent and ErrAttributeType if it is not an integer Number
+	AttributeInt(key string) (int, error)
+	// AttributeBool returns the value of a String attribute holding a boolean, e.g. "true". It returns
+	// ErrAttributeNotFound if the attribute was not sent and ErrAttributeType if it is not a boolean String
+	AttributeBool(key string) (bool, error)
+	// DecodeAttributes populates the fields of the supplied struct pointer with the message attributes named in
+	// their `sqsattr` tags. String and number fields are supported
+	DecodeAttributes(out interface{}) error
+	// FirstReceiveTime returns the time the message was first received from the queue. It returns the zero time
+	// if it is unknown
+	FirstReceiveTime() time.Time
+	// ReceiveCount returns the amount of times the message has been received including the current receive, e.g. to
+	// log extra diagnostics on the last attempts. It is 0 if it is unknown
+	ReceiveCount() int
+	// Age returns how long ago the message was sent, it is never negative even if the clocks of the host and AWS are
+	// skewed. It returns 0 if the send time is unknown
+	Age() time.Duration
+	// DecodeS3Event parses an S3 event notification into its records. The test event S3 sends when the notification
+	// is configured returns no records and no error so it can be consumed
+	DecodeS3Event() ([]S3Record, error)
+	// SNSMeta returns the topic, subject and timestamp of the SNS envelope the message was delivered in. It is
+	// empty if the message was not delivered by SNS or raw message delivery is enabled
+	SNSMeta() SNSMeta
+	// TraceHeader returns the AWS X-Ray trace header the message was sent with, it is empty if the message is not traced
+	TraceHeader() string
+	// Commit deletes the message from the queue right away and returns the result, making the delete an explicit and
+	// observable step of the handler. A committed message is not deleted again when the handler returns
+	Commit(ctx context.Context) error
+	// Ack deletes the message from the queue, it is equivalent to Commit. Use it with HandlerOptions.ManualAck to
+	// complete a message once asynchronous work finished
+	Ack(ctx context.Context) error
+	// Nack releases the message to be received again right away instead of deleting it, without treating it as a
+	// failure
+	Nack(ctx context.Context) error
+	// DeadLetter moves the message to the DLQUrl of the config right away, e.g. when the handler knows the payload is
+	// permanently bad, instead of letting it cycle through the redeliveries of the redrive policy
+	DeadLetter(ctx context.Context) error
+	// Defer makes the message visible again after d instead of deleting it once the handler returns, rescheduling it
+	// without counting the attempt as a failure, e.g. to back off from a throttled downstream
+	Defer(d time.Duration) error
+	// Extend sets the visibility timeout of the message to the given seconds from now, buying the handler time when it
+	// knows it needs more than the automatic extensions provide
+	Extend(ctx context.Context, seconds int) error
+}
+
+// SNSMeta holds the metadata of the SNS envelope a message was delivered in
+type SNSMeta struct {
+	TopicArn  string
+	Subject   string
+	Timestamp time.Time
 }
 
 // message serves as a wrapper for sqs.Message as well as controls the error handling channel
 type message struct {
+	// visibleAt is the time in unix nanoseconds at which the message becomes visible on the queue again, it is
+	// accessed atomically and must remain 64-bit aligned. 0 means unknown
+	visibleAt int64
+
 	*sqs.Message
-	err chan error
+	// done is closed once the handler called Success or ErrorResponse, extendMu serializes it with visibility
+	// extensions so that no extension is requested afterwards
+	done     chan struct{}
+	doneOnce sync.Once
+	extendMu sync.Mutex
+
+	// queueURL is the url of the queue the message was received from
+	queueURL string
+	// receivedAt is the local time the message was received at, clock provides the current time
+	receivedAt time.Time
+	clock      func() time.Time
+	// envelope is set when the message was delivered by SNS without raw message delivery
+	envelope *snsEnvelope
+	// payload is the body that is decoded by the handler, it might differ from the raw sqs body after unwrapping
+	// or transcoding
+	payload []byte
+
+	// commit deletes the message from the queue, it is provided by the consumer running the message
+	commit func(m *message) error
+	// codec decodes the body, json is used if it is nil
+	codec Codec
+	// deadLetter moves the message to the DLQ, it is provided by the consumer running the message
+	deadLetter func(ctx context.Context, m *message, reason error) error
+	commitMu   sync.Mutex
+	committed  bool
+
+	// changeVisibility sets the visibility timeout of the message, it is provided by the consumer running the message.
+	// deferred is set once the handler rescheduled the message with Defer
+	changeVisibility func(ctx context.Context, m *message, seconds int64) error
+	deferred         bool
+
+	// replyBody is the result of a ReplyHandler, replied is set once the handler returned it
+	replyBody interface{}
+	replied   bool
 }
 
 func newMessage(m *sqs.Message) *message {
-	return &message{m, make(chan error, 1)}
+	msg := &message{Message: m, done: make(chan struct{})}
+	if m.Body != nil {
+		msg.payload = []byte(*m.Body)
+	}
+	msg.unwrap()
+
+	return msg
+}
+
+// snsEnvelope is the json structure SNS wraps around a message when raw message delivery is disabled
+type snsEnvelope struct {
+	Type              string                  `json:"Type"`
+	MessageID         string                  `json:"MessageId"`
+	TopicArn          string                  `json:"TopicArn"`
+	Subject           string                  `json:"Subject"`
+	Message           string                  `json:"Message"`
+	Timestamp         string                  `json:"Timestamp"`
+	MessageAttributes map[string]snsAttribute `json:"MessageAttributes"`
+}
+
+// snsAttribute is the representation of a message attribute within an SNS envelope
+type snsAttribute struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// unwrap detects an SNS envelope in the body of the message. If one is found, the attributes of the envelope are
+// mapped into the message attributes so they are accessible through Route and Attribute. Attributes that were set
+// directly on the sqs message take precedence
+func (m *message) unwrap() {
+	if m.Message.Body == nil || !strings.HasPrefix(strings.TrimSpace(*m.Message.Body), "{") {
+		return
+	}
+
+	var env snsEnvelope
+	if err := json.Unmarshal([]byte(*m.Message.Body), &env); err != nil || env.Type != "Notification" || env.TopicArn == "" {
+		return
+	}
+
+	m.envelope = &env
+	m.payload = []byte(env.Message)
+
+	if m.MessageAttributes == nil {
+		m.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+	}
+
+	for key, attr := range env.MessageAttributes {
+		if _, ok := m.MessageAttributes[key]; ok {
+			continue
+		}
+
+		dt, val := attr.Type, attr.Value
+		v := &sqs.MessageAttributeValue{DataType: &dt}
+		if strings.HasPrefix(dt, "Binary") {
+			b, err := base64.StdEncoding.DecodeString(val)
+			if err != nil {
+				continue
+			}
+			v.BinaryValue = b
+		} else {
+			v.StringValue = &val
+		}
+
+		m.MessageAttributes[key] = v
+	}
+}
+
+// SNSMeta returns the topic, subject and timestamp of the SNS envelope the message was delivered in. It is
+// empty if the message was not delivered by SNS or raw message delivery is enabled
+func (m *message) SNSMeta() SNSMeta {
+	if m.envelope == nil {
+		return SNSMeta{}
+	}
+
+	// an unparseable timestamp leaves the zero time, the remaining metadata is still useful
+	ts, _ := time.Parse(time.RFC3339Nano, m.envelope.Timestamp)
+
+	return SNSMeta{
+		TopicArn:  m.envelope.TopicArn,
+		Subject:   m.envelope.Subject,
+		Timestamp: ts,
+	}
+}
+
+// setVisibleAt records the time at which the message becomes visible on the queue again
+func (m *message) setVisibleAt(t time.Time) {
+	atomic.StoreInt64(&m.visibleAt, t.UnixNano())
+}
+
+// visibilityLapsed determines whether the visibility timeout of the message has passed, in which case the message
+// may have been received again by another consumer
+func (m *message) visibilityLapsed() bool {
+	v := atomic.LoadInt64(&m.visibleAt)
+	return v != 0 && time.Now().UnixNano() > v
+}
+
+// defaultRoute sets the route of a message that was received without one
+func (m *message) defaultRoute(route string) {
+	if _, ok := m.MessageAttributes["route"]; ok {
+		return
+	}
+
+	if m.MessageAttributes == nil {
+		m.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+	}
+
+	st := DataTypeString.String()
+	m.MessageAttributes["route"] = &sqs.MessageAttributeValue{DataType: &st, StringValue: &route}
 }
 
 func (m *message) body() []byte {
-	return []byte(*m.Message.Body)
+	return m.payload
 }
 
 // Route returns the event name that is used for routing within a worker, e.g. post_published
@@ -39,11 +246,42 @@ func (m *message) Route() string {
 	return *m.MessageAttributes["route"].StringValue
 }
 
-// Decode will unmarshal the message into a supplied output using json
+// Decode will unmarshal the message into a supplied output using the Codec of the consumer, json by default
 func (m *message) Decode(out interface{}) error {
+	if m.codec != nil {
+		return m.codec.Unmarshal(m.body(), out)
+	}
+
 	return json.Unmarshal(m.body(), &out)
 }
 
+// Peek returns a top-level string field of the json body without decoding the rest of it, e.g. to read a
+// discriminator that selects the type the body is decoded into
+func (m *message) Peek(field string) (string, error) {
+	return Peek(m, field)
+}
+
+// Peek returns a top-level string field of the json body of the message. The other fields are only scanned, not
+// decoded. It returns an error if the field is missing or not a string
+func Peek(m Message, field string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := m.Decode(&fields); err != nil {
+		return "", ErrMarshal.Context(err)
+	}
+
+	raw, ok := fields[field]
+	if !ok {
+		return "", ErrMarshal.Context(fmt.Errorf("field %s not found", field))
+	}
+
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", ErrMarshal.Context(err)
+	}
+
+	return v, nil
+}
+
 // DecodeModified is used for decoding the modification message, it will populate the body with the actual message and a
 // map[string]interface{} to view original values from that message
 func (m *message) DecodeModified(body, changes interface{}) error {
@@ -61,28 +299,369 @@ func (m *message) DecodeModified(body, changes interface{}) error {
 // ErrorResponse is used to determine for error handling within the handler. When an error occurs,
 // this function should be returned.
 func (m *message) ErrorResponse(ctx context.Context, err error) error {
-	go func() {
-		m.err <- err
-	}()
+	m.finish()
 	return err
 }
 
 // Success is used to determine that a handler was successful in processing the message and the message should
 // now be consumed. This will delete the message from the queue
 func (m *message) Success(ctx context.Context) error {
-	go func() {
-		m.err <- nil
-	}()
+	m.finish()
+	return nil
+}
+
+// finish stops the visibility extension of the message, it waits for an extension request that is in progress
+func (m *message) finish() {
+	m.extendMu.Lock()
+	defer m.extendMu.Unlock()
+
+	m.doneOnce.Do(func() {
+		close(m.done)
+	})
+}
+
+// Commit deletes the message from the queue right away and returns the result, making the delete an explicit and
+// observable step of the handler. A committed message is not deleted again when the handler returns
+func (m *message) Commit(ctx context.Context) error {
+	m.commitMu.Lock()
+	defer m.commitMu.Unlock()
 
+	if m.committed {
+		return nil
+	}
+
+	if m.commit == nil {
+		return ErrUnableToDelete.Context(fmt.Errorf("the message is not being consumed"))
+	}
+
+	if err := m.commit(m); err != nil {
+		return err
+	}
+
+	m.committed = true
+	return nil
+}
+
+// DeadLetter moves the message to the DLQUrl of the config right away, e.g. when the handler knows the payload is
+// permanently bad, instead of letting it cycle through the redeliveries of the redrive policy. The message is sent to
+// the DLQ along with the configured DLQMetadata and deleted from its queue, it is not deleted again when the handler
+// returns. It returns ErrDeadLetter if no DLQUrl is configured
+func (m *message) DeadLetter(ctx context.Context) error {
+	m.commitMu.Lock()
+	defer m.commitMu.Unlock()
+
+	if m.committed {
+		return nil
+	}
+
+	if m.deadLetter == nil {
+		return ErrDeadLetter.Context(fmt.Errorf("the message is not being consumed"))
+	}
+
+	if err := m.deadLetter(ctx, m, nil); err != nil {
+		return err
+	}
+
+	m.committed = true
+	m.finish()
 	return nil
 }
 
+// maxVisibilityTimeout is the longest visibility timeout sqs allows in seconds
+const maxVisibilityTimeout = 43200
+
+// Defer makes the message visible again after d, rounded up to seconds and capped at the 12 hours sqs allows, instead
+// of deleting it once the handler returns. It stops the visibility extension of the message
+//
+// Returning an error from the handler fails the message, it is logged and received again once the remaining
+// visibility timeout lapses. A deferred message is not a failure and is received again after d. Unlike sending the
+// body again with MessageSelf, the message keeps its id and attributes. Every receive still counts towards the
+// maxReceiveCount of the redrive policy
+func (m *message) Defer(d time.Duration) error {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds > maxVisibilityTimeout {
+		seconds = maxVisibilityTimeout
+	}
+
+	return m.reschedule(context.Background(), seconds)
+}
+
+// Ack deletes the message from the queue, it is equivalent to Commit. Use it with HandlerOptions.ManualAck to complete
+// a message once asynchronous work finished. An acked message is not deleted again when the handler returns
+func (m *message) Ack(ctx context.Context) error {
+	return m.Commit(ctx)
+}
+
+// Nack releases the message to be received again right away instead of deleting it. Unlike returning an error from the
+// handler it is not logged as a failure, and the message does not wait for its visibility timeout to lapse. Every
+// receive still counts towards the maxReceiveCount of the redrive policy
+func (m *message) Nack(ctx context.Context) error {
+	return m.reschedule(ctx, 0)
+}
+
+// reschedule makes the message visible again after the given seconds and stops its visibility extension, the message
+// is not deleted when the handler returns
+func (m *message) reschedule(ctx context.Context, seconds int64) error {
+	m.commitMu.Lock()
+	defer m.commitMu.Unlock()
+
+	if m.changeVisibility == nil {
+		return ErrUnableToExtend.Context(fmt.Errorf("the message is not being consumed"))
+	}
+
+	// an extension must not override the deferred visibility
+	m.finish()
+	if err := m.changeVisibility(ctx, m, seconds); err != nil {
+		return err
+	}
+
+	m.deferred = true
+	return nil
+}
+
+// Extend sets the visibility timeout of the message to the given seconds from now, capped at the 12 hours sqs allows.
+// The automatic extensions continue on their own schedule, disable them with HandlerOptions.WithoutExtension when the
+// handler manages the visibility itself
+func (m *message) Extend(ctx context.Context, seconds int) error {
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds > maxVisibilityTimeout {
+		seconds = maxVisibilityTimeout
+	}
+
+	m.commitMu.Lock()
+	changeVisibility := m.changeVisibility
+	m.commitMu.Unlock()
+
+	if changeVisibility == nil {
+		return ErrUnableToExtend.Context(fmt.Errorf("the message is not being consumed"))
+	}
+
+	m.extendMu.Lock()
+	defer m.extendMu.Unlock()
+
+	return changeVisibility(ctx, m, int64(seconds))
+}
+
+// isDeferred determines whether the message was rescheduled using Defer
+func (m *message) isDeferred() bool {
+	m.commitMu.Lock()
+	defer m.commitMu.Unlock()
+
+	return m.deferred
+}
+
+// isCommitted determines whether the message was deleted using Commit
+func (m *message) isCommitted() bool {
+	m.commitMu.Lock()
+	defer m.commitMu.Unlock()
+
+	return m.committed
+}
+
 // Attribute will return the attrubute that was sent with the request.
 func (m *message) Attribute(key string) string {
 	id, ok := m.MessageAttributes[key]
-	if !ok {
+	if !ok || id.StringValue == nil {
 		return ""
 	}
 
 	return *id.StringValue
 }
+
+// AttributeInt returns the value of a Number attribute
+func (m *message) AttributeInt(key string) (int, error) {
+	val, err := m.typedAttribute(key, DataTypeNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, ErrAttributeType.Context(fmt.Errorf("%s: %w", key, err))
+	}
+
+	return n, nil
+}
+
+// AttributeBool returns the value of a String attribute holding a boolean
+func (m *message) AttributeBool(key string) (bool, error) {
+	val, err := m.typedAttribute(key, DataTypeString)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, ErrAttributeType.Context(fmt.Errorf("%s: %w", key, err))
+	}
+
+	return b, nil
+}
+
+// typedAttribute returns the value of the attribute if its datatype is of the expected type, custom types such as
+// Number.int are accepted as well
+func (m *message) typedAttribute(key string, expected dataType) (string, error) {
+	attr, ok := m.MessageAttributes[key]
+	if !ok || attr.StringValue == nil {
+		return "", ErrAttributeNotFound.Context(fmt.Errorf("%s", key))
+	}
+
+	dt := aws.StringValue(attr.DataType)
+	if dt != expected.String() && !strings.HasPrefix(dt, expected.String()+".") {
+		return "", ErrAttributeType.Context(fmt.Errorf("%s is a %s, not a %s", key, dt, expected))
+	}
+
+	return *attr.StringValue, nil
+}
+
+// FirstReceiveTime returns the time the message was first received from the queue. It returns the zero time
+// if it is unknown
+func (m *message) FirstReceiveTime() time.Time {
+	return m.systemTime(sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp)
+}
+
+// Age returns how long ago the message was sent. The time between sending and receiving is measured by comparing the
+// SentTimestamp of AWS with the local clock, if the local clock is behind the age at receipt is taken as 0 instead of
+// going negative. The time since receiving is measured with the monotonic clock and is not affected by skew
+func (m *message) Age() time.Duration {
+	sent := m.systemTime(sqs.MessageSystemAttributeNameSentTimestamp)
+	if sent.IsZero() {
+		return 0
+	}
+
+	now := m.now()
+	received := m.receivedAt
+	if received.IsZero() {
+		received = now
+	}
+
+	age := received.Sub(sent)
+	if age < 0 {
+		age = 0
+	}
+
+	return age + now.Sub(received)
+}
+
+// now returns the current time of the clock of the consumer
+func (m *message) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock()
+}
+
+// TraceHeader returns the AWS X-Ray trace header the message was sent with, it is empty if the message is not traced
+func (m *message) TraceHeader() string {
+	return aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameAwstraceHeader])
+}
+
+// ReceiveCount returns the amount of times the message has been received including the current receive, based on the
+// ApproximateReceiveCount of sqs. It is 0 if it is unknown
+func (m *message) ReceiveCount() int {
+	v, ok := m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]
+	if !ok || v == nil {
+		return 0
+	}
+
+	n, err := strconv.Atoi(*v)
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// systemTime parses a system attribute holding a timestamp in epoch milliseconds
+func (m *message) systemTime(name string) time.Time {
+	v, ok := m.Attributes[name]
+	if !ok || v == nil {
+		return time.Time{}
+	}
+
+	ms, err := strconv.ParseInt(*v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// DecodeAttributes populates the fields of the supplied struct pointer with the message attributes named in
+// their `sqsattr` tags. String and number fields are supported
+func (m *message) DecodeAttributes(out interface{}) error {
+	return DecodeAttributes(m, out)
+}
+
+// DecodeAttributes populates the fields of the supplied struct pointer with the attributes of the message named in
+// their `sqsattr` tags, e.g.
+//
+//	type Ctx struct {
+//		TenantID string `sqsattr:"tenant_id"`
+//		Retries  int    `sqsattr:"retries"`
+//	}
+//
+// String and number fields are supported. Attributes that are not present on the message leave the field untouched,
+// unexported fields are skipped
+func DecodeAttributes(m Message, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrInvalidTarget
+	}
+
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("sqsattr")
+		// unexported fields cannot be set, they are skipped like fields without a tag
+		if key == "" || key == "-" || !rv.Field(i).CanSet() {
+			continue
+		}
+
+		val := m.Attribute(key)
+		if val == "" {
+			continue
+		}
+
+		if err := setAttributeField(rv.Field(i), val); err != nil {
+			return ErrInvalidVal.Context(fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	return nil
+}
+
+// setAttributeField converts the attribute value to the kind of the field and sets it
+func setAttributeField(f reflect.Value, val string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+
+	return nil
+}
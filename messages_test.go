@@ -0,0 +1,333 @@
+package gosqs
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// snsNotification is a realistic body of a message delivered by SNS without raw message delivery
+const snsNotification = `{
+  "Type" : "Notification",
+  "MessageId" : "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+  "TopicArn" : "arn:aws:sns:us-west-1:000000000000:todolist-dev",
+  "Subject" : "post",
+  "Message" : "{\"val\":\"val\"}",
+  "Timestamp" : "2021-02-10T19:20:12.465Z",
+  "SignatureVersion" : "1",
+  "Signature" : "EXAMPLEpH+DcEwjAPg8O9mY8dReBSwksfg2S7WKQcikcNKWLQjwu6A4VbeS0QHVCkhRS7fUQvi2egU3N858fiTDN6bkkOxYDVrY0Ad8L10Hs3zH81mtnPk5uvvolIC1CXGu43obcgFxeL3khZl8IKvO61GWB6jI9b5+gLPoBc1Q=",
+  "SigningCertURL" : "https://sns.us-west-1.amazonaws.com/SimpleNotificationService-010a507c1833636cd94bdb98bd93083a.pem",
+  "UnsubscribeURL" : "https://sns.us-west-1.amazonaws.com/?Action=Unsubscribe&SubscriptionArn=arn:aws:sns:us-west-1:000000000000:todolist-dev:c7d2e5a6-bd0e-4bfa-9c4c-4ab0f5b7d6c4",
+  "MessageAttributes" : {
+    "route" : {"Type":"String","Value":"post_created"},
+    "correlationId" : {"Type":"String","Value":"abc-123"},
+    "retries" : {"Type":"Number","Value":"3"}
+  }
+}`
+
+func TestSNSEnvelopeAttributes(t *testing.T) {
+	m := newMessage(&sqs.Message{Body: aws.String(snsNotification)})
+
+	if m.Route() != "post_created" {
+		t.Errorf("unexpected route, expected post_created, got %s", m.Route())
+	}
+
+	if v := m.Attribute("correlationId"); v != "abc-123" {
+		t.Errorf("unexpected attribute, expected abc-123, got %s", v)
+	}
+
+	if v := m.Attribute("retries"); v != "3" {
+		t.Errorf("unexpected attribute, expected 3, got %s", v)
+	}
+
+	if dt := *m.MessageAttributes["retries"].DataType; dt != DataTypeNumber.String() {
+		t.Errorf("did not retain the datatype, expected %s, got %s", DataTypeNumber, dt)
+	}
+
+	var ts testStruct
+	if err := m.Decode(&ts); err != nil {
+		t.Fatalf("unable to decode the unwrapped message, got %v", err)
+	}
+
+	if ts.Val != "val" {
+		t.Errorf("did not properly apply value body, got %s", ts.Val)
+	}
+
+	t.Run("sqs_attributes_take_precedence", func(t *testing.T) {
+		m := newMessage(&sqs.Message{Body: aws.String(snsNotification), MessageAttributes: defaultSQSAttributes("post_updated")})
+		if m.Route() != "post_updated" {
+			t.Errorf("unexpected route, expected post_updated, got %s", m.Route())
+		}
+	})
+
+	t.Run("raw_delivery", func(t *testing.T) {
+		m := newMessage(&sqs.Message{Body: aws.String(`{"val":"val"}`), MessageAttributes: defaultSQSAttributes("post_created")})
+		if m.envelope != nil {
+			t.Fatalf("detected an envelope in a raw message")
+		}
+
+		if m.Route() != "post_created" {
+			t.Errorf("unexpected route, expected post_created, got %s", m.Route())
+		}
+	})
+}
+
+func TestSNSMeta(t *testing.T) {
+	m := newMessage(&sqs.Message{Body: aws.String(snsNotification)})
+
+	meta := m.SNSMeta()
+	if meta.TopicArn != "arn:aws:sns:us-west-1:000000000000:todolist-dev" {
+		t.Errorf("unexpected topic arn, got %s", meta.TopicArn)
+	}
+
+	if meta.Subject != "post" {
+		t.Errorf("unexpected subject, expected post, got %s", meta.Subject)
+	}
+
+	expected := time.Date(2021, 2, 10, 19, 20, 12, 465000000, time.UTC)
+	if !meta.Timestamp.Equal(expected) {
+		t.Errorf("unexpected timestamp, expected %s, got %s", expected, meta.Timestamp)
+	}
+
+	t.Run("raw_delivery", func(t *testing.T) {
+		m := newMessage(&sqs.Message{Body: aws.String(`{"val":"val"}`), MessageAttributes: defaultSQSAttributes("post_created")})
+		if meta := m.SNSMeta(); meta != (SNSMeta{}) {
+			t.Errorf("expected empty metadata, got %+v", meta)
+		}
+	})
+}
+
+func TestTypedAttributes(t *testing.T) {
+	st, nt := DataTypeString.String(), DataTypeNumber.String()
+	attrs := defaultSQSAttributes("post_created",
+		customAttribute{"retries", nt, "3"},
+		customAttribute{"score", nt, "1.5"},
+		customAttribute{"shard", "Number.int", "7"},
+		customAttribute{"beta", st, "true"},
+		customAttribute{"tenant_id", st, "tenant"},
+	)
+	m := newMessage(&sqs.Message{Body: aws.String(`{}`), MessageAttributes: attrs})
+
+	if n, err := m.AttributeInt("retries"); err != nil || n != 3 {
+		t.Errorf("expected 3, got %d %v", n, err)
+	}
+
+	if n, err := m.AttributeInt("shard"); err != nil || n != 7 {
+		t.Errorf("expected the custom number type to be accepted, got %d %v", n, err)
+	}
+
+	if b, err := m.AttributeBool("beta"); err != nil || !b {
+		t.Errorf("expected true, got %t %v", b, err)
+	}
+
+	cases := []struct {
+		name     string
+		get      func() error
+		expected *SQSError
+	}{
+		{"int_missing", func() error { _, err := m.AttributeInt("missing"); return err }, ErrAttributeNotFound},
+		{"int_string", func() error { _, err := m.AttributeInt("tenant_id"); return err }, ErrAttributeType},
+		{"int_float", func() error { _, err := m.AttributeInt("score"); return err }, ErrAttributeType},
+		{"bool_missing", func() error { _, err := m.AttributeBool("missing"); return err }, ErrAttributeNotFound},
+		{"bool_number", func() error { _, err := m.AttributeBool("retries"); return err }, ErrAttributeType},
+		{"bool_string", func() error { _, err := m.AttributeBool("tenant_id"); return err }, ErrAttributeType},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.get()
+			if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != tc.expected.Err {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestDecodeAttributes(t *testing.T) {
+	st, nt := DataTypeString.String(), DataTypeNumber.String()
+	attrs := defaultSQSAttributes("post_created",
+		customAttribute{"tenant_id", st, "tenant"},
+		customAttribute{"retries", nt, "3"},
+		customAttribute{"score", nt, "1.5"},
+	)
+	m := newMessage(&sqs.Message{Body: aws.String(`{}`), MessageAttributes: attrs})
+
+	var out struct {
+		TenantID string  `sqsattr:"tenant_id"`
+		Retries  int     `sqsattr:"retries"`
+		Score    float64 `sqsattr:"score"`
+		Route    string  `sqsattr:"route"`
+		Missing  string  `sqsattr:"missing"`
+		Ignored  string
+	}
+
+	if err := m.DecodeAttributes(&out); err != nil {
+		t.Fatalf("unable to decode attributes, got %v", err)
+	}
+
+	if out.TenantID != "tenant" {
+		t.Errorf("expected tenant, got %s", out.TenantID)
+	}
+	if out.Retries != 3 {
+		t.Errorf("expected 3, got %d", out.Retries)
+	}
+	if out.Score != 1.5 {
+		t.Errorf("expected 1.5, got %f", out.Score)
+	}
+	if out.Route != "post_created" {
+		t.Errorf("expected post_created, got %s", out.Route)
+	}
+	if out.Missing != "" || out.Ignored != "" {
+		t.Errorf("populated fields without attributes, got %+v", out)
+	}
+
+	t.Run("type_mismatch", func(t *testing.T) {
+		var out struct {
+			TenantID int `sqsattr:"tenant_id"`
+		}
+		if err := m.DecodeAttributes(&out); err == nil {
+			t.Fatalf("expected an error decoding a string into an int")
+		}
+	})
+
+	t.Run("unexported", func(t *testing.T) {
+		var out struct {
+			TenantID string `sqsattr:"tenant_id"`
+			retries  int    `sqsattr:"retries"`
+		}
+		if err := m.DecodeAttributes(&out); err != nil {
+			t.Fatalf("expected unexported fields to be skipped, got %v", err)
+		}
+
+		if out.TenantID != "tenant" || out.retries != 0 {
+			t.Errorf("expected only the exported field to be populated, got %+v", out)
+		}
+	})
+
+	t.Run("invalid_target", func(t *testing.T) {
+		var out struct{}
+		if err := m.DecodeAttributes(out); err != ErrInvalidTarget {
+			t.Fatalf("expected %v, got %v", ErrInvalidTarget, err)
+		}
+	})
+}
+
+func TestFirstReceiveTime(t *testing.T) {
+	m := newStubMessage("post_created", `{}`)
+	if !m.FirstReceiveTime().IsZero() {
+		t.Errorf("expected the zero time without the system attribute, got %v", m.FirstReceiveTime())
+	}
+
+	m.Attributes = map[string]*string{
+		sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: aws.String("1612984812465"),
+	}
+
+	expected := time.Unix(1612984812, 465*int64(time.Millisecond))
+	if !m.FirstReceiveTime().Equal(expected) {
+		t.Errorf("unexpected time, expected %v, got %v", expected, m.FirstReceiveTime())
+	}
+}
+
+func TestReceiveCount(t *testing.T) {
+	m := newStubMessage("post_created", `{}`)
+	if n := m.ReceiveCount(); n != 0 {
+		t.Errorf("expected 0 without the system attribute, got %d", n)
+	}
+
+	m.Attributes = map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3")}
+	if n := m.ReceiveCount(); n != 3 {
+		t.Errorf("unexpected receive count, expected 3, got %d", n)
+	}
+}
+
+func TestAge(t *testing.T) {
+	now := time.Unix(1612984812, 0)
+	sent := func(t time.Time) map[string]*string {
+		return map[string]*string{
+			sqs.MessageSystemAttributeNameSentTimestamp: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)),
+		}
+	}
+
+	c, _ := getStubConsumer(t, nil)
+	logger := &recordLogger{}
+	c.logger = logger
+	c.clock = func() time.Time { return now }
+
+	t.Run("unknown", func(t *testing.T) {
+		m := newStubMessage("post_created", `{}`)
+		c.stamp(m)
+		if age := m.Age(); age != 0 {
+			t.Errorf("expected no age without the system attribute, got %v", age)
+		}
+	})
+
+	t.Run("past", func(t *testing.T) {
+		m := newStubMessage("post_created", `{}`)
+		m.Attributes = sent(now.Add(-5 * time.Second))
+		c.stamp(m)
+		if age := m.Age(); age != 5*time.Second {
+			t.Errorf("unexpected age, expected 5s, got %v", age)
+		}
+	})
+
+	t.Run("future", func(t *testing.T) {
+		m := newStubMessage("post_created", `{}`)
+		m.Attributes = sent(now.Add(time.Minute))
+		c.stamp(m)
+		c.stamp(m)
+		if age := m.Age(); age != 0 {
+			t.Errorf("expected the skewed age to be clamped, got %v", age)
+		}
+
+		if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], ErrClockSkew.Error()) {
+			t.Errorf("expected the skew to be logged once, got %v", logger.lines)
+		}
+	})
+
+	t.Run("within_tolerance", func(t *testing.T) {
+		c, _ := getStubConsumer(t, nil)
+		logger := &recordLogger{}
+		c.logger = logger
+		c.clock = func() time.Time { return now }
+
+		m := newStubMessage("post_created", `{}`)
+		m.Attributes = sent(now.Add(500 * time.Millisecond))
+		c.stamp(m)
+		if len(logger.lines) != 0 {
+			t.Errorf("expected small skew to be tolerated, got %v", logger.lines)
+		}
+	})
+
+	t.Run("unstamped", func(t *testing.T) {
+		m := newStubMessage("post_created", `{}`)
+		m.Attributes = sent(time.Now().Add(time.Hour))
+		if age := m.Age(); age != 0 {
+			t.Errorf("expected the skewed age to be clamped, got %v", age)
+		}
+	})
+}
+
+func TestPeek(t *testing.T) {
+	m := newStubMessage("shape_created", `{"kind":"circle","radius":2,"meta":{"kind":"nested"}}`)
+
+	kind, err := m.Peek("kind")
+	if err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if kind != "circle" {
+		t.Errorf("unexpected field, expected circle, got %s", kind)
+	}
+
+	if _, err := m.Peek("missing"); err == nil || err.(*SQSError).Err != ErrMarshal.Err {
+		t.Errorf("expected %v for a missing field, got %v", ErrMarshal, err)
+	}
+
+	if _, err := m.Peek("radius"); err == nil || err.(*SQSError).Err != ErrMarshal.Err {
+		t.Errorf("expected %v for a field that is not a string, got %v", ErrMarshal, err)
+	}
+}
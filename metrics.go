@@ -0,0 +1,57 @@
+package gosqs
+
+import "time"
+
+// Metrics receives the processing counters of a consumer and the publishing counters of a publisher, e.g. to feed
+// Prometheus or Datadog. Implementations are called concurrently and must be safe for concurrent use
+type Metrics interface {
+	// IncReceived is called for every message that is received from the queue
+	IncReceived()
+	// IncProcessed is called for every message whose handler succeeded
+	IncProcessed(route string)
+	// IncFailed is called for every message whose handler returned an error
+	IncFailed(route string, err error)
+	// IncDeleted is called for every message that is deleted from the queue
+	IncDeleted()
+	// IncDeleteFailed is called for every message that could not be deleted from the queue
+	IncDeleteFailed()
+	// IncExtended is called for every visibility extension of a message
+	IncExtended(route string)
+	// ObserveLatency is called with the time the handler took to process a message, or a batch of messages
+	ObserveLatency(route string, d time.Duration)
+	// IncPublished is called for every notification or direct message that was sent, a notification counts once per
+	// destination topic
+	IncPublished(event string)
+	// IncPublishFailed is called for every notification or direct message that could not be sent once the retries
+	// were exhausted
+	IncPublishFailed(event string)
+}
+
+// noopMetrics discards the counters, it is used when no Metrics are configured
+type noopMetrics struct{}
+
+func (noopMetrics) IncReceived()                                 {}
+func (noopMetrics) IncProcessed(route string)                    {}
+func (noopMetrics) IncFailed(route string, err error)            {}
+func (noopMetrics) IncDeleted()                                  {}
+func (noopMetrics) IncDeleteFailed()                             {}
+func (noopMetrics) IncExtended(route string)                     {}
+func (noopMetrics) ObserveLatency(route string, d time.Duration) {}
+func (noopMetrics) IncPublished(event string)                    {}
+func (noopMetrics) IncPublishFailed(event string)                {}
+
+// meter returns the configured Metrics, the counters are discarded if none are configured
+func (c *consumer) meter() Metrics {
+	if c.metrics == nil {
+		return noopMetrics{}
+	}
+	return c.metrics
+}
+
+// meter returns the configured Metrics, the counters are discarded if none are configured
+func (p *publisher) meter() Metrics {
+	if p.metrics == nil {
+		return noopMetrics{}
+	}
+	return p.metrics
+}
@@ -0,0 +1,150 @@
+package gosqs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// recordMetrics counts the calls of every metric by name and route
+type recordMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (r *recordMetrics) inc(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.counts == nil {
+		r.counts = map[string]int{}
+	}
+	r.counts[name]++
+}
+
+func (r *recordMetrics) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.counts[name]
+}
+
+func (r *recordMetrics) IncReceived()                      { r.inc("received") }
+func (r *recordMetrics) IncProcessed(route string)         { r.inc("processed:" + route) }
+func (r *recordMetrics) IncFailed(route string, err error) { r.inc("failed:" + route) }
+func (r *recordMetrics) IncDeleted()                       { r.inc("deleted") }
+func (r *recordMetrics) IncDeleteFailed()                  { r.inc("delete_failed") }
+func (r *recordMetrics) IncExtended(route string)          { r.inc("extended:" + route) }
+func (r *recordMetrics) ObserveLatency(route string, d time.Duration) {
+	r.inc("latency:" + route)
+}
+func (r *recordMetrics) IncPublished(event string)     { r.inc("published:" + event) }
+func (r *recordMetrics) IncPublishFailed(event string) { r.inc("publish_failed:" + event) }
+
+func TestMetrics(t *testing.T) {
+	var once sync.Once
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name == "ReceiveMessage" {
+			once.Do(func() {
+				r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{
+					newStubMessage("post_published", `{}`).Message,
+					newStubMessage("post_published", `{}`).Message,
+					newStubMessage("post_failed", `{}`).Message,
+				}
+			})
+		}
+	})
+	metrics := &recordMetrics{}
+	c.metrics = metrics
+	c.exitAfterIdle = 1
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+	c.RegisterHandlerWithOptions("post_failed", err, HandlerOptions{WithoutExtension: true})
+
+	c.Consume()
+
+	expected := map[string]int{
+		"received":                 3,
+		"processed:post_published": 2,
+		"latency:post_published":   2,
+		"failed:post_failed":       1,
+		"latency:post_failed":      1,
+		"deleted":                  2,
+	}
+	for name, n := range expected {
+		if got := metrics.count(name); got != n {
+			t.Errorf("unexpected %s, expected %d, got %d", name, n, got)
+		}
+	}
+
+	t.Run("extended", func(t *testing.T) {
+		m := newStubMessage("post_published", `{}`)
+		if !c.extendVisibility(context.Background(), m, 30) {
+			t.Fatal("expected the visibility to be extended")
+		}
+
+		if n := metrics.count("extended:post_published"); n != 1 {
+			t.Errorf("expected the extension to be counted, got %d", n)
+		}
+	})
+
+	t.Run("delete_failed", func(t *testing.T) {
+		c, _ := getStubConsumer(t, func(r *request.Request) {
+			if r.Operation.Name == "DeleteMessage" {
+				r.Error = awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, "invalid receipt handle", nil)
+				r.Retryable = aws.Bool(false)
+			}
+		})
+		c.metrics = metrics
+
+		if err := c.delete(newStubMessage("post_published", `{}`)); err == nil {
+			t.Fatal("expected the delete to fail")
+		}
+
+		if n := metrics.count("delete_failed"); n != 1 {
+			t.Errorf("expected the failed delete to be counted, got %d", n)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		c.metrics = nil
+		if _, ok := c.meter().(noopMetrics); !ok {
+			t.Errorf("expected the counters to be discarded by default, got %T", c.meter())
+		}
+	})
+}
+
+func TestPublishMetrics(t *testing.T) {
+	p, _ := getStubPublisher(t, func(r *request.Request) {
+		if strings.Contains(*r.Params.(*sns.PublishInput).Message, "failed") {
+			r.Error = awserr.New(sns.ErrCodeInternalErrorException, "internal error", nil)
+			r.Retryable = aws.Bool(false)
+		}
+	})
+	metrics := &recordMetrics{}
+	p.metrics = metrics
+
+	p.DispatchBatch([]Notifier{&sample{Val: "ok"}, &sample{Val: "ok"}, &sample{Val: "failed"}}, "published")
+
+	if n := metrics.count("published:sample_published"); n != 2 {
+		t.Errorf("expected the sent notifications to be counted, got %d", n)
+	}
+
+	if n := metrics.count("publish_failed:sample_published"); n != 1 {
+		t.Errorf("expected the failed notification to be counted once, got %d", n)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		p.metrics = nil
+		if _, ok := p.meter().(noopMetrics); !ok {
+			t.Errorf("expected the counters to be discarded by default, got %T", p.meter())
+		}
+	})
+}
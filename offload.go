@@ -0,0 +1,101 @@
+package gosqs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// LargePayloadAttribute is the attribute holding the size of a body that was offloaded to S3, it is the attribute the
+// Amazon SQS Extended Client uses so messages can be exchanged with it
+const LargePayloadAttribute = "SQSLargePayloadSize"
+
+// payloadPointerClass identifies a pointer to an offloaded body in the format of the Amazon SQS Extended Client
+const payloadPointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+
+// payloadPointer is the location of an offloaded body, it is sent as the body of the message instead
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// offload uploads a body that would push the message beyond the size limit of sqs to the bucket and returns a pointer
+// to the object as the body, along with the attribute marking the message as offloaded. The body is returned as is if
+// it fits or no bucket is configured
+func offload(client S3API, bucket, body, event string, ca []customAttribute) (string, []customAttribute, error) {
+	if client == nil || bucket == "" || messageSize(body, event, ca) <= maxMessageSize {
+		return body, ca, nil
+	}
+
+	key, err := payloadKey()
+	if err != nil {
+		return "", nil, ErrOffload.Context(err)
+	}
+
+	if _, err := client.PutObject(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), Body: strings.NewReader(body)}); err != nil {
+		return "", nil, ErrOffload.Context(err)
+	}
+
+	pointer, err := json.Marshal([]interface{}{payloadPointerClass, payloadPointer{Bucket: bucket, Key: key}})
+	if err != nil {
+		return "", nil, ErrOffload.Context(err)
+	}
+
+	size := customAttribute{LargePayloadAttribute, DataTypeNumber.String(), strconv.Itoa(len(body))}
+	return string(pointer), append(append(make([]customAttribute, 0, len(ca)+1), ca...), size), nil
+}
+
+// payloadKey creates a random key for an offloaded body
+func payloadKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// fetchOffloaded replaces the pointer in the body of an offloaded message with the body it points to, handlers are
+// unaware of the offloading. Messages that were not offloaded are left as is
+func (c *consumer) fetchOffloaded(ctx context.Context, m *message) error {
+	if m.Attribute(LargePayloadAttribute) == "" {
+		return nil
+	}
+
+	var pointer []json.RawMessage
+	if err := json.Unmarshal(m.payload, &pointer); err != nil || len(pointer) != 2 {
+		return ErrOffload.Context(fmt.Errorf("malformed payload pointer: %s", m.payload))
+	}
+
+	var p payloadPointer
+	if err := json.Unmarshal(pointer[1], &p); err != nil || p.Bucket == "" || p.Key == "" {
+		return ErrOffload.Context(fmt.Errorf("malformed payload pointer: %s", m.payload))
+	}
+
+	if c.s3 == nil {
+		return ErrOffload.Context(errors.New("no s3 client to fetch the body"))
+	}
+
+	out, err := c.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(p.Bucket), Key: aws.String(p.Key)})
+	if err != nil {
+		return ErrOffload.Context(err)
+	}
+	defer out.Body.Close()
+
+	body, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return ErrOffload.Context(err)
+	}
+
+	m.payload = body
+	return nil
+}
@@ -0,0 +1,129 @@
+package gosqs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeS3 is an in-memory s3 client holding the uploaded objects by bucket and key
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.objects == nil {
+		f.objects = map[string][]byte{}
+	}
+	f.objects[*in.Bucket+"/"+*in.Key] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func TestOffload(t *testing.T) {
+	large := testStruct{Val: strings.Repeat("a", maxMessageSize)}
+
+	t.Run("round_trip", func(t *testing.T) {
+		storage := &fakeS3{}
+		sent := make(chan *sqs.SendMessageInput, 1)
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+				sent <- in
+			}
+		})
+		p.s3, p.s3Bucket = storage, "payloads"
+
+		p.Message("post-worker", "post_published", large)
+		in := <-sent
+
+		if len(*in.MessageBody) > maxMessageSize {
+			t.Fatalf("expected a pointer to be sent instead of the body, got %d bytes", len(*in.MessageBody))
+		}
+
+		if len(storage.objects) != 1 {
+			t.Fatalf("expected the body to be uploaded, got %d objects", len(storage.objects))
+		}
+
+		c, _ := getStubConsumer(t, nil)
+		c.s3 = storage
+
+		var received testStruct
+		c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+			return m.Decode(&received)
+		}, HandlerOptions{WithoutExtension: true})
+
+		m := newMessage(&sqs.Message{Body: in.MessageBody, ReceiptHandle: aws.String("receipt-handle"), MessageAttributes: in.MessageAttributes})
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if received.Val != large.Val {
+			t.Errorf("expected the handler to receive the offloaded body, got %d bytes", len(received.Val))
+		}
+	})
+
+	t.Run("small", func(t *testing.T) {
+		storage := &fakeS3{}
+		body, attributes, err := offload(storage, "payloads", `{"val":"val"}`, "post_published", nil)
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if body != `{"val":"val"}` || len(attributes) != 0 || len(storage.objects) != 0 {
+			t.Errorf("expected a body within the limit to be sent as is, got %s %v", body, attributes)
+		}
+	})
+
+	t.Run("no_bucket", func(t *testing.T) {
+		body, _, err := offload(&fakeS3{}, "", strings.Repeat("a", maxMessageSize+1), "post_published", nil)
+		if err != nil || len(body) != maxMessageSize+1 {
+			t.Errorf("expected the body to be left for ErrBodyOverflow without a bucket, got %v", err)
+		}
+	})
+
+	t.Run("missing_object", func(t *testing.T) {
+		c, _ := getStubConsumer(t, nil)
+		c.s3 = &fakeS3{}
+		c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+		m := newStubMessage("post_published", `["`+payloadPointerClass+`",{"s3BucketName":"payloads","s3Key":"missing"}]`)
+		m.MessageAttributes[LargePayloadAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("300000")}
+
+		err := c.run(context.Background(), m)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrOffload.Err {
+			t.Errorf("expected %v, got %v", ErrOffload, err)
+		}
+	})
+}
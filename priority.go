@@ -0,0 +1,126 @@
+package gosqs
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// PriorityQueue is a queue consumed by a priority consumer
+type PriorityQueue struct {
+	// Name of the queue, it is resolved to the queue url along with the env using QueueNameFunc, e.g. post-worker
+	Name string
+	// optional url of the queue, the name is not resolved if it is provided
+	URL string
+	// amount of consecutive receives from this queue, while it has messages, before the lower priority queues get a
+	// turn. Use it to prevent the starvation of lower priority queues. Default is 0 (always drained first)
+	Weight int
+}
+
+// priorityQueue holds the scheduling state of a queue consumed by a priority consumer
+type priorityQueue struct {
+	url    string
+	weight int
+	// streak is the amount of consecutive receives that returned messages from this queue
+	streak int
+}
+
+// NewPriorityConsumer provides a configured consumer interface that receives messages from multiple queues, listed
+// from the highest to the lowest priority, and feeds them to a single worker pool. A queue is only received from
+// when all higher priority queues are empty, unless a higher priority queue reached its weight
+//
+// Messages are deleted from and extended on the queue they were received from. MessageSelf and the redrive policy
+// use the highest priority queue. The consumer stops if any of the queues is deleted
+func NewPriorityConsumer(c Config, queues []PriorityQueue) (Consumer, error) {
+	if len(queues) == 0 {
+		return nil, ErrQueueURL
+	}
+
+	if c.SessionProvider == nil {
+		c.SessionProvider = newSession
+	}
+
+	sess, err := c.SessionProvider(c)
+	if err != nil {
+		return nil, err
+	}
+
+	cons := newConsumer(c, sqs.New(sess))
+	cons.sns = sns.New(sess)
+	if cons.s3 == nil {
+		cons.s3 = s3.New(sess)
+	}
+
+	for _, q := range queues {
+		u := q.URL
+		if u == "" {
+			name := cons.queueNameFunc(c.Env, q.Name)
+			o, err := cons.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: &name})
+			if err != nil {
+				return nil, err
+			}
+			u = *o.QueueUrl
+		}
+
+		cons.queues = append(cons.queues, &priorityQueue{url: u, weight: q.Weight})
+	}
+
+	cons.QueueURL = cons.queues[0].url
+
+	return cons, nil
+}
+
+// receivePriority receives from the queues in order of priority and returns the messages of the first queue that
+// has any. If all of them are empty, the url of the queue that was received from last is returned
+func (c *consumer) receivePriority(ctx context.Context, max int64) (*sqs.ReceiveMessageOutput, string, error) {
+	order := c.priorityOrder()
+	for i, q := range order {
+		in := receiveInput(q.url, max)
+		// only the last queue is long-polled, an empty queue must not delay receiving from the next one
+		if i < len(order)-1 {
+			in.WaitTimeSeconds = aws.Int64(0)
+		}
+
+		out, err := c.sqs.ReceiveMessageWithContext(ctx, in)
+		if err != nil {
+			return nil, q.url, err
+		}
+
+		if len(out.Messages) == 0 {
+			q.streak = 0
+			continue
+		}
+
+		for _, other := range c.queues {
+			if other != q {
+				other.streak = 0
+			}
+		}
+		q.streak++
+
+		return out, q.url, nil
+	}
+
+	return &sqs.ReceiveMessageOutput{}, order[len(order)-1].url, nil
+}
+
+// priorityOrder returns the queues in order of priority. A queue that reached its weight is moved to the end so the
+// lower priority queues get a turn
+func (c *consumer) priorityOrder() []*priorityQueue {
+	for i, q := range c.queues {
+		if q.weight == 0 || q.streak < q.weight {
+			continue
+		}
+
+		q.streak = 0
+		order := make([]*priorityQueue, 0, len(c.queues))
+		order = append(order, c.queues[:i]...)
+		order = append(order, c.queues[i+1:]...)
+		return append(order, q)
+	}
+
+	return c.queues
+}
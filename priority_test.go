@@ -0,0 +1,152 @@
+package gosqs
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	highPriority = "http://local.goaws:4100/queue/dev-high"
+	lowPriority  = "http://local.goaws:4100/queue/dev-low"
+)
+
+// getStubPriorityConsumer creates a priority consumer whose queues hold the provided amount of messages
+func getStubPriorityConsumer(t *testing.T, highWeight int, pending map[string]int) (*consumer, *[]string) {
+	var mu sync.Mutex
+	var deleted []string
+
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch in := r.Params.(type) {
+		case *sqs.ReceiveMessageInput:
+			if pending[*in.QueueUrl] == 0 {
+				return
+			}
+			pending[*in.QueueUrl]--
+			r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{{
+				Body:              aws.String(`{"val":"val"}`),
+				ReceiptHandle:     aws.String("receipt-handle"),
+				MessageAttributes: defaultSQSAttributes("post_published"),
+			}}
+		case *sqs.DeleteMessageInput:
+			deleted = append(deleted, *in.QueueUrl)
+		}
+	})
+
+	c.queues = []*priorityQueue{{url: highPriority, weight: highWeight}, {url: lowPriority}}
+	c.QueueURL = highPriority
+
+	return c, &deleted
+}
+
+func TestReceivePriority(t *testing.T) {
+	receive := func(c *consumer, n int) []string {
+		var served []string
+		for i := 0; i < n; i++ {
+			out, u, err := c.receive(context.TODO(), 10)
+			if err != nil {
+				t.Fatalf("should not return an error, got %v", err)
+			}
+
+			if len(out.Messages) == 0 {
+				served = append(served, "")
+				continue
+			}
+			served = append(served, u)
+		}
+		return served
+	}
+
+	t.Run("drains_higher_priority_first", func(t *testing.T) {
+		c, _ := getStubPriorityConsumer(t, 0, map[string]int{highPriority: 3, lowPriority: 2})
+
+		expected := []string{highPriority, highPriority, highPriority, lowPriority, lowPriority, ""}
+		if served := receive(c, 6); !reflect.DeepEqual(served, expected) {
+			t.Errorf("unexpected order, expected %v, got %v", expected, served)
+		}
+	})
+
+	t.Run("weight_prevents_starvation", func(t *testing.T) {
+		c, _ := getStubPriorityConsumer(t, 2, map[string]int{highPriority: 4, lowPriority: 2})
+
+		expected := []string{highPriority, highPriority, lowPriority, highPriority, highPriority, lowPriority, ""}
+		if served := receive(c, 7); !reflect.DeepEqual(served, expected) {
+			t.Errorf("unexpected order, expected %v, got %v", expected, served)
+		}
+	})
+
+	t.Run("weight_with_empty_lower_priority", func(t *testing.T) {
+		c, _ := getStubPriorityConsumer(t, 1, map[string]int{highPriority: 3})
+
+		expected := []string{highPriority, highPriority, highPriority, ""}
+		if served := receive(c, 4); !reflect.DeepEqual(served, expected) {
+			t.Errorf("unexpected order, expected %v, got %v", expected, served)
+		}
+	})
+}
+
+func TestConsumePriority(t *testing.T) {
+	c, deleted := getStubPriorityConsumer(t, 0, map[string]int{highPriority: 2, lowPriority: 1})
+	c.exitAfterIdle = 1
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+
+	c.Consume()
+
+	expected := map[string]int{highPriority: 2, lowPriority: 1}
+	got := map[string]int{}
+	for _, u := range *deleted {
+		got[u]++
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected messages to be deleted from the queue they were received from, expected %v, got %v", expected, got)
+	}
+}
+
+func TestPriorityConsumerOffload(t *testing.T) {
+	conf := Config{Env: "dev", SessionProvider: func(c Config) (*session.Session, error) {
+		// the clients add their own unmarshal handlers, they are cleared for each request instead
+		sess := stubSession.Copy()
+		stubClient(&sess.Handlers, &operations{}, func(r *request.Request) {
+			stubClient(&r.Handlers, &operations{}, nil)
+			if in, ok := r.Params.(*s3.GetObjectInput); ok && *in.Key == "post" {
+				r.Data.(*s3.GetObjectOutput).Body = ioutil.NopCloser(strings.NewReader(`{"val":"offloaded"}`))
+			}
+		})
+		return sess, nil
+	}}
+
+	cons, err := NewPriorityConsumer(conf, []PriorityQueue{{URL: highPriority}, {URL: lowPriority}})
+	if err != nil {
+		t.Fatalf("error creating consumer, got %v", err)
+	}
+	c := cons.(*consumer)
+
+	var received testStruct
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		return m.Decode(&received)
+	}, HandlerOptions{WithoutExtension: true})
+
+	m := newStubMessage("post_published", `["`+payloadPointerClass+`",{"s3BucketName":"payloads","s3Key":"post"}]`)
+	m.MessageAttributes[LargePayloadAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("300000")}
+
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if received.Val != "offloaded" {
+		t.Errorf("expected the handler to receive the offloaded body, got %q", received.Val)
+	}
+}
@@ -0,0 +1,125 @@
+package gosqs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// BatchResult is the outcome of publishing one of the notifiers passed to CreateBatch, UpdateBatch or DispatchBatch
+type BatchResult struct {
+	// Index is the position of the notifier in the provided slice
+	Index int
+	// Event is the event the notifier was published as, e.g. post_created
+	Event string
+	// Err is the reason the notifier was not published, it is nil if it was published to every topic
+	Err error
+}
+
+// CreateBatch publishes every notifier like Create, the modelname will be prepended to the static event, e.g
+// post_created. SNS has no batch publish in the supported sdk, each notifier is sent with a Publish call of its own and
+// up to 10 calls run concurrently. It returns once every notifier was published or failed, reporting the outcome of each
+func (p *publisher) CreateBatch(ns []Notifier) []BatchResult {
+	return p.publishBatch(ns, "created")
+}
+
+// UpdateBatch publishes every notifier like Update, the modelname will be prepended to the static event, e.g
+// post_updated. Like CreateBatch it fans out to concurrent Publish calls and reports the outcome of each notifier
+func (p *publisher) UpdateBatch(ns []Notifier) []BatchResult {
+	return p.publishBatch(ns, "updated")
+}
+
+// DispatchBatch publishes every notifier like Dispatch, the modelname will be prepended to the provided event, e.g
+// post_published. Like CreateBatch it fans out to concurrent Publish calls and reports the outcome of each notifier
+func (p *publisher) DispatchBatch(ns []Notifier, event string) []BatchResult {
+	return p.publishBatch(ns, event)
+}
+
+// publishBatch publishes the notifiers with concurrent Publish calls in chunks of 10, a chunk is sent once the
+// previous one finished so a large slice of notifiers does not flood sns
+func (p *publisher) publishBatch(ns []Notifier, action string) []BatchResult {
+	results := make([]BatchResult, len(ns))
+	for start := 0; start < len(ns); start += maxBatchEntries {
+		end := start + maxBatchEntries
+		if end > len(ns) {
+			end = len(ns)
+		}
+
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = p.publishEntry(i, ns[i], action)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	return results
+}
+
+// publishEntry publishes a single notifier to every destination topic
+func (p *publisher) publishEntry(i int, n Notifier, action string) BatchResult {
+	e, err := p.event(n, action)
+	if err != nil {
+		return BatchResult{Index: i, Err: err}
+	}
+
+	out, err := marshalBody(n, p.passthrough, p.encode)
+	if err != nil {
+		return BatchResult{Index: i, Event: e, Err: ErrMarshal.Context(err)}
+	}
+
+	out, attributes, err := prepareBody(out, e, outgoingAttributes(p.attributes, p.timestamp), p.compress, p.s3, p.s3Bucket)
+	if err != nil {
+		return BatchResult{Index: i, Event: e, Err: err}
+	}
+
+	if err := validateAttributes(out, e, attributes); err != nil {
+		return BatchResult{Index: i, Event: e, Err: err}
+	}
+
+	for _, arn := range p.destinations() {
+		arn := arn
+		err := p.publishWithRetry(&sns.PublishInput{
+			Message:           &out,
+			MessageAttributes: defaultSNSAttributes(e, attributes...),
+			TopicArn:          &arn,
+		})
+		if err != nil {
+			return BatchResult{Index: i, Event: e, Err: err}
+		}
+	}
+
+	return BatchResult{Index: i, Event: e}
+}
+
+// publishWithRetry sends the input to SNS like publish, retrying a failure after the RetryDelay. It returns the error
+// once the retries are exhausted instead of dropping the message, an oversized message is not retried and returns
+// ErrBodyOverflow
+func (p *publisher) publishWithRetry(input *sns.PublishInput) error {
+	event := publishRoute(input)
+	for retryCount := 0; ; retryCount++ {
+		err := p.publishThrottled(input)
+		if err == nil {
+			p.meter().IncPublished(event)
+			return nil
+		}
+
+		if isOversize(err) {
+			p.meter().IncPublishFailed(event)
+			return ErrBodyOverflow.Context(err)
+		}
+
+		if retryCount >= maxRetryCount {
+			p.meter().IncPublishFailed(event)
+			return ErrPublish.Context(err)
+		}
+
+		delay := retryBackoff(p.retryDelay, retryCount)
+		p.logger.Println(ErrPublish.Context(err).Error(), "retrying in", delay)
+		time.Sleep(delay)
+	}
+}
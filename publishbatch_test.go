@@ -0,0 +1,113 @@
+package gosqs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+func TestPublishBatch(t *testing.T) {
+	notifiers := func(n int) []Notifier {
+		var ns []Notifier
+		for i := 0; i < n; i++ {
+			ns = append(ns, &sample{Val: fmt.Sprintf("val%d", i)})
+		}
+		return ns
+	}
+
+	t.Run("create", func(t *testing.T) {
+		var mu sync.Mutex
+		var published []string
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			published = append(published, *r.Params.(*sns.PublishInput).MessageAttributes["route"].StringValue)
+		})
+
+		results := p.CreateBatch(notifiers(23))
+		if len(results) != 23 || len(published) != 23 {
+			t.Fatalf("expected every entry to be published, got %d results and %d publishes", len(results), len(published))
+		}
+
+		for i, res := range results {
+			if res.Index != i || res.Event != "sample_created" || res.Err != nil {
+				t.Errorf("unexpected result, got %+v", res)
+			}
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		p, _ := getStubPublisher(t, nil)
+		fake := &fakeSNS{}
+		p.sns = fake
+		p.fanout = []string{"arn:aws:sns:local:000000000000:search-dev"}
+
+		results := p.UpdateBatch(notifiers(2))
+		if len(results) != 2 || results[0].Event != "sample_updated" || results[1].Err != nil {
+			t.Errorf("unexpected results, got %+v", results)
+		}
+
+		if len(fake.published) != 4 {
+			t.Errorf("expected every entry to be published to every topic, got %d publishes", len(fake.published))
+		}
+	})
+
+	t.Run("failed_entries", func(t *testing.T) {
+		var mu sync.Mutex
+		attempts := map[string]int{}
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			body := *r.Params.(*sns.PublishInput).Message
+			attempts[body]++
+			switch {
+			case strings.Contains(body, "val1"):
+				r.Error = awserr.New(sns.ErrCodeInternalErrorException, "internal error", nil)
+				r.Retryable = aws.Bool(false)
+			case strings.Contains(body, "val2"):
+				r.Error = awserr.New(sns.ErrCodeInvalidParameterException, "Invalid parameter: Message too long", nil)
+				r.Retryable = aws.Bool(false)
+			}
+		})
+		logger := &recordLogger{}
+		p.logger = logger
+
+		ns := append(notifiers(3), &unnamed{})
+		results := p.DispatchBatch(ns, "published")
+
+		if results[0].Err != nil {
+			t.Errorf("should not return an error, got %v", results[0].Err)
+		}
+
+		if sqsErr, ok := results[1].Err.(*SQSError); !ok || sqsErr.Err != ErrPublish.Err {
+			t.Errorf("expected %v, got %v", ErrPublish, results[1].Err)
+		}
+
+		if n := attempts[`{"val":"val1"}`]; n != maxRetryCount+1 {
+			t.Errorf("expected the failed entry to be retried, got %d attempts", n)
+		}
+
+		if len(logger.lines) != maxRetryCount {
+			t.Errorf("expected every retry to be logged through the configured logger, got %v", logger.lines)
+		}
+
+		if sqsErr, ok := results[2].Err.(*SQSError); !ok || sqsErr.Err != ErrBodyOverflow.Err {
+			t.Errorf("expected %v, got %v", ErrBodyOverflow, results[2].Err)
+		}
+
+		if n := attempts[`{"val":"val2"}`]; n != 1 {
+			t.Errorf("expected the oversized entry not to be retried, got %d attempts", n)
+		}
+
+		if sqsErr, ok := results[3].Err.(*SQSError); !ok || sqsErr.Err != ErrInvalidNotifier.Err {
+			t.Errorf("expected %v, got %v", ErrInvalidNotifier, results[3].Err)
+		}
+	})
+}
@@ -1,19 +1,58 @@
 package gosqs
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"math/rand"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const maxRetryCount = 5
 
+// defaultRetryDelay is the time to wait before retrying a publish that failed after the retries of the sdk
+const defaultRetryDelay = 10 * time.Second
+
+// maxRetryBackoff caps the delay between retries unless the configured retry delay is longer
+const maxRetryBackoff = 2 * time.Minute
+
+// retryBackoff returns the delay before the retry that follows the failed attempt. It doubles the base delay with
+// every attempt and picks a random delay between half and all of it, so clients recovering from the same outage do
+// not retry in lockstep
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	if attempt > maxRetryCount {
+		attempt = maxRetryCount
+	}
+
+	limit := maxRetryBackoff
+	if base > limit {
+		limit = base
+	}
+
+	d := base << uint(attempt)
+	if d > limit || d <= 0 {
+		d = limit
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 var errDataLimit = errors.New("InvalidParameterValue: One or more parameters are invalid. Reason: Message must be shorter than 262144 bytes")
 
 // Notifier used for broadcasting messages
@@ -35,22 +74,67 @@ type Publisher interface {
 	Modify(n Notifier, changes interface{})
 	// Dispatch sends a message using a notifier, the modelname will be prepended to the provided event, e.g post_published
 	Dispatch(n Notifier, event string)
+	// CreateBatch publishes every notifier like Create with a Publish call of its own, several of them concurrently. It
+	// returns once every notifier was published or failed, reporting the outcome of each notifier
+	CreateBatch(ns []Notifier) []BatchResult
+	// UpdateBatch publishes every notifier like Update with a Publish call of its own, several of them concurrently. It
+	// returns once every notifier was published or failed, reporting the outcome of each notifier
+	UpdateBatch(ns []Notifier) []BatchResult
+	// DispatchBatch publishes every notifier like Dispatch with a Publish call of its own, several of them concurrently.
+	// It returns once every notifier was published or failed, reporting the outcome of each notifier
+	DispatchBatch(ns []Notifier, event string) []BatchResult
 	// Message sends a direct message to an individual queue, the queueName(receiver) must be provided. The event will be sent
 	// as is, no prepending will take place. No other queues will receive this message.
 	Message(queue, message string, body interface{})
+	// MessageWithDelay sends a direct message like Message that only becomes visible in the queue once the delay
+	// passed. The delay is rounded up to whole seconds, capped at 15 minutes and ignored for FIFO queues
+	MessageWithDelay(queue, message string, body interface{}, delay time.Duration)
+	// ReplayFromFile sends every message of a file written by Consumer.DumpToFile to the queue at queueURL, malformed
+	// lines are skipped. It returns the amount of messages that were sent
+	ReplayFromFile(ctx context.Context, path, queueURL string) (int, error)
+	// ReplayFromFileAt is ReplayFromFile starting at a byte offset, it returns the offset to resume a partial replay
+	ReplayFromFileAt(ctx context.Context, path, queueURL string, offset int64) (int, int64, error)
+	// MessageBatch sends direct messages to an individual queue like Message, grouping up to 10 of them into a single
+	// request. Each entry carries its own event and body
+	MessageBatch(queue string, msgs []BatchEntry)
+	// TopicARN returns the resolved ARN of the topic that notifications are published to
+	TopicARN() string
+	// EffectiveConfig returns the settings in use after the defaults were applied. Key and Secret are omitted so the
+	// result can be logged
+	EffectiveConfig() Config
 }
 
 type publisher struct {
-	sqs *sqs.SQS
-	sns *sns.SNS
+	sqs SQSAPI
+	sns SNSAPI
 
-	arn    string
-	env    string
-	sqsURL string
+	arn           string
+	fanout        []string
+	env           string
+	sqsURL        string
+	queueNameFunc func(env, name string) string
 
 	camelCase  bool
 	attributes []customAttribute
 	logger     Logger
+	limiter    *limiter
+	throttle   ThrottleBackoff
+	// passthrough sends []byte, json.RawMessage and string bodies verbatim
+	passthrough bool
+	// timestamp adds the publishedAt attribute to every message
+	timestamp bool
+	// encode encodes the bodies, json.Marshal is used if it is nil
+	encode func(v interface{}) ([]byte, error)
+	// config is the config the publisher was created with, it is used to report the effective config
+	config Config
+	// retryDelay is the base delay of the backoff before a failed publish is retried
+	retryDelay time.Duration
+	// s3 uploads bodies exceeding the size limit to s3Bucket when it is set
+	s3       S3API
+	s3Bucket string
+	// compress compresses every body with gzip
+	compress bool
+	metrics  Metrics
 }
 
 // NewPublisher creates a new SQS/SNS publisher instance
@@ -65,6 +149,26 @@ func NewPublisher(c Config) (Publisher, error) {
 		return nil, err
 	}
 
+	if c.S3Client == nil && c.S3Bucket != "" {
+		c.S3Client = s3.New(sess)
+	}
+
+	return newPublisher(c, sns.New(sess), sqs.New(sess)), nil
+}
+
+// NewPublisherWithClient creates a publisher instance using the supplied sns and sqs clients instead of creating them
+// from the config. This allows pre-configured clients or fakes to be injected, e.g. for unit tests.
+// The SessionProvider of the config is ignored
+func NewPublisherWithClient(snsClient SNSAPI, sqsClient SQSAPI, c Config) (Publisher, error) {
+	if snsClient == nil || sqsClient == nil {
+		return nil, ErrUndefinedPublisher
+	}
+
+	return newPublisher(c, snsClient, sqsClient), nil
+}
+
+// newPublisher creates a publisher with the provided clients and applies the config
+func newPublisher(c Config, snsClient SNSAPI, sqsClient SQSAPI) *publisher {
 	arn := c.TopicARN
 	if arn == "" {
 		arn = fmt.Sprintf("arn:aws:sns:%s:%s:%s-%s", c.Region, c.AWSAccountID, c.TopicPrefix, c.Env)
@@ -79,40 +183,115 @@ func NewPublisher(c Config) (Publisher, error) {
 		c.Logger = &defaultLogger{}
 	}
 
+	if c.QueueNameFunc == nil {
+		c.QueueNameFunc = defaultQueueName
+	}
+
 	pub := &publisher{
-		sqs:    sqs.New(sess),
-		sns:    sns.New(sess),
-		arn:    arn,
-		env:    c.Env,
-		sqsURL: sqsURL,
+		sqs:           sqsClient,
+		sns:           snsClient,
+		arn:           arn,
+		fanout:        c.FanOutTopicARNs,
+		env:           c.Env,
+		sqsURL:        sqsURL,
+		queueNameFunc: c.QueueNameFunc,
+		logger:        c.Logger,
+		limiter:       newLimiter(c.PublishRateLimit),
+		throttle:      c.ThrottleBackoff.withDefaults(),
+		passthrough:   c.PassthroughBodies,
+		attributes:    c.Attributes,
+		timestamp:     c.AddTimestampAttribute,
+		encode:        c.encoder(),
+		config:        c,
+		retryDelay:    c.RetryDelay,
+		s3:            c.S3Client,
+		s3Bucket:      c.S3Bucket,
+		compress:      c.Compress,
+		metrics:       c.Metrics,
 	}
 
-	return pub, nil
+	if pub.retryDelay <= 0 {
+		pub.retryDelay = defaultRetryDelay
+	}
+
+	return pub
+}
+
+// EffectiveConfig returns the settings in use after the defaults were applied. Key and Secret are omitted so the
+// result can be logged
+func (p *publisher) EffectiveConfig() Config {
+	cfg := p.config
+	cfg.Key, cfg.Secret = "", ""
+	cfg.TopicARN = p.arn
+	cfg.ThrottleBackoff = p.throttle
+	cfg.RetryDelay = p.retryDelay
+
+	return cfg
+}
+
+// TopicARN returns the resolved ARN of the topic that notifications are published to
+func (p *publisher) TopicARN() string {
+	return p.arn
 }
 
-func (p *publisher) event(n Notifier, action string) string {
+// event validates the notifier and creates the name of the event, e.g. post_created
+func (p *publisher) event(n Notifier, action string) (string, error) {
+	if err := validateNotifier(n); err != nil {
+		return "", err
+	}
+
 	if p.camelCase {
-		return fmt.Sprintf("%s%s", n.ModelName(), strings.Title(action))
+		return fmt.Sprintf("%s%s", n.ModelName(), strings.Title(action)), nil
 	}
 
-	return fmt.Sprintf("%s_%s", n.ModelName(), action)
+	return fmt.Sprintf("%s_%s", n.ModelName(), action), nil
+}
+
+// validateNotifier ensures that the notifier is not nil and has a model name, otherwise malformed events such as
+// _created would be published
+func validateNotifier(n Notifier) error {
+	if n == nil {
+		return ErrInvalidNotifier.Context(errors.New("notifier is nil"))
+	}
+
+	if v := reflect.ValueOf(n); v.Kind() == reflect.Ptr && v.IsNil() {
+		return ErrInvalidNotifier.Context(errors.New("notifier is nil"))
+	}
+
+	if strings.TrimSpace(n.ModelName()) == "" {
+		return ErrInvalidNotifier.Context(errors.New("empty model name"))
+	}
+
+	return nil
 }
 
 // Create sends a message using a notifier, the modelname will be prepended to the static event, e.g post_created
 func (p *publisher) Create(n Notifier) {
-	e := p.event(n, "created")
+	e, err := p.event(n, "created")
+	if err != nil {
+		p.logger.Println(err.Error())
+		return
+	}
 	go p.send(n, e)
 }
 
 // Delete sends a message using a notifier, the modelname will be prepended to the static event, e.g post_deleted
 func (p *publisher) Delete(n Notifier) {
-	e := p.event(n, "deleted")
+	e, err := p.event(n, "deleted")
+	if err != nil {
+		p.logger.Println(err.Error())
+		return
+	}
 	go p.send(n, e)
 }
 
 // Update sends a message using a notifier, the modelname will be prepended to the static event, e.g post_updated
 func (p *publisher) Update(n Notifier) {
-	e := p.event(n, "updated")
+	e, err := p.event(n, "updated")
+	if err != nil {
+		p.logger.Println(err.Error())
+		return
+	}
 	go p.send(n, e)
 }
 
@@ -133,36 +312,59 @@ func newModify(n Notifier, changes interface{}) *modify {
 //
 // a special decoder will need to be used to process these events
 func (p *publisher) Modify(n Notifier, changes interface{}) {
-	e := p.event(n, "modified")
+	e, err := p.event(n, "modified")
+	if err != nil {
+		p.logger.Println(err.Error())
+		return
+	}
 	go p.send(newModify(n, changes), e)
 }
 
 // Dispatch sends a message using a notifier, the modelname will be prepended to the provided event, e.g post_published
 func (p *publisher) Dispatch(n Notifier, event string) {
-	e := p.event(n, event)
+	e, err := p.event(n, event)
+	if err != nil {
+		p.logger.Println(err.Error())
+		return
+	}
 	go p.send(n, e)
 }
 
 // Message sends a direct message to an individual queue, the queueName(receiver) must be provided. The event will be sent
 // as is, no prepending will take place. No other queues will receive this message.
 func (p *publisher) Message(queue, event string, body interface{}) {
-	name := fmt.Sprintf("%s-%s", p.env, queue)
+	p.MessageWithDelay(queue, event, body, 0)
+}
+
+// MessageWithDelay sends a direct message like Message that only becomes visible in the queue once the delay passed,
+// e.g. to schedule a short reminder without running a separate scheduler
+func (p *publisher) MessageWithDelay(queue, event string, body interface{}, delay time.Duration) {
+	name := p.fullQueueName(queue)
 
-	o, err := json.Marshal(body)
+	out, err := marshalBody(body, p.passthrough, p.encode)
 	if err != nil {
 		p.logger.Println(ErrMarshal.Context(err).Error())
 		return
 	}
 
-	out := string(o)
-
 	u := p.sqsURL + name
+	out, attributes, err := prepareBody(out, event, outgoingAttributes(p.attributes, p.timestamp), p.compress, p.s3, p.s3Bucket)
+	if err != nil {
+		p.logger.Println(err.Error(), event)
+		return
+	}
+
+	if err := validateAttributes(out, event, attributes); err != nil {
+		p.logger.Println(err.Error(), event)
+		return
+	}
 
 	sqsInput := &sqs.SendMessageInput{
 		MessageBody:       &out,
-		MessageAttributes: defaultSQSAttributes(event, p.attributes...),
+		MessageAttributes: defaultSQSAttributes(event, attributes...),
 		QueueUrl:          &u,
 	}
+	applyDelay(sqsInput, delay)
 
 	go p.sendDirectMessage(sqsInput, event)
 }
@@ -170,7 +372,7 @@ func (p *publisher) Message(queue, event string, body interface{}) {
 // sendDirectMessage is used to handle sending and error failures in a separate go-routine
 //
 // AWS-SDK will use their own retry mechanism for a failed request utilizing exponential backoff. If they fail
-// then we will wait 10 seconds before trying again
+// then we will wait the RetryDelay, doubled with every retry, before trying again
 func (p *publisher) sendDirectMessage(input *sqs.SendMessageInput, event string, retryCount ...int) {
 	var c int
 	if len(retryCount) != 0 {
@@ -178,66 +380,398 @@ func (p *publisher) sendDirectMessage(input *sqs.SendMessageInput, event string,
 	}
 
 	if c > maxRetryCount {
+		p.meter().IncPublishFailed(event)
 		return
 	}
 
 	if _, err := p.sqs.SendMessage(input); err != nil {
-		if err.Error() == errDataLimit.Error() {
-			panic(ErrBodyOverflow.Context(err))
+		// an oversized message fails on every retry, it is dropped instead
+		if isOversize(err) {
+			p.logger.Println(ErrBodyOverflow.Context(err).Error(), event)
+			p.meter().IncPublishFailed(event)
+			return
 		}
 
-		log.Print(ErrPublish)
-		time.Sleep(10 * time.Second)
+		delay := retryBackoff(p.retryDelay, c)
+		p.logger.Println(ErrPublish.Context(err).Error(), "retrying in", delay)
+		time.Sleep(delay)
 		p.sendDirectMessage(input, event, c+1)
+		return
 	}
+
+	p.meter().IncPublished(event)
 }
 
-// send is used to handle sending and error failures in a separate go-routine for SNS messages
+// BatchEntry is a direct message sent with MessageBatch
+type BatchEntry struct {
+	// Event is the route of the message, it is sent as is
+	Event string
+	// Body is encoded like the body of a message sent with Message
+	Body interface{}
+}
+
+// maxBatchEntries is the most entries sqs accepts in a single batch request
+const maxBatchEntries = 10
+
+// MessageBatch sends direct messages to an individual queue like Message, grouping up to 10 of them into a single
+// request. Each entry carries its own event and body. Entries that cannot be encoded or exceed the attribute limits
+// are logged and skipped, the others are still sent
+func (p *publisher) MessageBatch(queue string, msgs []BatchEntry) {
+	for _, input := range p.batchInputs(queue, msgs) {
+		go p.sendDirectBatch(input, 0)
+	}
+}
+
+// batchInputs encodes the entries and groups them into batch requests. A request holds at most 10 entries and, like
+// a single message, at most 256KB including the attributes
+func (p *publisher) batchInputs(queue string, msgs []BatchEntry) []*sqs.SendMessageBatchInput {
+	u := p.sqsURL + p.fullQueueName(queue)
+	attributes := outgoingAttributes(p.attributes, p.timestamp)
+
+	var inputs []*sqs.SendMessageBatchInput
+	var current *sqs.SendMessageBatchInput
+	var size int
+	for i, m := range msgs {
+		out, err := marshalBody(m.Body, p.passthrough, p.encode)
+		if err != nil {
+			p.logger.Println(ErrMarshal.Context(err).Error(), m.Event)
+			continue
+		}
+
+		out, attributes, err := prepareBody(out, m.Event, attributes, p.compress, p.s3, p.s3Bucket)
+		if err != nil {
+			p.logger.Println(err.Error(), m.Event)
+			continue
+		}
+
+		if err := validateAttributes(out, m.Event, attributes); err != nil {
+			p.logger.Println(err.Error(), m.Event)
+			continue
+		}
+
+		n := messageSize(out, m.Event, attributes)
+		if current == nil || len(current.Entries) == maxBatchEntries || size+n > maxMessageSize {
+			current = &sqs.SendMessageBatchInput{QueueUrl: aws.String(u)}
+			inputs = append(inputs, current)
+			size = 0
+		}
+
+		size += n
+		current.Entries = append(current.Entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       aws.String(out),
+			MessageAttributes: defaultSQSAttributes(m.Event, attributes...),
+		})
+	}
+
+	return inputs
+}
+
+// sendDirectBatch is used to handle sending and error failures of a batch in a separate go-routine
 //
-// AWS-SDK will use their own retry mechanism for a failed request utilizing exponential backoff. If they fail
-// then we will wait 10 seconds before trying again
-func (p *publisher) send(body interface{}, event string, retryCount ...int) {
-	var c int
-	if len(retryCount) != 0 {
-		c = retryCount[0]
+// SQS reports the entries of a batch that failed individually, only those are retried after the RetryDelay.
+// Entries that failed because of the sender, e.g. an invalid body, fail on every retry and are logged instead
+func (p *publisher) sendDirectBatch(input *sqs.SendMessageBatchInput, retryCount int) {
+	if retryCount > maxRetryCount {
+		p.logger.Println(ErrPublish.Context(fmt.Errorf("%d batch entries dropped after %d retries", len(input.Entries), maxRetryCount)).Error())
+		for _, e := range input.Entries {
+			p.meter().IncPublishFailed(entryRoute(e))
+		}
+		return
 	}
 
-	if c > maxRetryCount {
+	out, err := p.sqs.SendMessageBatch(input)
+	if err != nil {
+		delay := retryBackoff(p.retryDelay, retryCount)
+		p.logger.Println(ErrPublish.Context(err).Error(), "retrying in", delay)
+		time.Sleep(delay)
+		p.sendDirectBatch(input, retryCount+1)
 		return
 	}
 
-	o, err := json.Marshal(body)
+	entries := make(map[string]*sqs.SendMessageBatchRequestEntry, len(input.Entries))
+	for _, e := range input.Entries {
+		entries[*e.Id] = e
+	}
+
+	var failed []*sqs.SendMessageBatchRequestEntry
+	for _, f := range out.Failed {
+		e, ok := entries[aws.StringValue(f.Id)]
+		if !ok {
+			continue
+		}
+
+		delete(entries, *e.Id)
+		if aws.BoolValue(f.SenderFault) {
+			p.logger.Println(ErrPublish.Context(fmt.Errorf("%s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))).Error(), entryRoute(e))
+			p.meter().IncPublishFailed(entryRoute(e))
+			continue
+		}
+
+		failed = append(failed, e)
+	}
+
+	// the remaining entries were sent
+	for _, e := range entries {
+		p.meter().IncPublished(entryRoute(e))
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	delay := retryBackoff(p.retryDelay, retryCount)
+	p.logger.Println(ErrPublish.Context(fmt.Errorf("%d batch entries failed", len(failed))).Error(), "retrying in", delay)
+	time.Sleep(delay)
+	p.sendDirectBatch(&sqs.SendMessageBatchInput{QueueUrl: input.QueueUrl, Entries: failed}, retryCount+1)
+}
+
+// publishRoute returns the route attribute of a notification
+func publishRoute(input *sns.PublishInput) string {
+	if attr, ok := input.MessageAttributes["route"]; ok {
+		return aws.StringValue(attr.StringValue)
+	}
+	return ""
+}
+
+// entryRoute returns the route attribute of a batch entry
+func entryRoute(e *sqs.SendMessageBatchRequestEntry) string {
+	if attr, ok := e.MessageAttributes["route"]; ok {
+		return aws.StringValue(attr.StringValue)
+	}
+	return ""
+}
+
+// send is used to handle sending and error failures in a separate go-routine for SNS messages
+//
+// The body is marshalled once and the same payload is published to every destination topic, each destination
+// receives its own set of attributes
+func (p *publisher) send(body interface{}, event string) {
+	out, err := marshalBody(body, p.passthrough, p.encode)
 	if err != nil {
 		panic(ErrMarshal.Context(err))
 	}
+	out, attributes, err := prepareBody(out, event, outgoingAttributes(p.attributes, p.timestamp), p.compress, p.s3, p.s3Bucket)
+	if err != nil {
+		p.logger.Println(err.Error(), event)
+		return
+	}
 
-	out := string(o)
-	snsInput := &sns.PublishInput{Message: &out,
-		MessageAttributes: defaultSNSAttributes(event, p.attributes...),
-		TopicArn:          &p.arn,
+	if err := validateAttributes(out, event, attributes); err != nil {
+		p.logger.Println(err.Error(), event)
+		return
 	}
 
-	var retrier func(input *sns.PublishInput, retryCount int)
+	for _, arn := range p.destinations() {
+		arn := arn
+		p.publish(&sns.PublishInput{
+			Message:           &out,
+			MessageAttributes: defaultSNSAttributes(event, attributes...),
+			TopicArn:          &arn,
+		}, 0)
+	}
+}
 
-	retrier = func(input *sns.PublishInput, retryCount int) {
-		if c > maxRetryCount {
-			return
+// marshalBody encodes the body of a message as json using encode, or json.Marshal if it is nil. With passthrough,
+// []byte, json.RawMessage and string bodies are already encoded and are sent verbatim instead of being encoded a
+// second time
+func marshalBody(body interface{}, passthrough bool, encode func(v interface{}) ([]byte, error)) (string, error) {
+	if passthrough {
+		switch b := body.(type) {
+		case []byte:
+			return string(b), nil
+		case json.RawMessage:
+			return string(b), nil
+		case string:
+			return b, nil
 		}
+	}
 
-		_, err = p.sns.Publish(snsInput)
-		if err != nil {
-			if err.Error() == errDataLimit.Error() {
-				panic(ErrBodyOverflow.Context(err).Error())
-			}
+	if encode == nil {
+		encode = json.Marshal
+	}
+
+	o, err := encode(body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(o), nil
+}
+
+// destinations returns the topics that notifications are published to
+func (p *publisher) destinations() []string {
+	return append([]string{p.arn}, p.fanout...)
+}
+
+// publish sends the input to SNS
+//
+// AWS-SDK will use their own retry mechanism for a failed request utilizing exponential backoff. If they fail
+// then we will wait the RetryDelay, doubled with every retry, before trying again
+func (p *publisher) publish(input *sns.PublishInput, retryCount int) {
+	event := publishRoute(input)
+	if retryCount > maxRetryCount {
+		p.meter().IncPublishFailed(event)
+		return
+	}
 
-			log.Println(ErrPublish.Context(err), " retrying in 10s")
-			time.Sleep(10 * time.Second)
-			retrier(input, retryCount+1)
+	if err := p.publishThrottled(input); err != nil {
+		// an oversized message fails on every retry, it is dropped like an oversized direct message
+		if isOversize(err) {
+			p.logger.Println(ErrBodyOverflow.Context(err).Error(), event)
+			p.meter().IncPublishFailed(event)
 			return
 		}
+
+		delay := retryBackoff(p.retryDelay, retryCount)
+		p.logger.Println(ErrPublish.Context(err).Error(), "retrying in", delay)
+		time.Sleep(delay)
+		p.publish(input, retryCount+1)
+		return
+	}
+
+	p.meter().IncPublished(event)
+}
+
+// isOversize determines whether the message was rejected for exceeding the size limit of sqs or sns. The services
+// report it differently, sns rejects it as an invalid parameter stating the message is too long
+func isOversize(err error) bool {
+	if err.Error() == errDataLimit.Error() {
+		return true
+	}
+
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case sns.ErrCodeInvalidParameterException, sns.ErrCodeInvalidParameterValueException:
+		return strings.Contains(aerr.Message(), "too long")
+	}
+
+	return false
+}
+
+// limiter paces calls to a fixed rate per second, calls exceeding the rate wait for their turn instead of being sent
+// in a burst
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newLimiter creates a limiter allowing the provided amount of calls per second, 0 or less means no limit
+func newLimiter(perSecond int) *limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	return &limiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until the next call is allowed, a nil limiter never blocks
+func (l *limiter) wait() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// publishThrottled sends the input to SNS. Publishes that are throttled are retried separately from other failures,
+// using a short exponential backoff with jitter so throughput recovers quickly once SNS stops rate-limiting
+func (p *publisher) publishThrottled(input *sns.PublishInput) error {
+	for attempt := 0; ; attempt++ {
+		p.limiter.wait()
+		_, err := p.sns.Publish(input)
+		if !request.IsErrorThrottle(err) || attempt >= p.throttle.Retries {
+			return err
+		}
+
+		time.Sleep(p.throttle.delay(attempt))
+	}
+}
+
+// PublishedAtAttribute is the name of the attribute holding the RFC3339 time a message was sent at, it is set when
+// Config.AddTimestampAttribute is enabled
+const PublishedAtAttribute = "publishedAt"
+
+// outgoingAttributes returns the custom attributes of an outgoing message. With timestamp, the current time is added
+// as the publishedAt attribute unless a custom attribute of the same name was configured
+func outgoingAttributes(ca []customAttribute, timestamp bool) []customAttribute {
+	if !timestamp {
+		return ca
+	}
+
+	for _, attr := range ca {
+		if attr.Title == PublishedAtAttribute {
+			return ca
+		}
+	}
+
+	out := make([]customAttribute, 0, len(ca)+1)
+	out = append(out, customAttribute{PublishedAtAttribute, DataTypeString.String(), time.Now().UTC().Format(time.RFC3339)})
+	return append(out, ca...)
+}
+
+// mergeAttributes returns the default attributes followed by the provided ones, the provided attributes take precedence
+// since the later of two attributes with the same title is applied
+func mergeAttributes(defaults, attributes []customAttribute) []customAttribute {
+	if len(attributes) == 0 {
+		return defaults
+	}
+
+	return append(append(make([]customAttribute, 0, len(defaults)+len(attributes)), defaults...), attributes...)
+}
+
+const (
+	// maxAttributes is the most message attributes sqs accepts, including the route
+	maxAttributes = 10
+	// maxMessageSize is the most bytes sqs accepts for the body and the attributes of a message combined
+	maxMessageSize = 262144
+)
+
+// validateAttributes checks that the route and the custom attributes of a message fit the attribute limits of sqs,
+// which otherwise rejects the message with a cryptic error. The name, data type and value of every attribute count
+// towards the size of the message
+func validateAttributes(body, event string, ca []customAttribute) error {
+	size := messageSize(body, event, ca)
+	titles := map[string]bool{"route": true}
+	for _, attr := range ca {
+		titles[attr.Title] = true
+	}
+
+	if len(titles) > maxAttributes {
+		return ErrTooManyAttributes.Context(fmt.Errorf("%d attributes including the route, at most %d are allowed", len(titles), maxAttributes))
+	}
+
+	// an oversized body is reported as ErrBodyOverflow when it is sent
+	if len(body) <= maxMessageSize && size > maxMessageSize {
+		return ErrAttributeSizeExceeded.Context(fmt.Errorf("%d bytes including attributes, at most %d are allowed", size, maxMessageSize))
+	}
+
+	return nil
+}
+
+// messageSize returns the size of a message as counted by sqs, the name, data type and value of every attribute count
+// towards it
+func messageSize(body, event string, ca []customAttribute) int {
+	size := len(body) + len("route") + len(DataTypeString) + len(event)
+	for _, attr := range ca {
+		size += len(attr.Title) + len(attr.DataType) + len(attr.Value)
 	}
 
-	retrier(snsInput, 0)
+	return size
 }
 
 // defaultSNSAttributes provides general SNS attributes that we need for every message
@@ -248,6 +782,7 @@ func defaultSNSAttributes(event string, ca ...customAttribute) map[string]*sns.M
 	}
 
 	for _, attr := range ca {
+		attr := attr
 		m[attr.Title] = &sns.MessageAttributeValue{DataType: &attr.DataType, StringValue: &attr.Value}
 	}
 
@@ -262,6 +797,7 @@ func defaultSQSAttributes(event string, ca ...customAttribute) map[string]*sqs.M
 	}
 
 	for _, attr := range ca {
+		attr := attr
 		m[attr.Title] = &sqs.MessageAttributeValue{DataType: &attr.DataType, StringValue: &attr.Value}
 	}
 
@@ -1,11 +1,21 @@
 package gosqs
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
@@ -26,10 +36,14 @@ func TestNewPublisher(t *testing.T) {
 			Hostname: "http://localhost:4100",
 			TopicARN: "arn:aws:sns:local:000000000000:todolist-dev",
 		}
-		_, err := NewPublisher(conf)
+		pub, err := NewPublisher(conf)
 		if err != nil {
 			t.Fatalf("error creating publisher, got %v", err)
 		}
+
+		if arn := pub.TopicARN(); arn != conf.TopicARN {
+			t.Errorf("did not use the provided arn, expected %s, got %s", conf.TopicARN, arn)
+		}
 	})
 
 	t.Run("without_arn", func(t *testing.T) {
@@ -46,7 +60,7 @@ func TestNewPublisher(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error creating publisher, got %v", err)
 		}
-		arn := pub.(*publisher).arn
+		arn := pub.TopicARN()
 		if arn != "arn:aws:sns:local:000000000000:todolist-dev" {
 			t.Errorf("did not properly create the arn name, expected %s, got %s", "arn:aws:sns:local:000000000000:todolist-dev", arn)
 		}
@@ -88,13 +102,56 @@ func getPublisher(t *testing.T) *publisher {
 	}
 
 	return &publisher{
-		sqs: sqs.New(sess),
-		sns: sns.New(sess),
-		arn: conf.TopicARN,
-		env: conf.Env,
+		sqs:           sqs.New(sess),
+		sns:           sns.New(sess),
+		arn:           conf.TopicARN,
+		env:           conf.Env,
+		logger:        &defaultLogger{},
+		queueNameFunc: defaultQueueName,
 	}
 }
 
+// stubSession is used by stubbed clients, checksums are disabled since stubbed responses do not carry them
+var stubSession = unit.Session.Copy(&aws.Config{DisableComputeChecksums: aws.Bool(true)})
+
+// stubClient prevents the requests of the client from leaving the process. Every request is recorded and passed
+// to respond which can populate r.Data or r.Error to emulate aws
+func stubClient(handlers *request.Handlers, ops *operations, respond func(r *request.Request)) {
+	handlers.Send.Clear()
+	handlers.Unmarshal.Clear()
+	handlers.UnmarshalMeta.Clear()
+	handlers.UnmarshalError.Clear()
+	handlers.ValidateResponse.Clear()
+	handlers.Send.PushBack(func(r *request.Request) {
+		ops.add(r.Operation.Name)
+		if respond != nil {
+			respond(r)
+		}
+	})
+}
+
+// getStubPublisher creates a publisher whose requests never leave the process
+func getStubPublisher(tb testing.TB, respond func(r *request.Request)) (*publisher, *operations) {
+	ops := &operations{}
+
+	sqsClient, snsClient := sqs.New(stubSession), sns.New(stubSession)
+	stubClient(&sqsClient.Handlers, ops, respond)
+	stubClient(&snsClient.Handlers, ops, respond)
+
+	p := &publisher{
+		sqs:    sqsClient,
+		sns:    snsClient,
+		arn:    "arn:aws:sns:local:000000000000:todolist-dev",
+		env:    "dev",
+		sqsURL: "http://local.goaws:4100/queue/",
+		logger: &defaultLogger{},
+
+		queueNameFunc: defaultQueueName,
+	}
+
+	return p, ops
+}
+
 func TestCreate(t *testing.T) {
 	p := getPublisher(t)
 	p.Create(&sample{})
@@ -199,3 +256,627 @@ func TestDefaultSQSAttributs(t *testing.T) {
 		t.Fatalf("unexpected results,\nexpected %+v,\ngot: %+v", expected, att)
 	}
 }
+
+func TestTimestampAttribute(t *testing.T) {
+	var inputs []*sns.PublishInput
+	p, _ := getStubPublisher(t, func(r *request.Request) {
+		inputs = append(inputs, r.Params.(*sns.PublishInput))
+	})
+	p.timestamp = true
+
+	p.send(&sample{Val: "val"}, "sample_created")
+
+	attr := inputs[0].MessageAttributes[PublishedAtAttribute]
+	if attr == nil {
+		t.Fatalf("expected the %s attribute to be set", PublishedAtAttribute)
+	}
+
+	if _, err := time.Parse(time.RFC3339, *attr.StringValue); err != nil {
+		t.Errorf("expected an RFC3339 timestamp, got %v", err)
+	}
+
+	t.Run("custom_attribute_precedence", func(t *testing.T) {
+		ca := []customAttribute{{PublishedAtAttribute, DataTypeString.String(), "custom"}}
+		att := defaultSQSAttributes("sample_created", outgoingAttributes(ca, true)...)
+		if v := *att[PublishedAtAttribute].StringValue; v != "custom" {
+			t.Errorf("expected the custom attribute to be retained, got %s", v)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		if att := defaultSQSAttributes("sample_created", outgoingAttributes(nil, false)...); att[PublishedAtAttribute] != nil {
+			t.Errorf("expected no timestamp, got %v", att[PublishedAtAttribute])
+		}
+	})
+}
+
+func TestSendFanOut(t *testing.T) {
+	var inputs []*sns.PublishInput
+	p, _ := getStubPublisher(t, func(r *request.Request) {
+		inputs = append(inputs, r.Params.(*sns.PublishInput))
+	})
+	p.fanout = []string{"arn:aws:sns:local:000000000000:audit-dev", "arn:aws:sns:local:000000000000:search-dev"}
+
+	p.send(&sample{Val: "val"}, "sample_created")
+
+	if len(inputs) != 3 {
+		t.Fatalf("expected 3 publishes, got %d", len(inputs))
+	}
+
+	for i, arn := range p.destinations() {
+		in := inputs[i]
+		if *in.TopicArn != arn {
+			t.Errorf("unexpected destination, expected %s, got %s", arn, *in.TopicArn)
+		}
+
+		if in.Message != inputs[0].Message {
+			t.Errorf("expected the marshalled payload to be shared across destinations")
+		}
+
+		if i > 0 && reflect.ValueOf(in.MessageAttributes).Pointer() == reflect.ValueOf(inputs[0].MessageAttributes).Pointer() {
+			t.Errorf("expected every destination to receive its own attributes")
+		}
+	}
+}
+
+// largeSample is a notifier with a payload of roughly 200KB
+type largeSample struct {
+	Rows []string `json:"rows"`
+}
+
+func (s *largeSample) ModelName() string {
+	return "large_sample"
+}
+
+func newLargeSample() *largeSample {
+	s := &largeSample{}
+	for i := 0; i < 2000; i++ {
+		s.Rows = append(s.Rows, strings.Repeat("x", 100))
+	}
+	return s
+}
+
+func fanOutPublisher(b *testing.B) *publisher {
+	p, _ := getStubPublisher(b, nil)
+	for i := 0; i < 4; i++ {
+		p.fanout = append(p.fanout, fmt.Sprintf("arn:aws:sns:local:000000000000:topic-%d", i))
+	}
+	return p
+}
+
+// BenchmarkSendFanOut publishes a 200KB body to 5 destinations, marshalling it once
+func BenchmarkSendFanOut(b *testing.B) {
+	p := fanOutPublisher(b)
+	body := newLargeSample()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.send(body, "large_sample_created")
+	}
+}
+
+// BenchmarkSendFanOutMarshalPerDestination publishes a 200KB body to 5 destinations, marshalling it for every
+// destination. It serves as the baseline for BenchmarkSendFanOut
+func BenchmarkSendFanOutMarshalPerDestination(b *testing.B) {
+	p := fanOutPublisher(b)
+	body := newLargeSample()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, arn := range p.destinations() {
+			o, err := json.Marshal(body)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			arn, out := arn, string(o)
+			p.publish(&sns.PublishInput{
+				Message:           &out,
+				MessageAttributes: defaultSNSAttributes("large_sample_created", p.attributes...),
+				TopicArn:          &arn,
+			}, 0)
+		}
+	}
+}
+
+// fakeSNS is an in-memory sns client that records the notifications it receives
+type fakeSNS struct {
+	snsiface.SNSAPI
+
+	mu        sync.Mutex
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(in *sns.PublishInput) (*sns.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, in)
+	return &sns.PublishOutput{}, nil
+}
+
+type unnamed struct{}
+
+func (u *unnamed) ModelName() string {
+	return ""
+}
+
+// recordLogger records every line that is logged
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Println(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func TestInvalidNotifier(t *testing.T) {
+	var nilSample *sample
+	cases := []struct {
+		name string
+		n    Notifier
+	}{
+		{"empty_model_name", &unnamed{}},
+		{"nil", nil},
+		{"nil_pointer", nilSample},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, ops := getStubPublisher(t, nil)
+			logger := &recordLogger{}
+			p.logger = logger
+
+			p.Create(tc.n)
+			p.Dispatch(tc.n, "published")
+
+			if _, err := p.event(tc.n, "created"); err == nil || err.(*SQSError).Err != ErrInvalidNotifier.Err {
+				t.Errorf("expected %v, got %v", ErrInvalidNotifier, err)
+			}
+
+			if len(logger.lines) != 2 || !strings.HasPrefix(logger.lines[0], ErrInvalidNotifier.Err) {
+				t.Errorf("expected the invalid notifier to be logged, got %v", logger.lines)
+			}
+
+			if len(ops.names) != 0 {
+				t.Errorf("expected nothing to be published, got %v", ops.names)
+			}
+		})
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	p, ops := getStubPublisher(t, nil)
+	p.limiter = newLimiter(20)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.send(&sample{}, "sample_created")
+		}()
+	}
+	wg.Wait()
+
+	if n := ops.count("Publish"); n != 5 {
+		t.Fatalf("expected 5 publishes, got %d", n)
+	}
+
+	// the first publish is immediate, the remaining 4 are paced 50ms apart
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Errorf("expected the burst to be paced, took %v", took)
+	}
+}
+
+func TestPublishThrottled(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	p, _ := getStubPublisher(t, func(r *request.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+		if attempts <= 2 {
+			// the sdk retries are exhausted
+			r.Error = awserr.New("Throttling", "Rate exceeded", nil)
+			r.Retryable = aws.Bool(false)
+		}
+	})
+	p.throttle = ThrottleBackoff{BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Retries: 3}
+
+	start := time.Now()
+	p.send(&sample{}, "sample_created")
+
+	if attempts != 3 {
+		t.Errorf("expected the throttled publish to be retried until it succeeds, got %d attempts", attempts)
+	}
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected the throttling backoff instead of the failure delay, took %v", took)
+	}
+}
+
+func TestPublishOversize(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		send func(p *publisher)
+	}{
+		{"notification", awserr.New(sns.ErrCodeInvalidParameterException, "Invalid parameter: Message too long", nil), func(p *publisher) {
+			p.send(&sample{}, "sample_created")
+		}},
+		{"direct_message", errDataLimit, func(p *publisher) {
+			p.sendDirectMessage(&sqs.SendMessageInput{MessageBody: aws.String(`{}`), QueueUrl: aws.String(p.sqsURL + "dev-post-worker")}, "sample_created")
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int
+			p, _ := getStubPublisher(t, func(r *request.Request) {
+				attempts++
+				r.Error = tc.err
+				r.Retryable = aws.Bool(false)
+			})
+			logger := &recordLogger{}
+			metrics := &recordMetrics{}
+			p.logger, p.metrics = logger, metrics
+
+			tc.send(p)
+
+			if attempts != 1 {
+				t.Errorf("expected the oversized message not to be retried, got %d attempts", attempts)
+			}
+
+			if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], ErrBodyOverflow.Error()) {
+				t.Errorf("expected %v to be logged, got %v", ErrBodyOverflow, logger.lines)
+			}
+
+			if n := metrics.count("publish_failed:sample_created"); n != 1 {
+				t.Errorf("expected the dropped message to be counted, got %d", n)
+			}
+		})
+	}
+}
+
+func TestIsOversize(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		oversize bool
+	}{
+		{"sqs", errDataLimit, true},
+		{"sns", awserr.New(sns.ErrCodeInvalidParameterException, "Invalid parameter: Message too long", nil), true},
+		{"sns_invalid_parameter", awserr.New(sns.ErrCodeInvalidParameterException, "Invalid parameter: TopicArn", nil), false},
+		{"throttled", awserr.New("Throttling", "Rate exceeded", nil), false},
+	}
+
+	for _, tc := range cases {
+		if isOversize(tc.err) != tc.oversize {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.oversize, !tc.oversize)
+		}
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	attributes := func(n int) []customAttribute {
+		var ca []customAttribute
+		for i := 0; i < n; i++ {
+			ca = append(ca, customAttribute{fmt.Sprintf("attr%d", i), DataTypeString.String(), "val"})
+		}
+		return ca
+	}
+
+	if err := validateAttributes(`{}`, "post_published", attributes(9)); err != nil {
+		t.Errorf("expected 10 attributes including the route to be valid, got %v", err)
+	}
+
+	err := validateAttributes(`{}`, "post_published", attributes(10))
+	if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrTooManyAttributes.Err {
+		t.Errorf("expected %v for 11 attributes, got %v", ErrTooManyAttributes, err)
+	}
+
+	if err := validateAttributes(`{}`, "post_published", append(attributes(9), attributes(1)...)); err != nil {
+		t.Errorf("expected attributes with the same name to be counted once, got %v", err)
+	}
+
+	body := strings.Repeat("a", maxMessageSize-100)
+	err = validateAttributes(body, "post_published", []customAttribute{{"trace", DataTypeString.String(), strings.Repeat("b", 100)}})
+	if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrAttributeSizeExceeded.Err {
+		t.Errorf("expected %v, got %v", ErrAttributeSizeExceeded, err)
+	}
+
+	p, _ := getStubPublisher(t, nil)
+	fake := &fakeSNS{}
+	p.sns = fake
+	p.attributes = attributes(10)
+
+	p.send(&sample{}, "sample_created")
+	if len(fake.published) != 0 {
+		t.Errorf("expected a message with too many attributes not to be published, got %d", len(fake.published))
+	}
+}
+
+func TestThrottleBackoffDelay(t *testing.T) {
+	b := ThrottleBackoff{}.withDefaults()
+	for attempt, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if d := b.delay(attempt); d < 0 || d > max {
+			t.Errorf("unexpected delay for attempt %d, expected at most %v, got %v", attempt, max, d)
+		}
+	}
+
+	if d := b.delay(40); d > b.MaxDelay {
+		t.Errorf("expected the delay to be capped at %v, got %v", b.MaxDelay, d)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	base := 10 * time.Second
+	for attempt, max := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		if d := retryBackoff(base, attempt); d < max/2 || d > max {
+			t.Errorf("unexpected delay for attempt %d, expected between %v and %v, got %v", attempt, max/2, max, d)
+		}
+	}
+
+	if d := retryBackoff(base, 40); d > maxRetryBackoff {
+		t.Errorf("expected the delay to be capped at %v, got %v", maxRetryBackoff, d)
+	}
+
+	if d := retryBackoff(5*time.Minute, 3); d > 5*time.Minute {
+		t.Errorf("expected a delay longer than the cap not to grow, got %v", d)
+	}
+
+	if d := retryBackoff(0, 3); d != 0 {
+		t.Errorf("expected no delay without a base delay, got %v", d)
+	}
+}
+
+func TestMarshalBody(t *testing.T) {
+	cases := []struct {
+		name        string
+		body        interface{}
+		passthrough string
+		encoded     string
+	}{
+		{"bytes", []byte(`{"val":"val"}`), `{"val":"val"}`, `"eyJ2YWwiOiJ2YWwifQ=="`},
+		{"raw_message", json.RawMessage(`{"val":"val"}`), `{"val":"val"}`, `{"val":"val"}`},
+		{"string", "plain text", "plain text", `"plain text"`},
+		{"struct", &sample{Val: "val"}, `{"val":"val"}`, `{"val":"val"}`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sent := make(chan string, 1)
+			p, _ := getStubPublisher(t, func(r *request.Request) {
+				if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+					sent <- *in.MessageBody
+				}
+			})
+
+			p.passthrough = true
+			p.Message("post-worker", "post_published", tc.body)
+			if body := <-sent; body != tc.passthrough {
+				t.Errorf("expected the body to be passed through, expected %s, got %s", tc.passthrough, body)
+			}
+
+			p.passthrough = false
+			p.Message("post-worker", "post_published", tc.body)
+			if body := <-sent; body != tc.encoded {
+				t.Errorf("expected the body to be encoded, expected %s, got %s", tc.encoded, body)
+			}
+		})
+	}
+
+	t.Run("send", func(t *testing.T) {
+		p, _ := getStubPublisher(t, nil)
+		fake := &fakeSNS{}
+		p.sns = fake
+		p.passthrough = true
+
+		p.send(json.RawMessage(`{"val":"val"}`), "sample_created")
+		if body := *fake.published[0].Message; body != `{"val":"val"}` {
+			t.Errorf("expected the notification body to be passed through, got %s", body)
+		}
+	})
+}
+
+func TestJSONEncoderFunc(t *testing.T) {
+	body := map[string]string{"html": "<b>&</b>"}
+
+	p, _ := getStubPublisher(t, nil)
+	fake := &fakeSNS{}
+	p.sns = fake
+
+	p.send(body, "sample_created")
+	if msg := *fake.published[0].Message; msg != `{"html":"\u003cb\u003e\u0026\u003c/b\u003e"}` {
+		t.Fatalf("expected the default encoding to escape html, got %s", msg)
+	}
+
+	p.encode = func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(buf.Bytes(), "\n"), nil
+	}
+
+	p.send(body, "sample_created")
+	if msg := *fake.published[1].Message; msg != `{"html":"<b>&</b>"}` {
+		t.Errorf("expected the custom encoder to be used, got %s", msg)
+	}
+}
+
+func TestNewPublisherWithClient(t *testing.T) {
+	if _, err := NewPublisherWithClient(nil, &fakeSQS{}, Config{}); err != ErrUndefinedPublisher {
+		t.Fatalf("expected %v without a client, got %v", ErrUndefinedPublisher, err)
+	}
+
+	fake := &fakeSNS{}
+	pub, err := NewPublisherWithClient(fake, &fakeSQS{}, Config{TopicARN: "arn:aws:sns:local:000000000000:todolist-dev"})
+	if err != nil {
+		t.Fatalf("error creating publisher, got %v", err)
+	}
+
+	pub.(*publisher).send(&sample{}, "sample_created")
+	if len(fake.published) != 1 {
+		t.Fatalf("expected the injected client to publish, got %d", len(fake.published))
+	}
+
+	if arn := *fake.published[0].TopicArn; arn != "arn:aws:sns:local:000000000000:todolist-dev" {
+		t.Errorf("unexpected topic, got %s", arn)
+	}
+}
+
+func TestPublisherEffectiveConfig(t *testing.T) {
+	pub, err := NewPublisherWithClient(&fakeSNS{}, &fakeSQS{}, Config{Key: "key", Secret: "secret", Region: "local", AWSAccountID: "000000000000", TopicPrefix: "todolist", Env: "dev"})
+	if err != nil {
+		t.Fatalf("error creating publisher, got %v", err)
+	}
+
+	cfg := pub.EffectiveConfig()
+	if cfg.TopicARN != "arn:aws:sns:local:000000000000:todolist-dev" {
+		t.Errorf("expected the resolved topic, got %s", cfg.TopicARN)
+	}
+
+	if cfg.ThrottleBackoff.Retries != 8 || cfg.RetryDelay != defaultRetryDelay || cfg.QueueNameFunc == nil || cfg.Logger == nil {
+		t.Errorf("expected the defaults to be applied, got %+v", cfg)
+	}
+
+	if cfg.Key != "" || cfg.Secret != "" {
+		t.Errorf("expected the credentials to be omitted, got %s %s", cfg.Key, cfg.Secret)
+	}
+}
+
+func TestMessageBatch(t *testing.T) {
+	entries := func(n int) []BatchEntry {
+		var msgs []BatchEntry
+		for i := 0; i < n; i++ {
+			msgs = append(msgs, BatchEntry{Event: "post_published", Body: &sample{Val: fmt.Sprintf("post%d", i)}})
+		}
+		return msgs
+	}
+
+	t.Run("groups", func(t *testing.T) {
+		p, _ := getStubPublisher(t, nil)
+
+		inputs := p.batchInputs("post-worker", entries(23))
+		if len(inputs) != 3 {
+			t.Fatalf("expected 23 entries to be sent in 3 batches, got %d", len(inputs))
+		}
+
+		for i, expected := range []int{10, 10, 3} {
+			if len(inputs[i].Entries) != expected {
+				t.Errorf("unexpected entries in batch %d, expected %d, got %d", i, expected, len(inputs[i].Entries))
+			}
+		}
+
+		if *inputs[0].QueueUrl != "http://local.goaws:4100/queue/dev-post-worker" {
+			t.Errorf("unexpected queue url, got %s", *inputs[0].QueueUrl)
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		p, _ := getStubPublisher(t, nil)
+		p.attributes = []customAttribute{{"tenant", DataTypeString.String(), "acme"}}
+
+		inputs := p.batchInputs("post-worker", []BatchEntry{{"post_published", &sample{}}, {"post_archived", &sample{}}})
+		if len(inputs) != 1 || len(inputs[0].Entries) != 2 {
+			t.Fatalf("expected a single batch of 2 entries, got %v", inputs)
+		}
+
+		for i, event := range []string{"post_published", "post_archived"} {
+			attributes := inputs[0].Entries[i].MessageAttributes
+			if entryRoute(inputs[0].Entries[i]) != event {
+				t.Errorf("unexpected route, expected %s, got %s", event, entryRoute(inputs[0].Entries[i]))
+			}
+
+			if attr, ok := attributes["tenant"]; !ok || *attr.StringValue != "acme" {
+				t.Errorf("expected the custom attributes on every entry, got %v", attributes)
+			}
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		p, _ := getStubPublisher(t, nil)
+		p.passthrough = true
+
+		large := strings.Repeat("a", maxMessageSize/2)
+		inputs := p.batchInputs("post-worker", []BatchEntry{{"post_published", large}, {"post_published", large}})
+		if len(inputs) != 2 {
+			t.Errorf("expected entries exceeding the request size to be split, got %d batches", len(inputs))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		p, _ := getStubPublisher(t, nil)
+		logger := &recordLogger{}
+		p.logger = logger
+
+		msgs := append(entries(2), BatchEntry{"post_published", make(chan int)})
+		inputs := p.batchInputs("post-worker", msgs)
+		if len(inputs) != 1 || len(inputs[0].Entries) != 2 {
+			t.Errorf("expected the valid entries to be sent, got %v", inputs)
+		}
+
+		if len(logger.lines) != 1 {
+			t.Errorf("expected the invalid entry to be logged, got %v", logger.lines)
+		}
+	})
+
+	t.Run("retries_failed_entries", func(t *testing.T) {
+		var sent [][]string
+		p, _ := getStubPublisher(t, func(r *request.Request) {
+			in := r.Params.(*sqs.SendMessageBatchInput)
+			var ids []string
+			for _, e := range in.Entries {
+				ids = append(ids, *e.Id)
+			}
+			sent = append(sent, ids)
+
+			out := r.Data.(*sqs.SendMessageBatchOutput)
+			if len(sent) == 1 {
+				out.Failed = []*sqs.BatchResultErrorEntry{
+					{Id: aws.String("1"), Code: aws.String("InternalError"), SenderFault: aws.Bool(false)},
+					{Id: aws.String("2"), Code: aws.String("InvalidMessageContents"), SenderFault: aws.Bool(true)},
+				}
+			}
+		})
+		logger := &recordLogger{}
+		p.logger = logger
+
+		inputs := p.batchInputs("post-worker", entries(3))
+		p.sendDirectBatch(inputs[0], 0)
+
+		if len(sent) != 2 {
+			t.Fatalf("expected the failed entries to be retried once, got %v", sent)
+		}
+
+		if len(sent[1]) != 1 || sent[1][0] != "1" {
+			t.Errorf("expected only the entry failed by sqs to be retried, got %v", sent[1])
+		}
+
+		// the rejected entry followed by the retry of the failed one
+		if len(logger.lines) != 2 || !strings.Contains(logger.lines[0], "InvalidMessageContents") || !strings.Contains(logger.lines[1], "retrying in") {
+			t.Errorf("expected the rejected entry and the retry to be logged, got %v", logger.lines)
+		}
+	})
+}
+
+func TestFullQueueNameFallback(t *testing.T) {
+	if name := (&publisher{env: "dev"}).fullQueueName("post-worker"); name != "dev-post-worker" {
+		t.Errorf("expected the default queue name, got %s", name)
+	}
+
+	if name := (&consumer{env: "dev"}).fullQueueName("post-worker"); name != "dev-post-worker" {
+		t.Errorf("expected the default queue name, got %s", name)
+	}
+}
@@ -0,0 +1,108 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReplyToAttribute is the message attribute naming the queue that receives the delivery receipt of a message, the
+// name is resolved along with the env like any other direct message, e.g. orchestrator
+const ReplyToAttribute = "replyTo"
+
+// CorrelationIDAttribute is the message attribute that correlates a reply or a delivery receipt with the message it
+// responds to. It is copied from the message, or set to the sqs message id if the message has none
+const CorrelationIDAttribute = "correlationId"
+
+// ReceiptRoute is the route of the delivery receipts sent to the replyTo queue
+const ReceiptRoute = "delivery_receipt"
+
+// Receipt statuses
+const (
+	// ReceiptAck is sent once the message was processed successfully
+	ReceiptAck = "ack"
+	// ReceiptNack is sent every time the handler returns an error
+	ReceiptNack = "nack"
+)
+
+// Receipt is the body of a delivery receipt, it is sent to the queue named in the replyTo attribute of a message when
+// Config.EnableReplyTo is set
+type Receipt struct {
+	// MessageID is the sqs message id of the processed message
+	MessageID string `json:"messageId"`
+	// Route is the route of the processed message
+	Route string `json:"route"`
+	// Status is either ReceiptAck or ReceiptNack
+	Status string `json:"status"`
+	// Error holds the error returned by the handler of a nack
+	Error string `json:"error,omitempty"`
+}
+
+// ReplyHandler is a handler returning a reply to the message. The reply is encoded like any other body, e.g. as json
+type ReplyHandler func(ctx context.Context, m Message) (interface{}, error)
+
+// RegisterReplyHandler registers a handler that responds to request messages, e.g. for RPC-style calls over SQS
+// between internal services. Once the handler returns successfully, its reply is sent as a direct message with the
+// route of the message suffixed with _reply, e.g. post_published_reply, to the queue named in the replyTo attribute.
+// The reply carries the correlationId attribute of the message, or its sqs message id if it has none. Messages
+// without a replyTo attribute are handled without sending a reply
+//
+// The consumer does not track timeouts. A requester waits on its own queue for the reply with the correlation id it
+// sent and should discard replies to requests it gave up on, the reply of a redelivered message may arrive more than
+// once. If the handler returns an error no reply is sent, unless EnableReplyTo is set which sends a nack receipt instead
+func (c *consumer) RegisterReplyHandler(name string, h ReplyHandler, adapters ...Adapter) {
+	c.RegisterHandler(name, func(ctx context.Context, m Message) error {
+		body, err := h(ctx, m)
+		if err != nil {
+			return err
+		}
+
+		if msg, ok := m.(*message); ok {
+			msg.replyBody, msg.replied = body, true
+		}
+		return nil
+	}, adapters...)
+}
+
+// correlationID returns the correlation id of the message, or its sqs message id if it has none
+func (m *message) correlationID() string {
+	if id := m.Attribute(CorrelationIDAttribute); id != "" {
+		return id
+	}
+
+	if m.MessageId != nil {
+		return *m.MessageId
+	}
+
+	return ""
+}
+
+// reply sends the reply of a ReplyHandler or the delivery receipt of the message to its replyTo queue. A nil err sends
+// the reply if there is one, or an ack. Otherwise a nack is sent. Receipts are not sent unless EnableReplyTo is set
+func (c *consumer) reply(ctx context.Context, m *message, err error) {
+	queue := m.Attribute(ReplyToAttribute)
+	if queue == "" {
+		return
+	}
+
+	correlation := customAttribute{CorrelationIDAttribute, DataTypeString.String(), m.correlationID()}
+	if err == nil && m.replied {
+		c.Message(ctx, queue, fmt.Sprintf("%s_reply", m.Route()), m.replyBody, correlation)
+		return
+	}
+
+	if !c.replyTo {
+		return
+	}
+
+	r := Receipt{Route: m.Route(), Status: ReceiptAck}
+	if m.MessageId != nil {
+		r.MessageID = *m.MessageId
+	}
+
+	if err != nil {
+		r.Status = ReceiptNack
+		r.Error = err.Error()
+	}
+
+	c.Message(ctx, queue, ReceiptRoute, r, correlation)
+}
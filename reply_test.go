@@ -0,0 +1,160 @@
+package gosqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestRunReplyTo(t *testing.T) {
+	receipts := make(chan *sqs.SendMessageInput, 1)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueUrlInput:
+			r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/" + *in.QueueName)
+		case *sqs.SendMessageInput:
+			receipts <- in
+		}
+	})
+	c.replyTo = true
+	c.RegisterHandlerWithOptions("post_published", test, HandlerOptions{WithoutExtension: true})
+	c.RegisterHandlerWithOptions("post_failed", err, HandlerOptions{WithoutExtension: true})
+
+	newReplyMessage := func(route string) *message {
+		m := newStubMessage(route, `{"val":"val"}`)
+		m.MessageId = aws.String("message-id")
+		m.MessageAttributes[ReplyToAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("orchestrator")}
+		return m
+	}
+
+	receipt := func(t *testing.T) Receipt {
+		in := <-receipts
+		if *in.QueueUrl != "http://local.goaws:4100/queue/dev-orchestrator" {
+			t.Errorf("unexpected receipt queue, got %s", *in.QueueUrl)
+		}
+
+		if route := *in.MessageAttributes["route"].StringValue; route != ReceiptRoute {
+			t.Errorf("unexpected receipt route, got %s", route)
+		}
+
+		var r Receipt
+		if err := json.Unmarshal([]byte(*in.MessageBody), &r); err != nil {
+			t.Fatalf("invalid receipt, got %v", err)
+		}
+		return r
+	}
+
+	t.Run("ack", func(t *testing.T) {
+		if err := c.run(context.Background(), newReplyMessage("post_published")); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		expected := Receipt{MessageID: "message-id", Route: "post_published", Status: ReceiptAck}
+		if r := receipt(t); r != expected {
+			t.Errorf("unexpected receipt, expected %+v, got %+v", expected, r)
+		}
+	})
+
+	t.Run("nack", func(t *testing.T) {
+		if err := c.run(context.Background(), newReplyMessage("post_failed")); !errors.Is(err, ErrGetMessage) {
+			t.Fatalf("expected %v, got %v", ErrGetMessage, err)
+		}
+
+		expected := Receipt{MessageID: "message-id", Route: "post_failed", Status: ReceiptNack, Error: ErrGetMessage.Error()}
+		if r := receipt(t); r != expected {
+			t.Errorf("unexpected receipt, expected %+v, got %+v", expected, r)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c.replyTo = false
+		if err := c.run(context.Background(), newReplyMessage("post_published")); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		select {
+		case in := <-receipts:
+			t.Errorf("expected no receipt, got %s", *in.MessageBody)
+		default:
+		}
+	})
+}
+
+func TestRegisterReplyHandler(t *testing.T) {
+	replies := make(chan *sqs.SendMessageInput, 1)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueUrlInput:
+			r.Data.(*sqs.GetQueueUrlOutput).QueueUrl = aws.String("http://local.goaws:4100/queue/" + *in.QueueName)
+		case *sqs.SendMessageInput:
+			replies <- in
+		}
+	})
+
+	c.RegisterReplyHandler("post_lookup", func(ctx context.Context, m Message) (interface{}, error) {
+		var in testStruct
+		if err := m.Decode(&in); err != nil {
+			return nil, err
+		}
+		return testStruct{Val: in.Val + "_found"}, nil
+	})
+
+	t.Run("reply", func(t *testing.T) {
+		m := newStubMessage("post_lookup", `{"val":"val"}`)
+		m.MessageId = aws.String("message-id")
+		m.MessageAttributes[ReplyToAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("orchestrator")}
+		m.MessageAttributes[CorrelationIDAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("abc-123")}
+
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		in := <-replies
+		if *in.QueueUrl != "http://local.goaws:4100/queue/dev-orchestrator" {
+			t.Errorf("unexpected reply queue, got %s", *in.QueueUrl)
+		}
+
+		if route := *in.MessageAttributes["route"].StringValue; route != "post_lookup_reply" {
+			t.Errorf("unexpected reply route, got %s", route)
+		}
+
+		if id := *in.MessageAttributes[CorrelationIDAttribute].StringValue; id != "abc-123" {
+			t.Errorf("expected the correlation id to be propagated, got %s", id)
+		}
+
+		if *in.MessageBody != `{"val":"val_found"}` {
+			t.Errorf("unexpected reply, got %s", *in.MessageBody)
+		}
+	})
+
+	t.Run("message_id_correlation", func(t *testing.T) {
+		m := newStubMessage("post_lookup", `{"val":"val"}`)
+		m.MessageId = aws.String("message-id")
+		m.MessageAttributes[ReplyToAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("orchestrator")}
+
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if id := *(<-replies).MessageAttributes[CorrelationIDAttribute].StringValue; id != "message-id" {
+			t.Errorf("expected the message id as correlation id, got %s", id)
+		}
+	})
+
+	t.Run("no_reply_to", func(t *testing.T) {
+		if err := c.run(context.Background(), newStubMessage("post_lookup", `{"val":"val"}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		select {
+		case in := <-replies:
+			t.Errorf("expected no reply, got %s", *in.MessageBody)
+		default:
+		}
+	})
+}
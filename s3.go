@@ -0,0 +1,89 @@
+package gosqs
+
+import (
+	"net/url"
+	"time"
+)
+
+// S3Record is a single record of an S3 event notification
+type S3Record struct {
+	// EventName is the type of the event, e.g. ObjectCreated:Put
+	EventName string
+	EventTime time.Time
+	Region    string
+	Bucket    string
+	// Key is the url decoded key of the object
+	Key       string
+	Size      int64
+	ETag      string
+	VersionID string
+}
+
+// s3Event is the json structure of an S3 event notification. It also covers the test event S3 sends when the
+// notification is configured
+type s3Event struct {
+	Event   string `json:"Event"`
+	Records []struct {
+		EventName string    `json:"eventName"`
+		EventTime time.Time `json:"eventTime"`
+		Region    string    `json:"awsRegion"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key       string `json:"key"`
+				Size      int64  `json:"size"`
+				ETag      string `json:"eTag"`
+				VersionID string `json:"versionId"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// s3TestEvent is the event S3 sends to verify the notification configuration
+const s3TestEvent = "s3:TestEvent"
+
+// DecodeS3Event parses an S3 event notification into its records. The test event S3 sends when the notification is
+// configured returns no records and no error so it can be consumed
+func (m *message) DecodeS3Event() ([]S3Record, error) {
+	return DecodeS3Event(m)
+}
+
+// DecodeS3Event parses the body of the message as an S3 event notification into its records. The test event S3 sends
+// when the notification is configured returns no records and no error so it can be consumed
+func DecodeS3Event(m Message) ([]S3Record, error) {
+	var e s3Event
+	if err := m.Decode(&e); err != nil {
+		return nil, ErrInvalidS3Event.Context(err)
+	}
+
+	if e.Event == s3TestEvent {
+		return nil, nil
+	}
+
+	if len(e.Records) == 0 {
+		return nil, ErrInvalidS3Event
+	}
+
+	records := make([]S3Record, 0, len(e.Records))
+	for _, r := range e.Records {
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, ErrInvalidS3Event.Context(err)
+		}
+
+		records = append(records, S3Record{
+			EventName: r.EventName,
+			EventTime: r.EventTime,
+			Region:    r.Region,
+			Bucket:    r.S3.Bucket.Name,
+			Key:       key,
+			Size:      r.S3.Object.Size,
+			ETag:      r.S3.Object.ETag,
+			VersionID: r.S3.Object.VersionID,
+		})
+	}
+
+	return records, nil
+}
@@ -0,0 +1,82 @@
+package gosqs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// s3Notification is a real S3 event notification as delivered to sqs
+const s3Notification = `{
+  "Records": [
+    {
+      "eventVersion": "2.1",
+      "eventSource": "aws:s3",
+      "awsRegion": "us-west-1",
+      "eventTime": "2021-02-10T19:20:12.465Z",
+      "eventName": "ObjectCreated:Put",
+      "userIdentity": {"principalId": "AWS:AIDAJDPLRKLG7UEXAMPLE"},
+      "requestParameters": {"sourceIPAddress": "127.0.0.1"},
+      "responseElements": {"x-amz-request-id": "C3D13FE58DE4C810", "x-amz-id-2": "FMyUVURIY8/IgAtTv8xRjskZQpcIZ9KG4V5Wp6S7S/JRWeUWerMUE5JgHvANOjpD"},
+      "s3": {
+        "s3SchemaVersion": "1.0",
+        "configurationId": "uploads",
+        "bucket": {"name": "todolist-uploads", "ownerIdentity": {"principalId": "A3NL1KOZZKExample"}, "arn": "arn:aws:s3:::todolist-uploads"},
+        "object": {"key": "avatars/my+photo%281%29.png", "size": 1024, "eTag": "d41d8cd98f00b204e9800998ecf8427e", "versionId": "096fKKXTRTtl3on89fVO.nfljtsv6qko", "sequencer": "0055AED6DCD90281E5"}
+      }
+    }
+  ]
+}`
+
+func TestDecodeS3Event(t *testing.T) {
+	m := newMessage(&sqs.Message{Body: aws.String(s3Notification)})
+
+	records, err := m.DecodeS3Event()
+	if err != nil {
+		t.Fatalf("unable to decode the s3 event, got %v", err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	expected := S3Record{
+		EventName: "ObjectCreated:Put",
+		EventTime: time.Date(2021, 2, 10, 19, 20, 12, 465*int(time.Millisecond), time.UTC),
+		Region:    "us-west-1",
+		Bucket:    "todolist-uploads",
+		Key:       "avatars/my photo(1).png",
+		Size:      1024,
+		ETag:      "d41d8cd98f00b204e9800998ecf8427e",
+		VersionID: "096fKKXTRTtl3on89fVO.nfljtsv6qko",
+	}
+
+	if r := records[0]; r != expected {
+		t.Errorf("unexpected record,\nexpected %+v,\ngot: %+v", expected, r)
+	}
+
+	t.Run("test_event", func(t *testing.T) {
+		m := newMessage(&sqs.Message{Body: aws.String(`{"Service":"Amazon S3","Event":"s3:TestEvent","Time":"2021-02-10T19:20:12.465Z","Bucket":"todolist-uploads","RequestId":"C3D13FE58DE4C810","HostId":"FMyUVURIY8/IgAtTv8xRjskZQpcIZ9KG4V5Wp6S7S/JRWeUWerMUE5JgHvANOjpD"}`)})
+		records, err := m.DecodeS3Event()
+		if err != nil || len(records) != 0 {
+			t.Errorf("expected no records and no error for the test event, got %v, %v", records, err)
+		}
+	})
+
+	t.Run("not_s3", func(t *testing.T) {
+		m := newMessage(&sqs.Message{Body: aws.String(`{"val":"val"}`)})
+		if _, err := m.DecodeS3Event(); err != ErrInvalidS3Event {
+			t.Errorf("expected %v, got %v", ErrInvalidS3Event, err)
+		}
+	})
+
+	t.Run("default_route", func(t *testing.T) {
+		m := newMessage(&sqs.Message{Body: aws.String(s3Notification)})
+		m.defaultRoute("s3_event")
+		if m.Route() != "s3_event" {
+			t.Errorf("expected the default route, got %s", m.Route())
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultGracePeriod is the time RunUntilSignal allows the received messages to be processed
+const defaultGracePeriod = 30 * time.Second
+
+// stopSignal returns the channel that is closed once the consumer is stopped
+func (c *consumer) stopSignal() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stop == nil {
+		c.stop = make(chan struct{})
+	}
+
+	return c.stop
+}
+
+// started records that Consume is running and returns the channel that Consume closes when it returns
+func (c *consumer) started() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done = make(chan struct{})
+	return c.done
+}
+
+// Stop stops receiving messages and waits for the received messages to be processed. It returns ErrShutdownTimeout
+// if the context is done first, the remaining messages are still processed in the background. A stopped consumer
+// cannot be started again
+//
+// Messages are tracked from the moment they are handed to a worker until their handler returns and they are deleted
+// or released, Consume returns once every worker finished
+func (c *consumer) Stop(ctx context.Context) error {
+	c.signalStop()
+
+	c.mu.RLock()
+	done := c.done
+	c.mu.RUnlock()
+
+	if done == nil {
+		// Consume was never started
+		return nil
+	}
+
+	if err := waitDone(ctx, done); err != nil {
+		return ErrShutdownTimeout.Context(fmt.Errorf("%d messages abandoned: %v", atomic.LoadInt64(&c.inFlight), ctx.Err()))
+	}
+
+	return nil
+}
+
+// Shutdown stops receiving messages and waits for the handlers of the received messages to finish, like
+// http.Server.Shutdown. If the context is done first it returns ErrShutdownTimeout stating the amount of messages
+// that were abandoned, their handlers keep running in the background. It is equivalent to Stop
+func (c *consumer) Shutdown(ctx context.Context) error {
+	return c.Stop(ctx)
+}
+
+// signalStop ends receiving messages
+func (c *consumer) signalStop() {
+	stop := c.stopSignal()
+	c.stopOnce.Do(func() {
+		close(stop)
+	})
+}
+
+// waitDone waits for the done channel to be closed or returns ErrShutdownTimeout if the context is done first
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ErrShutdownTimeout.Context(ctx.Err())
+	}
+}
+
+// RunUntilSignal consumes until SIGINT or SIGTERM is received or the context is done, then stops the consumer
+// allowing the ShutdownGracePeriod for the received messages to be processed. It returns nil once all received
+// messages have been processed, or ErrShutdownTimeout if the grace period elapsed first. If Consume returns on its
+// own, e.g. with ExitAfterIdleReceives, RunUntilSignal returns nil
+func (c *consumer) RunUntilSignal(ctx context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	return c.runUntilSignal(ctx, signals)
+}
+
+// runUntilSignal consumes until a signal is received on the channel or the context is done
+func (c *consumer) runUntilSignal(ctx context.Context, signals <-chan os.Signal) error {
+	consumed := make(chan struct{})
+	go func() {
+		c.Consume()
+		close(consumed)
+	}()
+
+	select {
+	case <-consumed:
+		return nil
+	case <-signals:
+	case <-ctx.Done():
+	}
+
+	grace, cancel := context.WithTimeout(context.Background(), c.gracePeriod)
+	defer cancel()
+
+	c.signalStop()
+	return waitDone(grace, consumed)
+}
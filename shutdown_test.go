@@ -0,0 +1,214 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// getStubRunningConsumer creates a consumer that receives a single message and then long-polls an empty queue until
+// receiving is cancelled. handled is closed once the handler starts
+func getStubRunningConsumer(t *testing.T, h Handler) (*consumer, *operations, chan struct{}) {
+	var once sync.Once
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		delivered := false
+		once.Do(func() {
+			delivered = true
+			r.Data.(*sqs.ReceiveMessageOutput).Messages = []*sqs.Message{{
+				Body:              aws.String(`{"val":"val"}`),
+				ReceiptHandle:     aws.String("receipt-handle"),
+				MessageAttributes: defaultSQSAttributes("post_published"),
+			}}
+		})
+
+		if !delivered {
+			<-r.Context().Done()
+			r.Error = r.Context().Err()
+		}
+	})
+
+	handled := make(chan struct{})
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		close(handled)
+		return h(ctx, m)
+	}, HandlerOptions{WithoutExtension: true})
+
+	return c, ops, handled
+}
+
+func TestStop(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		c, ops, handled := getStubRunningConsumer(t, func(ctx context.Context, m Message) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+
+		go c.Consume()
+		<-handled
+
+		if err := c.Stop(context.Background()); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the in-flight message to be processed, got %d deletes", n)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		release := make(chan struct{})
+		c, _, handled := getStubRunningConsumer(t, func(ctx context.Context, m Message) error {
+			<-release
+			return nil
+		})
+		defer close(release)
+
+		go c.Consume()
+		<-handled
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := c.Stop(ctx)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrShutdownTimeout.Err {
+			t.Fatalf("expected %v, got %v", ErrShutdownTimeout, err)
+		}
+	})
+
+	t.Run("shutdown_abandoned", func(t *testing.T) {
+		release := make(chan struct{})
+		c, ops, handled := getStubRunningConsumer(t, func(ctx context.Context, m Message) error {
+			<-release
+			return nil
+		})
+
+		go c.Consume()
+		<-handled
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := c.Shutdown(ctx)
+		if sqsErr, ok := err.(*SQSError); !ok || sqsErr.Err != ErrShutdownTimeout.Err {
+			t.Fatalf("expected %v, got %v", ErrShutdownTimeout, err)
+		}
+
+		if !strings.Contains(err.Error(), "1 messages abandoned") {
+			t.Errorf("expected the abandoned messages to be reported, got %v", err)
+		}
+
+		close(release)
+		if err := c.Shutdown(context.Background()); err != nil {
+			t.Fatalf("should not return an error once the handlers finished, got %v", err)
+		}
+
+		if n := ops.count("DeleteMessage"); n != 1 {
+			t.Errorf("expected the in-flight message to be processed, got %d deletes", n)
+		}
+	})
+
+	t.Run("not_started", func(t *testing.T) {
+		c, _ := getStubConsumer(t, nil)
+		if err := c.Stop(context.Background()); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+	})
+}
+
+func TestStopDrainsWorkers(t *testing.T) {
+	var once sync.Once
+	c, ops := getStubConsumer(t, func(r *request.Request) {
+		if r.Operation.Name != "ReceiveMessage" {
+			return
+		}
+
+		delivered := false
+		once.Do(func() {
+			delivered = true
+			out := r.Data.(*sqs.ReceiveMessageOutput)
+			for i := 0; i < 6; i++ {
+				out.Messages = append(out.Messages, &sqs.Message{
+					Body:              aws.String(`{"val":"val"}`),
+					ReceiptHandle:     aws.String(fmt.Sprintf("receipt-handle-%d", i)),
+					MessageAttributes: defaultSQSAttributes("post_published"),
+				})
+			}
+		})
+
+		if !delivered {
+			<-r.Context().Done()
+			r.Error = r.Context().Err()
+		}
+	})
+	c.workerPool = 3
+
+	var started int64
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		atomic.AddInt64(&started, 1)
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}, HandlerOptions{WithoutExtension: true})
+
+	go c.Consume()
+	for atomic.LoadInt64(&started) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	// every received message is handed to a worker and processed before Stop returns, including the ones that
+	// were still waiting for a free worker
+	if n := ops.count("DeleteMessage"); n != 6 {
+		t.Errorf("expected all received messages to be processed, got %d deletes", n)
+	}
+
+	if n := atomic.LoadInt64(&c.inFlight); n != 0 {
+		t.Errorf("expected no messages in flight, got %d", n)
+	}
+}
+
+func TestRunUntilSignal(t *testing.T) {
+	c, ops, handled := getStubRunningConsumer(t, func(ctx context.Context, m Message) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	c.gracePeriod = time.Second
+
+	signals := make(chan os.Signal, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- c.runUntilSignal(context.Background(), signals)
+	}()
+
+	<-handled
+	signals <- syscall.SIGTERM
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("did not return after the signal")
+	}
+
+	if n := ops.count("DeleteMessage"); n != 1 {
+		t.Errorf("expected the in-flight message to be processed, got %d deletes", n)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/qhenkart/gosqs"
 )
@@ -14,6 +16,30 @@ type StubMessage struct {
 	body     []byte
 	Err      error
 	Endpoint string
+	// Attributes emulates the custom attributes of the message
+	Attributes map[string]string
+	// FirstReceived emulates the time the message was first received
+	FirstReceived time.Time
+	// MessageAge emulates how long ago the message was sent
+	MessageAge time.Duration
+	// Receives emulates the amount of times the message was received
+	Receives int
+	// Meta emulates the metadata of the SNS envelope the message was delivered in
+	Meta gosqs.SNSMeta
+	// Committed is set once the handler commits the message
+	Committed bool
+	// DeadLettered is set once the handler moves the message to the DLQ
+	DeadLettered bool
+	// Acked is set once the handler acks the message
+	Acked bool
+	// Nacked is set once the handler nacks the message
+	Nacked bool
+	// Trace emulates the AWS X-Ray trace header of the message
+	Trace string
+	// Deferred records the delay the handler rescheduled the message with
+	Deferred time.Duration
+	// Extensions records the seconds of every Extend call
+	Extensions []int
 }
 
 // NewStubMessage returns an encoded stubmessage that is ready to emulate the sqs messenger
@@ -71,6 +97,11 @@ func (sm *StubMessage) DecodeModified(body interface{}, changes interface{}) err
 	return sm.Decode(&s)
 }
 
+// Peek returns a top-level string field of the stub body
+func (sm *StubMessage) Peek(field string) (string, error) {
+	return gosqs.Peek(sm, field)
+}
+
 // ErrorResponse applies an error to the stub message and returns
 func (sm *StubMessage) ErrorResponse(ctx context.Context, err error) error {
 	sm.Err = err
@@ -82,9 +113,108 @@ func (sm *StubMessage) Success(ctx context.Context) error {
 	return nil
 }
 
-// Attribute returns a fake attribute
+// Attribute returns the fake attribute set in Attributes
 func (sm *StubMessage) Attribute(key string) string {
-	return ""
+	return sm.Attributes[key]
+}
+
+// AttributeInt returns the fake attribute set in Attributes converted to an int
+func (sm *StubMessage) AttributeInt(key string) (int, error) {
+	val, ok := sm.Attributes[key]
+	if !ok {
+		return 0, gosqs.ErrAttributeNotFound.Context(fmt.Errorf("%s", key))
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, gosqs.ErrAttributeType.Context(err)
+	}
+	return n, nil
+}
+
+// AttributeBool returns the fake attribute set in Attributes converted to a bool
+func (sm *StubMessage) AttributeBool(key string) (bool, error) {
+	val, ok := sm.Attributes[key]
+	if !ok {
+		return false, gosqs.ErrAttributeNotFound.Context(fmt.Errorf("%s", key))
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, gosqs.ErrAttributeType.Context(err)
+	}
+	return b, nil
+}
+
+// FirstReceiveTime returns the fake time set in FirstReceived
+func (sm *StubMessage) FirstReceiveTime() time.Time {
+	return sm.FirstReceived
+}
+
+// ReceiveCount returns the fake amount of receives set in Receives
+func (sm *StubMessage) ReceiveCount() int {
+	return sm.Receives
+}
+
+// Age returns the fake age set in MessageAge
+func (sm *StubMessage) Age() time.Duration {
+	return sm.MessageAge
+}
+
+// SNSMeta returns the fake metadata set in Meta
+func (sm *StubMessage) SNSMeta() gosqs.SNSMeta {
+	return sm.Meta
+}
+
+// TraceHeader returns the fake trace header set in Trace
+func (sm *StubMessage) TraceHeader() string {
+	return sm.Trace
+}
+
+// Commit marks the stub message as committed
+func (sm *StubMessage) Commit(ctx context.Context) error {
+	sm.Committed = true
+	return nil
+}
+
+// Ack marks the stub message as acked
+func (sm *StubMessage) Ack(ctx context.Context) error {
+	sm.Acked = true
+	return nil
+}
+
+// Nack marks the stub message as nacked
+func (sm *StubMessage) Nack(ctx context.Context) error {
+	sm.Nacked = true
+	return nil
+}
+
+// DeadLetter marks the stub message as dead-lettered
+func (sm *StubMessage) DeadLetter(ctx context.Context) error {
+	sm.DeadLettered = true
+	return nil
+}
+
+// Defer records the delay in Deferred
+func (sm *StubMessage) Defer(d time.Duration) error {
+	sm.Deferred = d
+	return nil
+}
+
+// Extend records the requested seconds in Extensions
+func (sm *StubMessage) Extend(ctx context.Context, seconds int) error {
+	sm.Extensions = append(sm.Extensions, seconds)
+	return nil
+}
+
+// DecodeS3Event parses the stub body as an S3 event notification
+func (sm *StubMessage) DecodeS3Event() ([]gosqs.S3Record, error) {
+	return gosqs.DecodeS3Event(sm)
+}
+
+// DecodeAttributes populates the supplied struct with the fake attributes set in Attributes
+func (sm *StubMessage) DecodeAttributes(out interface{}) error {
+	return gosqs.DecodeAttributes(sm, out)
 }
 
 // StubConsumer provides a stub framework for consumer unit tests
@@ -97,6 +227,14 @@ func (sm *StubMessage) Attribute(key string) string {
 type StubConsumer struct {
 	DirectMessages []SentMessage
 	EventList      []string
+	// FIFO is returned by IsFIFO
+	FIFO bool
+	// EffectiveConf is returned by EffectiveConfig
+	EffectiveConf gosqs.Config
+	// Info is returned by Config
+	Info gosqs.ConsumerInfo
+	// Visible and NotVisible are returned by QueueDepth
+	Visible, NotVisible int
 }
 
 // NewStubConsumer provides a stub consumer/publisher to place into the handler or context
@@ -111,30 +249,69 @@ type SentMessage struct {
 	QueueName string
 	Event     string
 	Body      interface{}
+	// Delay is the delivery delay the message was sent with
+	Delay time.Duration
 }
 
 // Consume satisfies the Consumer interface
 func (c *StubConsumer) Consume() {}
 
+// ConsumeWithContext satisfies the Consumer interface
+func (c *StubConsumer) ConsumeWithContext(ctx context.Context) {}
+
+// Run satisfies the Consumer interface
+func (c *StubConsumer) Run(ctx context.Context) error { return nil }
+
+// Stop satisfies the Consumer interface
+func (c *StubConsumer) Stop(ctx context.Context) error { return nil }
+
+// Shutdown satisfies the Consumer interface
+func (c *StubConsumer) Shutdown(ctx context.Context) error { return nil }
+
+// RunUntilSignal satisfies the Consumer interface
+func (c *StubConsumer) RunUntilSignal(ctx context.Context) error { return nil }
+
 // MessageSelf saves the message into the local map with the queue name listed as "self"
 // satisfies the Consumer interface
-func (c *StubConsumer) MessageSelf(ctx context.Context, event string, body interface{}) {
+func (c *StubConsumer) MessageSelf(ctx context.Context, event string, body interface{}, attributes ...gosqs.CustomAttribute) {
 	sm := SentMessage{
 		QueueName: "self",
 		Event:     event,
 		Body:      body,
+		Delay:     gosqs.Delay(ctx),
 	}
 	c.DirectMessages = append(c.DirectMessages, sm)
 	c.EventList = append(c.EventList, sm.Event)
 
 }
 
+// CreateBatch saves every message in the dispatcher array and satisfies the Publisher interface
+func (c *StubPublisher) CreateBatch(ns []gosqs.Notifier) []gosqs.BatchResult {
+	return c.DispatchBatch(ns, "created")
+}
+
+// UpdateBatch saves every message in the dispatcher array and satisfies the Publisher interface
+func (c *StubPublisher) UpdateBatch(ns []gosqs.Notifier) []gosqs.BatchResult {
+	return c.DispatchBatch(ns, "updated")
+}
+
+// DispatchBatch saves every message in the dispatcher array and satisfies the Publisher interface
+func (c *StubPublisher) DispatchBatch(ns []gosqs.Notifier, event string) []gosqs.BatchResult {
+	results := make([]gosqs.BatchResult, 0, len(ns))
+	for i, n := range ns {
+		c.Dispatch(n, event)
+		results = append(results, gosqs.BatchResult{Index: i, Event: fmt.Sprintf("%s_%s", n.ModelName(), event)})
+	}
+	return results
+}
+
 // Message saves the message into the local map and satisfies the Consumer interface
-func (c *StubConsumer) Message(ctx context.Context, queue, event string, body interface{}) {
+func (c *StubConsumer) Message(ctx context.Context, queue, event string, body interface{}, attributes ...gosqs.CustomAttribute) {
 	sm := SentMessage{
 		QueueName: queue,
 		Event:     event,
 		Body:      body,
+		Delay:     gosqs.Delay(ctx),
 	}
 	c.DirectMessages = append(c.DirectMessages, sm)
 	c.EventList = append(c.EventList, sm.Event)
@@ -143,6 +320,69 @@ func (c *StubConsumer) Message(ctx context.Context, queue, event string, body in
 // RegisterHandler satisfies the Consumer interface
 func (c *StubConsumer) RegisterHandler(name string, h gosqs.Handler, a ...gosqs.Adapter) {}
 
+// RegisterBatchHandler satisfies the Consumer interface
+func (c *StubConsumer) RegisterBatchHandler(name string, h gosqs.BatchHandler) {}
+
+// RegisterTopicHandler satisfies the Consumer interface
+func (c *StubConsumer) RegisterTopicHandler(topicARN, name string, h gosqs.Handler, a ...gosqs.Adapter) {}
+
+// RegisterReplyHandler satisfies the Consumer interface
+func (c *StubConsumer) RegisterReplyHandler(name string, h gosqs.ReplyHandler, a ...gosqs.Adapter) {}
+
+// RegisterHandlerWeighted satisfies the Consumer interface
+func (c *StubConsumer) RegisterHandlerWeighted(name string, h gosqs.Handler, weight int, a ...gosqs.Adapter) {}
+
+// RegisterHandlerWeightedWithOptions satisfies the Consumer interface
+func (c *StubConsumer) RegisterHandlerWeightedWithOptions(name string, h gosqs.Handler, weight int, opts gosqs.HandlerOptions, a ...gosqs.Adapter) {
+}
+
+// RegisterHandlerWithOptions satisfies the Consumer interface
+func (c *StubConsumer) RegisterHandlerWithOptions(name string, h gosqs.Handler, opts gosqs.HandlerOptions, a ...gosqs.Adapter) {
+}
+
+// IsFIFO returns the fake value set in FIFO and satisfies the Consumer interface
+func (c *StubConsumer) IsFIFO() bool {
+	return c.FIFO
+}
+
+// QueueDepth returns the fake values set in Visible and NotVisible and satisfies the Consumer interface
+func (c *StubConsumer) QueueDepth(ctx context.Context) (int, int, error) {
+	return c.Visible, c.NotVisible, nil
+}
+
+// Subscribe satisfies the Consumer interface
+func (c *StubConsumer) Subscribe(ctx context.Context, topicARN string, routes ...string) error { return nil }
+
+// SetVisibilityTimeout satisfies the Consumer interface
+func (c *StubConsumer) SetVisibilityTimeout(seconds int) {}
+
+// SetExtensionLimit satisfies the Consumer interface
+func (c *StubConsumer) SetExtensionLimit(n int) {}
+
+// SetWorkerPool satisfies the Consumer interface
+func (c *StubConsumer) SetWorkerPool(n int) {}
+
+// EffectiveConfig returns the fake config set in EffectiveConf and satisfies the Consumer interface
+func (c *StubConsumer) EffectiveConfig() gosqs.Config {
+	return c.EffectiveConf
+}
+
+// DumpToFile satisfies the Consumer interface
+func (c *StubConsumer) DumpToFile(ctx context.Context, path string, max int) (int, error) { return 0, nil }
+
+// ReplayFromFile satisfies the Consumer interface
+func (c *StubConsumer) ReplayFromFile(ctx context.Context, path, queueURL string) (int, error) { return 0, nil }
+
+// ReplayFromFileAt satisfies the Consumer interface
+func (c *StubConsumer) ReplayFromFileAt(ctx context.Context, path, queueURL string, offset int64) (int, int64, error) {
+	return 0, offset, nil
+}
+
+// Config returns the fake settings set in Info and satisfies the Consumer interface
+func (c *StubConsumer) Config() gosqs.ConsumerInfo {
+	return c.Info
+}
+
 // StubPublisher provides a stub framework for service unit tests
 //
 // SNS messages event names will go into the DispatcherMessages string array
@@ -154,6 +394,10 @@ type StubPublisher struct {
 	DirectMessages     []SentMessage
 	DispatcherMessages []SentMessage
 	EventList          []string
+	// Topic is returned by TopicARN
+	Topic string
+	// Config is returned by EffectiveConfig
+	Config gosqs.Config
 }
 
 // NewStubDispatcher provides a stub publisher to place into the handler or context
@@ -225,3 +469,40 @@ func (c *StubPublisher) Message(queue, event string, body interface{}) {
 	c.DirectMessages = append(c.DirectMessages, sm)
 	c.EventList = append(c.EventList, sm.Event)
 }
+
+// MessageWithDelay saves the message along with its delay into the local map and satisfies the Publisher interface
+func (c *StubPublisher) MessageWithDelay(queue, event string, body interface{}, delay time.Duration) {
+	sm := SentMessage{
+		QueueName: queue,
+		Event:     event,
+		Body:      body,
+		Delay:     delay,
+	}
+	c.DirectMessages = append(c.DirectMessages, sm)
+	c.EventList = append(c.EventList, sm.Event)
+}
+
+// ReplayFromFile satisfies the Publisher interface
+func (c *StubPublisher) ReplayFromFile(ctx context.Context, path, queueURL string) (int, error) { return 0, nil }
+
+// ReplayFromFileAt satisfies the Publisher interface
+func (c *StubPublisher) ReplayFromFileAt(ctx context.Context, path, queueURL string, offset int64) (int, int64, error) {
+	return 0, offset, nil
+}
+
+// MessageBatch saves every entry into the direct messages and satisfies the Publisher interface
+func (c *StubPublisher) MessageBatch(queue string, msgs []gosqs.BatchEntry) {
+	for _, m := range msgs {
+		c.Message(queue, m.Event, m.Body)
+	}
+}
+
+// TopicARN returns the fake topic set in Topic and satisfies the Publisher interface
+func (c *StubPublisher) TopicARN() string {
+	return c.Topic
+}
+
+// EffectiveConfig returns the fake config set in Config and satisfies the Publisher interface
+func (c *StubPublisher) EffectiveConfig() gosqs.Config {
+	return c.Config
+}
@@ -75,6 +75,16 @@ func TestErrorResponse(t *testing.T) {
 	}
 }
 
+func TestExtend(t *testing.T) {
+	m := NewStubMessage(t, sample{"name"})
+	m.Extend(context.TODO(), 60)
+	m.Extend(context.TODO(), 120)
+
+	if len(m.Extensions) != 2 || m.Extensions[1] != 120 {
+		t.Fatalf("expected the requested extensions to be recorded, got %v", m.Extensions)
+	}
+}
+
 func TestMessageSelf(t *testing.T) {
 	stub := NewStubConsumer()
 	stub.MessageSelf(context.TODO(), "some_event", nil)
@@ -175,3 +185,38 @@ func TestDisp(t *testing.T) {
 		t.Fatalf("expected sample_random_event, got %s", stub.EventList[0])
 	}
 }
+
+func TestDecodeAttributes(t *testing.T) {
+	m := NewStubMessage(t, sample{"name"})
+	m.Attributes = map[string]string{"tenant_id": "tenant", "retries": "3"}
+
+	var out struct {
+		TenantID string `sqsattr:"tenant_id"`
+		Retries  int    `sqsattr:"retries"`
+	}
+	if err := m.DecodeAttributes(&out); err != nil {
+		t.Fatalf("decode error, got %v", err)
+	}
+
+	if out.TenantID != "tenant" || out.Retries != 3 {
+		t.Fatalf("unexpected response, got %+v", out)
+	}
+}
+
+func TestReceiveCount(t *testing.T) {
+	var loud bool
+	handler := func(ctx context.Context, m gosqs.Message) error {
+		loud = m.ReceiveCount() >= 3
+		return nil
+	}
+
+	m := NewStubMessage(t, sample{"name"})
+	if handler(context.TODO(), m); loud {
+		t.Fatal("did not expect the first receive to be logged loudly")
+	}
+
+	m.Receives = 3
+	if handler(context.TODO(), m); !loud {
+		t.Fatal("expected the third receive to be logged loudly")
+	}
+}
@@ -0,0 +1,138 @@
+package gosqs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// queuePolicy is the json structure of the Policy queue attribute. Statements are kept as is so that existing
+// statements survive when the policy is rewritten
+type queuePolicy struct {
+	Version   string            `json:"Version"`
+	ID        string            `json:"Id,omitempty"`
+	Statement []json.RawMessage `json:"Statement"`
+}
+
+// policyStatement is the statement allowing a topic to send messages to the queue
+type policyStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Principal map[string]string            `json:"Principal"`
+	Action    string                       `json:"Action"`
+	Resource  string                       `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition"`
+}
+
+// Subscribe subscribes the queue of the consumer to the topic with raw message delivery enabled. If routes are
+// provided, a filter policy on the route attribute is applied so only those events are delivered. The queue policy is
+// updated to allow the topic to send messages to the queue
+//
+// Subscribe changes IAM policies and must be enabled with Config.AllowSubscribe. It is idempotent and intended for
+// bootstrapping development, test and ephemeral environments. It requires a consumer created with NewConsumer
+func (c *consumer) Subscribe(ctx context.Context, topicARN string, routes ...string) error {
+	if !c.allowSubscribe {
+		return ErrSubscribeNotAllowed
+	}
+
+	if c.sns == nil {
+		return ErrSubscribe.Context(fmt.Errorf("the consumer has no sns client"))
+	}
+
+	queueURL := c.queueURL()
+	out, err := c.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn), aws.String(sqs.QueueAttributeNamePolicy)},
+	})
+	if err != nil {
+		return ErrSubscribe.Context(err)
+	}
+
+	queueARN := aws.StringValue(out.Attributes[sqs.QueueAttributeNameQueueArn])
+	if queueARN == "" {
+		return ErrSubscribe.Context(fmt.Errorf("unable to determine the queue arn"))
+	}
+
+	policy, changed, err := allowTopic(aws.StringValue(out.Attributes[sqs.QueueAttributeNamePolicy]), queueARN, topicARN)
+	if err != nil {
+		return ErrSubscribe.Context(err)
+	}
+
+	if changed {
+		if _, err := c.sqs.SetQueueAttributesWithContext(ctx, &sqs.SetQueueAttributesInput{
+			QueueUrl:   &queueURL,
+			Attributes: map[string]*string{sqs.QueueAttributeNamePolicy: &policy},
+		}); err != nil {
+			return ErrSubscribe.Context(err)
+		}
+	}
+
+	attributes := map[string]*string{"RawMessageDelivery": aws.String("true")}
+	if len(routes) > 0 {
+		filter, err := json.Marshal(map[string][]string{"route": routes})
+		if err != nil {
+			return ErrSubscribe.Context(err)
+		}
+		attributes["FilterPolicy"] = aws.String(string(filter))
+	}
+
+	// sns returns the existing subscription when the queue is already subscribed with the same attributes
+	if _, err := c.sns.SubscribeWithContext(ctx, &sns.SubscribeInput{
+		TopicArn:              &topicARN,
+		Protocol:              aws.String("sqs"),
+		Endpoint:              &queueARN,
+		Attributes:            attributes,
+		ReturnSubscriptionArn: aws.Bool(true),
+	}); err != nil {
+		return ErrSubscribe.Context(err)
+	}
+
+	return nil
+}
+
+// allowTopic adds a statement allowing the topic to send messages to the queue to the policy. It reports whether the
+// policy was changed, a policy that already allows the topic is returned as is
+func allowTopic(policy, queueARN, topicARN string) (string, bool, error) {
+	h := fnv.New32a()
+	h.Write([]byte(topicARN))
+	sid := fmt.Sprintf("gosqs%x", h.Sum32())
+
+	p := queuePolicy{Version: "2012-10-17"}
+	if policy != "" {
+		if err := json.Unmarshal([]byte(policy), &p); err != nil {
+			return "", false, err
+		}
+	}
+
+	for _, raw := range p.Statement {
+		var s struct{ Sid string }
+		if json.Unmarshal(raw, &s) == nil && s.Sid == sid {
+			return policy, false, nil
+		}
+	}
+
+	statement, err := json.Marshal(policyStatement{
+		Sid:       sid,
+		Effect:    "Allow",
+		Principal: map[string]string{"Service": "sns.amazonaws.com"},
+		Action:    "sqs:SendMessage",
+		Resource:  queueARN,
+		Condition: map[string]map[string]string{"ArnEquals": {"aws:SourceArn": topicARN}},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	p.Statement = append(p.Statement, statement)
+
+	out, err := json.Marshal(p)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(out), true, nil
+}
@@ -0,0 +1,119 @@
+package gosqs
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const subscribeTopic = "arn:aws:sns:local:000000000000:todolist-dev"
+
+// getStubSubscriber creates a consumer allowed to subscribe whose queue policy is kept in policy
+func getStubSubscriber(t *testing.T, policy *string) (*consumer, *operations, *[]*sns.SubscribeInput) {
+	var subscriptions []*sns.SubscribeInput
+	respond := func(r *request.Request) {
+		switch in := r.Params.(type) {
+		case *sqs.GetQueueAttributesInput:
+			r.Data.(*sqs.GetQueueAttributesOutput).Attributes = map[string]*string{
+				sqs.QueueAttributeNameQueueArn: aws.String("arn:aws:sqs:local:000000000000:dev-post-worker"),
+				sqs.QueueAttributeNamePolicy:   aws.String(*policy),
+			}
+		case *sqs.SetQueueAttributesInput:
+			*policy = *in.Attributes[sqs.QueueAttributeNamePolicy]
+		case *sns.SubscribeInput:
+			subscriptions = append(subscriptions, in)
+		}
+	}
+
+	c, ops := getStubConsumer(t, respond)
+
+	snsClient := sns.New(stubSession)
+	stubClient(&snsClient.Handlers, ops, respond)
+	c.sns = snsClient
+	c.allowSubscribe = true
+
+	return c, ops, &subscriptions
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Run("not_allowed", func(t *testing.T) {
+		var policy string
+		c, ops, _ := getStubSubscriber(t, &policy)
+		c.allowSubscribe = false
+
+		if err := c.Subscribe(context.TODO(), subscribeTopic); err != ErrSubscribeNotAllowed {
+			t.Fatalf("expected %v, got %v", ErrSubscribeNotAllowed, err)
+		}
+
+		if len(ops.names) != 0 {
+			t.Errorf("expected no requests, got %v", ops.names)
+		}
+	})
+
+	t.Run("subscribed", func(t *testing.T) {
+		policy := `{"Version":"2012-10-17","Statement":[{"Sid":"existing","Effect":"Deny"}]}`
+		c, _, subscriptions := getStubSubscriber(t, &policy)
+
+		if err := c.Subscribe(context.TODO(), subscribeTopic, "post_created", "post_deleted"); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		var p queuePolicy
+		if err := json.Unmarshal([]byte(policy), &p); err != nil {
+			t.Fatalf("invalid policy %s, got %v", policy, err)
+		}
+
+		if len(p.Statement) != 2 {
+			t.Fatalf("expected the existing statement to be retained, got %s", policy)
+		}
+
+		var s policyStatement
+		json.Unmarshal(p.Statement[1], &s)
+		if s.Condition["ArnEquals"]["aws:SourceArn"] != subscribeTopic || s.Resource != "arn:aws:sqs:local:000000000000:dev-post-worker" {
+			t.Errorf("unexpected statement, got %+v", s)
+		}
+
+		if len(*subscriptions) != 1 {
+			t.Fatalf("expected a single subscription, got %d", len(*subscriptions))
+		}
+
+		in := (*subscriptions)[0]
+		if *in.Protocol != "sqs" || *in.Endpoint != "arn:aws:sqs:local:000000000000:dev-post-worker" || *in.TopicArn != subscribeTopic {
+			t.Errorf("unexpected subscription, got %+v", in)
+		}
+
+		if v := *in.Attributes["RawMessageDelivery"]; v != "true" {
+			t.Errorf("expected raw message delivery, got %s", v)
+		}
+
+		if v := *in.Attributes["FilterPolicy"]; v != `{"route":["post_created","post_deleted"]}` {
+			t.Errorf("unexpected filter policy, got %s", v)
+		}
+	})
+
+	t.Run("idempotent", func(t *testing.T) {
+		var policy string
+		c, ops, _ := getStubSubscriber(t, &policy)
+
+		for i := 0; i < 2; i++ {
+			if err := c.Subscribe(context.TODO(), subscribeTopic); err != nil {
+				t.Fatalf("should not return an error, got %v", err)
+			}
+		}
+
+		if n := ops.count("SetQueueAttributes"); n != 1 {
+			t.Errorf("expected the policy to be set once, got %d", n)
+		}
+
+		var p queuePolicy
+		json.Unmarshal([]byte(policy), &p)
+		if len(p.Statement) != 1 {
+			t.Errorf("expected a single statement, got %s", policy)
+		}
+	})
+}
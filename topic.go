@@ -0,0 +1,32 @@
+package gosqs
+
+// RegisterTopicHandler registers a handler for the route of messages published to the topic, e.g. when the queue is
+// subscribed to multiple topics that publish the same routes. A topic handler takes precedence over a handler
+// registered for the route alone, which handles the messages of every other topic
+//
+// The topic is read from the SNS envelope, messages delivered with raw message delivery do not carry it and are only
+// handled by the handlers registered for the route alone
+func (c *consumer) RegisterTopicHandler(topicARN, name string, h Handler, adapters ...Adapter) {
+	if c.topicHandlers == nil {
+		c.topicHandlers = make(map[string]map[string]*route)
+	}
+
+	if c.topicHandlers[topicARN] == nil {
+		c.topicHandlers[topicARN] = make(map[string]*route)
+	}
+
+	c.topicHandlers[topicARN][name] = newRoute(h, HandlerOptions{}, adapters...)
+}
+
+// routeFor returns the route handling the message, the handler registered for the topic of the message and its route
+// is preferred over the handler registered for the route alone
+func (c *consumer) routeFor(m *message) (*route, bool) {
+	if topic := m.SNSMeta().TopicArn; topic != "" {
+		if r, ok := c.topicHandlers[topic][m.Route()]; ok {
+			return r, true
+		}
+	}
+
+	r, ok := c.handlers[m.Route()]
+	return r, ok
+}
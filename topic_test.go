@@ -0,0 +1,45 @@
+package gosqs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestRegisterTopicHandler(t *testing.T) {
+	const (
+		ordersTopic  = "arn:aws:sns:us-west-1:000000000000:orders-dev"
+		refundsTopic = "arn:aws:sns:us-west-1:000000000000:refunds-dev"
+	)
+
+	fromTopic := func(topic string) *message {
+		body := strings.Replace(snsNotification, "arn:aws:sns:us-west-1:000000000000:todolist-dev", topic, 1)
+		return newMessage(&sqs.Message{Body: aws.String(body), ReceiptHandle: aws.String("receipt-handle")})
+	}
+
+	var handled []string
+	handler := func(name string) Handler {
+		return func(ctx context.Context, m Message) error {
+			handled = append(handled, name)
+			return nil
+		}
+	}
+
+	c, _ := getStubConsumer(t, nil)
+	c.RegisterHandlerWithOptions("post_created", handler("route"), HandlerOptions{WithoutExtension: true})
+	c.RegisterTopicHandler(ordersTopic, "post_created", handler("orders"))
+
+	for _, m := range []*message{fromTopic(ordersTopic), fromTopic(refundsTopic), newStubMessage("post_created", `{}`)} {
+		if err := c.run(context.Background(), m); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+	}
+
+	expected := []string{"orders", "route", "route"}
+	if strings.Join(handled, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected handlers, expected %v, got %v", expected, handled)
+	}
+}
@@ -0,0 +1,36 @@
+package gosqs
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const traceHeaderKey = contextKey("traceHeader")
+
+// WithTraceHeader adds the AWS X-Ray trace header to the context. Messages sent by the consumer with this context
+// carry the header so the trace continues through the queue
+func WithTraceHeader(ctx context.Context, header string) context.Context {
+	return context.WithValue(ctx, traceHeaderKey, header)
+}
+
+// TraceHeader retrieves the AWS X-Ray trace header from the context. The context of a handler carries the trace header
+// of the message it is processing, use it to continue the trace in instrumented downstream calls
+func TraceHeader(ctx context.Context) string {
+	h, _ := ctx.Value(traceHeaderKey).(string)
+	return h
+}
+
+// traceAttributes provides the system attributes propagating the trace header of the context, it returns nil if the
+// context does not carry one
+func traceAttributes(ctx context.Context) map[string]*sqs.MessageSystemAttributeValue {
+	h := TraceHeader(ctx)
+	if h == "" {
+		return nil
+	}
+
+	return map[string]*sqs.MessageSystemAttributeValue{
+		sqs.MessageSystemAttributeNameForSendsAwstraceHeader: {DataType: aws.String(DataTypeString.String()), StringValue: &h},
+	}
+}
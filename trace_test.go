@@ -0,0 +1,68 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const traceHeader = "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+
+func TestTraceHeaderExtraction(t *testing.T) {
+	c, _ := getStubConsumer(t, nil)
+
+	var got string
+	c.RegisterHandlerWithOptions("post_published", func(ctx context.Context, m Message) error {
+		got = TraceHeader(ctx)
+		return nil
+	}, HandlerOptions{WithoutExtension: true})
+
+	m := newStubMessage("post_published", `{}`)
+	m.Attributes = map[string]*string{sqs.MessageSystemAttributeNameAwstraceHeader: aws.String(traceHeader)}
+
+	if m.TraceHeader() != traceHeader {
+		t.Errorf("unexpected trace header, got %s", m.TraceHeader())
+	}
+
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if got != traceHeader {
+		t.Errorf("expected the trace header in the handler context, got %s", got)
+	}
+
+	if h := newStubMessage("post_published", `{}`).TraceHeader(); h != "" {
+		t.Errorf("expected no trace header, got %s", h)
+	}
+}
+
+func TestTraceHeaderPropagation(t *testing.T) {
+	sent := make(chan *sqs.SendMessageInput, 1)
+	c, _ := getStubConsumer(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sqs.SendMessageInput); ok {
+			sent <- in
+		}
+	})
+
+	c.MessageSelf(WithTraceHeader(context.Background(), traceHeader), "post_published", &sample{})
+
+	select {
+	case in := <-sent:
+		attr, ok := in.MessageSystemAttributes[sqs.MessageSystemAttributeNameForSendsAwstraceHeader]
+		if !ok || *attr.StringValue != traceHeader {
+			t.Errorf("expected the trace header to be propagated, got %v", in.MessageSystemAttributes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the message was not sent")
+	}
+
+	c.MessageSelf(context.Background(), "post_published", &sample{})
+	if in := <-sent; in.MessageSystemAttributes != nil {
+		t.Errorf("expected no system attributes without a trace header, got %v", in.MessageSystemAttributes)
+	}
+}
@@ -0,0 +1,52 @@
+package gosqs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// RegisterTypedHandler registers a handler for the route derived from the type T and the verb, the message body is
+// decoded into a new T before the handler is run. The route follows the naming of the publisher: the model name of T
+// followed by the verb, e.g. a *Post with the model name post registered with the verb created handles post_created.
+// Types that do not implement Notifier use their lowercased type name instead of the model name
+//
+// Modify events are sent with the changes alongside the body, use RegisterHandler with DecodeModified for them
+func RegisterTypedHandler[T any](c Consumer, verb string, fn func(ctx context.Context, v T, m Message) error, adapters ...Adapter) {
+	c.RegisterHandler(typedRoute[T](verb), func(ctx context.Context, m Message) error {
+		v := newTyped[T]()
+		if err := m.Decode(v); err != nil {
+			return ErrMarshal.Context(err)
+		}
+
+		return fn(ctx, *v, m)
+	}, adapters...)
+}
+
+// typedRoute derives the route of the type T and the verb, e.g. post_created
+func typedRoute[T any](verb string) string {
+	model := reflect.TypeOf((*T)(nil)).Elem()
+
+	name := strings.ToLower(model.Name())
+	if model.Kind() == reflect.Ptr {
+		name = strings.ToLower(model.Elem().Name())
+	}
+
+	if n, ok := interface{}(*newTyped[T]()).(Notifier); ok {
+		name = n.ModelName()
+	}
+
+	return fmt.Sprintf("%s_%s", name, verb)
+}
+
+// newTyped returns a pointer to a new T. If T is a pointer type, the pointer it holds is initialized as well so the
+// body can be decoded into it and methods can be called on it
+func newTyped[T any]() *T {
+	v := new(T)
+	if rv := reflect.ValueOf(v).Elem(); rv.Kind() == reflect.Ptr {
+		rv.Set(reflect.New(rv.Type().Elem()))
+	}
+
+	return v
+}
@@ -0,0 +1,80 @@
+package gosqs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+type plainEvent struct {
+	Val string `json:"val"`
+}
+
+func TestTypedRoute(t *testing.T) {
+	if r := typedRoute[*sample]("created"); r != "sample_created" {
+		t.Errorf("expected the model name to be used, got %s", r)
+	}
+
+	if r := typedRoute[plainEvent]("created"); r != "plainevent_created" {
+		t.Errorf("expected the type name to be used, got %s", r)
+	}
+}
+
+func TestRegisterTypedHandler(t *testing.T) {
+	published := make(chan *sns.PublishInput, 1)
+	p, _ := getStubPublisher(t, func(r *request.Request) {
+		if in, ok := r.Params.(*sns.PublishInput); ok {
+			published <- in
+		}
+	})
+
+	c, ops := getStubConsumer(t, nil)
+
+	var got *sample
+	RegisterTypedHandler(c, "created", func(ctx context.Context, s *sample, m Message) error {
+		got = s
+		return nil
+	})
+
+	p.Create(&sample{Val: "val"})
+	in := <-published
+
+	// deliver the notification as sns would with raw message delivery
+	attrs := make(map[string]*sqs.MessageAttributeValue)
+	for k, v := range in.MessageAttributes {
+		attrs[k] = &sqs.MessageAttributeValue{DataType: v.DataType, StringValue: v.StringValue}
+	}
+	m := newMessage(&sqs.Message{Body: in.Message, ReceiptHandle: aws.String("receipt-handle"), MessageAttributes: attrs})
+
+	if err := c.run(context.Background(), m); err != nil {
+		t.Fatalf("should not return an error, got %v", err)
+	}
+
+	if got == nil || got.Val != "val" {
+		t.Fatalf("expected the typed handler to receive the decoded body, got %+v", got)
+	}
+
+	if n := ops.count("DeleteMessage"); n != 1 {
+		t.Errorf("expected the message to be deleted, got %d deletes", n)
+	}
+
+	t.Run("value_type", func(t *testing.T) {
+		var got plainEvent
+		RegisterTypedHandler(c, "created", func(ctx context.Context, e plainEvent, m Message) error {
+			got = e
+			return nil
+		})
+
+		if err := c.run(context.Background(), newStubMessage("plainevent_created", `{"val":"plain"}`)); err != nil {
+			t.Fatalf("should not return an error, got %v", err)
+		}
+
+		if got.Val != "plain" {
+			t.Errorf("expected the typed handler to receive the decoded body, got %+v", got)
+		}
+	})
+}
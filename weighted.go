@@ -0,0 +1,74 @@
+package gosqs
+
+import (
+	"context"
+	"math/rand"
+)
+
+// variant is one of the handlers registered for a weighted route along with its own options
+type variant struct {
+	*route
+	weight int
+}
+
+// RegisterHandlerWeighted registers one of several handler variants for the same route, e.g. to canary a new
+// implementation. Each message of the route is handled by a single variant, chosen at random in proportion to the
+// weights: registering a route with the weights 90 and 10 sends roughly a tenth of the messages to the second variant.
+// A variant with a weight of 0 or less receives no messages
+//
+// The adapters apply to the variant they are registered with. RegisterHandler replaces all variants of the route
+func (c *consumer) RegisterHandlerWeighted(name string, h Handler, weight int, adapters ...Adapter) {
+	c.RegisterHandlerWeightedWithOptions(name, h, weight, HandlerOptions{}, adapters...)
+}
+
+// RegisterHandlerWeightedWithOptions registers a handler variant like RegisterHandlerWeighted, the options apply to the
+// messages handled by this variant only
+func (c *consumer) RegisterHandlerWeightedWithOptions(name string, h Handler, weight int, opts HandlerOptions, adapters ...Adapter) {
+	if c.handlers == nil {
+		c.handlers = make(map[string]*route)
+	}
+
+	if weight < 0 {
+		weight = 0
+	}
+
+	v := newRoute(h, opts, adapters...)
+
+	r := c.handlers[name]
+	if r == nil || r.variants == nil {
+		r = &route{}
+		r.handler = func(ctx context.Context, m Message) error {
+			return c.pickVariant(r.variants).handler(ctx, m)
+		}
+		c.handlers[name] = r
+	}
+
+	r.variants = append(r.variants, &variant{route: v, weight: weight})
+}
+
+// pickVariant chooses a variant in proportion to the weights. If every weight is 0 the first variant is chosen
+func (c *consumer) pickVariant(variants []*variant) *variant {
+	var total int
+	for _, v := range variants {
+		total += v.weight
+	}
+
+	if total == 0 {
+		return variants[0]
+	}
+
+	intn := c.intn
+	if intn == nil {
+		intn = rand.Intn
+	}
+
+	n := intn(total)
+	for _, v := range variants {
+		if n < v.weight {
+			return v
+		}
+		n -= v.weight
+	}
+
+	return variants[len(variants)-1]
+}
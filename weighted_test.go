@@ -0,0 +1,88 @@
+package gosqs
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+)
+
+func TestRegisterHandlerWeighted(t *testing.T) {
+	counts := map[string]int{}
+	variant := func(name string) Handler {
+		return func(ctx context.Context, m Message) error {
+			counts[name]++
+			return nil
+		}
+	}
+
+	t.Run("split", func(t *testing.T) {
+		c, _ := getStubConsumer(t, nil)
+		c.intn = rand.New(rand.NewSource(1)).Intn
+		c.RegisterHandlerWeighted("post_published", variant("stable"), 90)
+		c.RegisterHandlerWeighted("post_published", variant("canary"), 10)
+
+		for i := 0; i < 1000; i++ {
+			if err := c.run(context.Background(), newStubMessage("post_published", `{"val":"val"}`)); err != nil {
+				t.Fatalf("should not return an error, got %v", err)
+			}
+		}
+
+		if counts["stable"]+counts["canary"] != 1000 {
+			t.Fatalf("expected every message to be handled once, got %v", counts)
+		}
+
+		if counts["canary"] < 70 || counts["canary"] > 130 {
+			t.Errorf("expected roughly 100 messages for the canary, got %d", counts["canary"])
+		}
+	})
+
+	t.Run("zero_weight", func(t *testing.T) {
+		counts = map[string]int{}
+		c, _ := getStubConsumer(t, nil)
+		c.RegisterHandlerWeighted("post_published", variant("stable"), 1)
+		c.RegisterHandlerWeighted("post_published", variant("drained"), 0)
+
+		for i := 0; i < 100; i++ {
+			c.handlers["post_published"].handler(context.TODO(), newStubMessage("post_published", `{}`))
+		}
+
+		if counts["drained"] != 0 {
+			t.Errorf("expected no messages for a zero weight, got %d", counts["drained"])
+		}
+	})
+
+	t.Run("replaced_by_register_handler", func(t *testing.T) {
+		counts = map[string]int{}
+		c, _ := getStubConsumer(t, nil)
+		c.RegisterHandlerWeightedWithOptions("post_published", variant("canary"), 1, HandlerOptions{WithoutExtension: true})
+		if c.handlers["post_published"].variants[0].extend {
+			t.Errorf("expected the extension to be disabled for the variant")
+		}
+
+		c.RegisterHandler("post_published", variant("single"))
+		c.handlers["post_published"].handler(context.TODO(), newStubMessage("post_published", `{}`))
+
+		if counts["single"] != 1 || counts["canary"] != 0 {
+			t.Errorf("expected RegisterHandler to replace the variants, got %v", counts)
+		}
+	})
+
+	t.Run("manual_ack", func(t *testing.T) {
+		c, ops := getStubConsumer(t, nil)
+		c.RegisterHandlerWeightedWithOptions("post_published", variant("stable"), 1, HandlerOptions{WithoutExtension: true})
+		c.RegisterHandlerWeightedWithOptions("post_published", variant("manual"), 1, HandlerOptions{WithoutExtension: true, ManualAck: true})
+
+		// the manual variant is picked first, the message is only deleted once the other one is picked
+		for i, pick := range []int{1, 0} {
+			pick, deletes := pick, i
+			c.intn = func(int) int { return pick }
+			if err := c.run(context.Background(), newStubMessage("post_published", `{}`)); err != nil {
+				t.Fatalf("should not return an error, got %v", err)
+			}
+
+			if n := ops.count("DeleteMessage"); n != deletes {
+				t.Errorf("expected %d deletes after picking variant %d, got %d", deletes, pick, n)
+			}
+		}
+	})
+}